@@ -0,0 +1,194 @@
+package analysis
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+	"github.com/kljensen/snowball"
+)
+
+// Languages are the languages that text can be stemmed and stripped of stop
+// words in
+var Languages = []string{"english", "french", "spanish", "russian", "swedish"}
+
+// Tokenisers are the ways in which text can be split into tokens -- standard
+// splits on whitespace and punctuation (keeping the punctuation as tokens of
+// its own) and whitespace splits on whitespace alone
+var Tokenisers = []string{"standard", "whitespace"}
+
+// DefaultAnalyzer is the analyzer used by text fields that don't name one
+var DefaultAnalyzer = "standard"
+
+// BuiltInAnalyzers map the name of each analyzer that is always available to
+// its settings
+var BuiltInAnalyzers = map[string]types.Analyzer{
+	"standard": {Tokeniser: "standard", Lowercase: true, Stemmer: "english"},
+	"simple":   {Tokeniser: "standard", Lowercase: true},
+	"english":  {Tokeniser: "standard", Lowercase: true, StopWords: "english", Stemmer: "english"},
+	"french":   {Tokeniser: "standard", Lowercase: true, StopWords: "french", Stemmer: "french"},
+	"spanish":  {Tokeniser: "standard", Lowercase: true, StopWords: "spanish", Stemmer: "spanish"},
+	"russian":  {Tokeniser: "standard", Lowercase: true, StopWords: "russian", Stemmer: "russian"},
+	"swedish":  {Tokeniser: "standard", Lowercase: true, StopWords: "swedish", Stemmer: "swedish"},
+}
+
+// ParseAnalyzer parses the settings of a custom analyzer, falling back to
+// those of the standard analyzer for any that are omitted
+func ParseAnalyzer(settings interface{}) (types.Analyzer, error) {
+
+	options, ok := settings.(map[string]interface{})
+
+	if ok == false {
+		return types.Analyzer{}, errors.New("Analyzer settings must be an object")
+	}
+
+	analyzer := BuiltInAnalyzers[DefaultAnalyzer]
+
+	if tokeniser, ok := options["tokeniser"]; ok {
+
+		tokeniserString, _ := tokeniser.(string)
+
+		if utils.StringInSlice(tokeniserString, Tokenisers) == false {
+			return types.Analyzer{}, errors.New("The tokeniser must be one of " + strings.Join(Tokenisers, ", "))
+		}
+
+		analyzer.Tokeniser = tokeniserString
+
+	}
+
+	if lowercase, ok := options["lowercase"]; ok {
+
+		lowercaseBool, ok := lowercase.(bool)
+
+		if ok == false {
+			return types.Analyzer{}, errors.New("The lowercase option must be a boolean")
+		}
+
+		analyzer.Lowercase = lowercaseBool
+
+	}
+
+	// Stop words and stemming can be turned off with an empty string or null
+	for key, target := range map[string]*string{"stop_words": &analyzer.StopWords, "stemmer": &analyzer.Stemmer} {
+
+		language, ok := options[key]
+
+		if ok == false {
+			continue
+		}
+
+		languageString, _ := language.(string)
+
+		if language != nil && languageString != "" && utils.StringInSlice(languageString, Languages) == false {
+			return types.Analyzer{}, errors.New("The " + key + " option must be one of " + strings.Join(Languages, ", "))
+		}
+
+		*target = languageString
+
+	}
+
+	return analyzer, nil
+
+}
+
+// EncodeAnalyzer converts an analyzer's settings back into the form they are
+// declared in
+func EncodeAnalyzer(analyzer types.Analyzer) map[string]interface{} {
+
+	return map[string]interface{}{
+		"tokeniser":  analyzer.Tokeniser,
+		"lowercase":  analyzer.Lowercase,
+		"stop_words": analyzer.StopWords,
+		"stemmer":    analyzer.Stemmer}
+
+}
+
+// Tokenise splits text into tokens using an analyzer's tokeniser
+func Tokenise(analyzer types.Analyzer, text string) []string {
+
+	if analyzer.Tokeniser == "whitespace" {
+		return strings.Fields(text)
+	}
+
+	tokens := []string{}
+
+	for _, token := range strings.Split(utils.PadPunctuationWithSpaces(text), " ") {
+
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+
+	}
+
+	return tokens
+
+}
+
+// GetTerms breaks text into its tokens and the terms they are indexed as,
+// leaving out any stop words from both
+func GetTerms(analyzer types.Analyzer, text string) ([]string, []string) {
+
+	plainTokens := []string{}
+	terms := []string{}
+
+	for _, token := range Tokenise(analyzer, text) {
+
+		term, ok := GetTerm(analyzer, token)
+
+		if ok == false {
+			continue
+		}
+
+		plainTokens = append(plainTokens, token)
+		terms = append(terms, term)
+
+	}
+
+	return plainTokens, terms
+
+}
+
+// GetTerm gets the term a single token is indexed as, returning false if it
+// is a stop word or cannot be stemmed
+func GetTerm(analyzer types.Analyzer, token string) (string, bool) {
+
+	term := token
+
+	if analyzer.Lowercase {
+		term = strings.ToLower(term)
+	}
+
+	if IsStopWord(analyzer, term) {
+		return "", false
+	}
+
+	// Stemmers always lowercase the words they are given
+	if analyzer.Stemmer != "" {
+
+		stemmedTerm, err := snowball.Stem(term, analyzer.Stemmer, true)
+
+		if err != nil || stemmedTerm == "" {
+			return "", false
+		}
+
+		term = stemmedTerm
+
+	}
+
+	return term, true
+
+}
+
+// IsStopWord checks whether a term is one of the stop words an analyzer
+// removes
+func IsStopWord(analyzer types.Analyzer, term string) bool {
+
+	if analyzer.StopWords == "" {
+		return false
+	}
+
+	return utils.StringInSlice(strings.ToLower(term), data.StopWordLists[analyzer.StopWords])
+
+}
@@ -13,14 +13,15 @@ import (
 
 	"github.com/D-L-M/mem-db/src/crypt"
 	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/types"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// userPasswords will hold the user credentials
-var userPasswords = map[string]string{}
+// users will hold the user credentials and access grants
+var users = map[string]types.UserAccount{}
 
-// userPasswordsLock allows locking of the passwords map during reads/writes
-var userPasswordsLock = sync.RWMutex{}
+// usersLock allows locking of the users map during reads/writes
+var usersLock = sync.RWMutex{}
 
 // GetCredentials gets the current username and password
 func GetCredentials(request *http.Request) (string, string, error) {
@@ -75,18 +76,53 @@ func getPasswordFilePath() (string, error) {
 
 }
 
-// AddUser adds a new user
-func AddUser(username string, password string) error {
+// AddUser adds a new user or updates an existing one -- an empty password
+// leaves an existing user's password as it is, and nil roles or permissions
+// leave their existing grants as they are (new users are given the writer
+// role unless told otherwise, and root is always an admin)
+func AddUser(username string, password string, roles []string, permissions []string) error {
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	usersLock.Lock()
 
-	if err != nil {
-		return err
+	account, exists := users[username]
+
+	if exists == false && password == "" {
+		usersLock.Unlock()
+		return errors.New("New users must have a password")
 	}
 
-	userPasswordsLock.Lock()
-	userPasswords[username] = string(hashedPassword)
-	userPasswordsLock.Unlock()
+	if password != "" {
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+		if err != nil {
+			usersLock.Unlock()
+			return err
+		}
+
+		account.Password = string(hashedPassword)
+
+	}
+
+	if roles != nil {
+		account.Roles = roles
+	} else if exists == false {
+		account.Roles = []string{defaultRole}
+	}
+
+	if permissions != nil {
+		account.Permissions = permissions
+	} else if exists == false {
+		account.Permissions = []string{}
+	}
+
+	if username == "root" {
+		account.Roles = []string{"admin"}
+	}
+
+	users[username] = account
+
+	usersLock.Unlock()
 
 	savePasswordFile()
 
@@ -97,15 +133,14 @@ func AddUser(username string, password string) error {
 // DeleteUser removes a user
 func DeleteUser(username string) {
 
-	userPasswordsLock.Lock()
-	delete(userPasswords, username)
-	userPasswordsLock.Unlock()
+	usersLock.Lock()
+	delete(users, username)
+	usersLock.Unlock()
 	savePasswordFile()
 
 }
 
-// savePasswordFile updates the password file based on the user passwords in
-// memory
+// savePasswordFile updates the password file based on the users in memory
 func savePasswordFile() {
 
 	passwordFilename, err := getPasswordFilePath()
@@ -114,9 +149,9 @@ func savePasswordFile() {
 		log.Fatal(err)
 	}
 
-	userPasswordsLock.RLock()
-	passwordFile, err := json.Marshal(userPasswords)
-	userPasswordsLock.RUnlock()
+	usersLock.RLock()
+	passwordFile, err := json.Marshal(users)
+	usersLock.RUnlock()
 
 	if err != nil {
 		log.Fatal(err)
@@ -131,9 +166,9 @@ func savePasswordFile() {
 func Init() {
 
 	// Load Basic authentication credentials
-	userPasswordsLock.Lock()
+	usersLock.Lock()
 
-	userPasswords = map[string]string{}
+	users = map[string]types.UserAccount{}
 	passwordFilename, err := getPasswordFilePath()
 
 	if err != nil {
@@ -141,10 +176,20 @@ func Init() {
 	}
 
 	passwordFile, err := ioutil.ReadFile(passwordFilename)
+	migrated := false
 
 	if err == nil {
 
-		err = json.Unmarshal(passwordFile, &userPasswords)
+		err = json.Unmarshal(passwordFile, &users)
+
+		// Password files written before roles were introduced map usernames
+		// straight to password hashes
+		if err != nil {
+
+			migrated = true
+			users, err = migratePasswordFile(passwordFile)
+
+		}
 
 		if err != nil {
 			log.Fatal(err)
@@ -152,32 +197,66 @@ func Init() {
 
 	}
 
-	userPasswordsLock.Unlock()
+	usersLock.Unlock()
+
+	if migrated {
+		savePasswordFile()
+	}
 
 	// Load HMAC authentication secret key
 	crypt.SecretKey()
 
 }
 
+// migratePasswordFile reads a password file written before roles were
+// introduced, making root an admin and every other user a writer
+func migratePasswordFile(passwordFile []byte) (map[string]types.UserAccount, error) {
+
+	var userPasswords map[string]string
+
+	err := json.Unmarshal(passwordFile, &userPasswords)
+
+	if err != nil {
+		return nil, err
+	}
+
+	migratedUsers := map[string]types.UserAccount{}
+
+	for username, hashedPassword := range userPasswords {
+
+		role := defaultRole
+
+		if username == "root" {
+			role = "admin"
+		}
+
+		migratedUsers[username] = types.UserAccount{Password: hashedPassword, Roles: []string{role}, Permissions: []string{}}
+
+	}
+
+	return migratedUsers, nil
+
+}
+
 // isUsernameAndPasswordValid checks whether a username and password pair
 // exists
 func isUsernameAndPasswordValid(username string, password string) bool {
 
 	// Look up the user's password and see if the hash is valid
-	userPasswordsLock.RLock()
+	usersLock.RLock()
 
-	if hashedPassword, ok := userPasswords[username]; ok {
+	if account, ok := users[username]; ok {
 
-		userPasswordsLock.RUnlock()
+		usersLock.RUnlock()
 
-		err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+		err := bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(password))
 
 		if err == nil {
 			return true
 		}
 
 	} else {
-		userPasswordsLock.RUnlock()
+		usersLock.RUnlock()
 	}
 
 	return false
@@ -187,10 +266,10 @@ func isUsernameAndPasswordValid(username string, password string) bool {
 // UserExists checks whether a user exists
 func UserExists(username string) bool {
 
-	userPasswordsLock.RLock()
-	defer userPasswordsLock.RUnlock()
+	usersLock.RLock()
+	defer usersLock.RUnlock()
 
-	if _, ok := userPasswords[username]; ok {
+	if _, ok := users[username]; ok {
 		return true
 	}
 
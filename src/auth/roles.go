@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+)
+
+// Permissions that can be granted to users, either individually or as part
+// of a role
+var Permissions = []string{
+	"documents:read",
+	"documents:write",
+	"documents:truncate",
+	"mappings:manage",
+	"percolator:manage",
+	"stats:read",
+	"users:manage",
+	"peers:message",
+}
+
+// Roles map the name of each role to the permissions it grants
+var Roles = map[string][]string{
+	"reader": {"documents:read", "stats:read"},
+	"writer": {"documents:read", "documents:write", "stats:read"},
+	"admin":  Permissions,
+}
+
+// The role given to new users when none are specified
+const defaultRole = "writer"
+
+// ValidateAccess checks that a set of roles and permissions all exist
+func ValidateAccess(roles []string, permissions []string) error {
+
+	for _, role := range roles {
+
+		if _, ok := Roles[role]; ok == false {
+			return errors.New("Role '" + role + "' does not exist")
+		}
+
+	}
+
+	for _, permission := range permissions {
+
+		if utils.StringInSlice(permission, Permissions) == false {
+			return errors.New("Permission '" + permission + "' does not exist")
+		}
+
+	}
+
+	return nil
+
+}
+
+// getEffectivePermissions gets every permission a user account has, whether
+// granted by its roles or individually
+func getEffectivePermissions(account types.UserAccount) []string {
+
+	effectivePermissions := []string{}
+
+	for _, permission := range Permissions {
+
+		granted := utils.StringInSlice(permission, account.Permissions)
+
+		for _, role := range account.Roles {
+			granted = granted || utils.StringInSlice(permission, Roles[role])
+		}
+
+		if granted {
+			effectivePermissions = append(effectivePermissions, permission)
+		}
+
+	}
+
+	return effectivePermissions
+
+}
+
+// HasPermission checks whether a user has been granted a permission
+func HasPermission(username string, permission string) bool {
+
+	usersLock.RLock()
+	account, ok := users[username]
+	usersLock.RUnlock()
+
+	if ok == false {
+		return false
+	}
+
+	return utils.StringInSlice(permission, getEffectivePermissions(account))
+
+}
+
+// CheckPermission checks whether the sender of a request has been granted a
+// permission -- peers authenticated by HMAC are trusted with everything
+func CheckPermission(request *http.Request, body *[]byte, permission string) bool {
+
+	if CheckHMAC(request, body) {
+		return true
+	}
+
+	username, _, err := GetCredentials(request)
+
+	if err != nil {
+		return false
+	}
+
+	return HasPermission(username, permission)
+
+}
+
+// GetUser gets the roles and permissions of a user, along with the effective
+// permissions they add up to
+func GetUser(username string) (map[string]interface{}, error) {
+
+	usersLock.RLock()
+	account, ok := users[username]
+	usersLock.RUnlock()
+
+	if ok == false {
+		return nil, errors.New("User does not exist")
+	}
+
+	return map[string]interface{}{"username": username, "roles": account.Roles, "permissions": account.Permissions, "effective_permissions": getEffectivePermissions(account)}, nil
+
+}
+
+// GetUsers gets the roles and permissions of every user, ordered by username
+func GetUsers() []map[string]interface{} {
+
+	usersLock.RLock()
+
+	usernames := []string{}
+
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+
+	usersLock.RUnlock()
+
+	sort.Strings(usernames)
+
+	result := []map[string]interface{}{}
+
+	for _, username := range usernames {
+
+		if user, err := GetUser(username); err == nil {
+			result = append(result, user)
+		}
+
+	}
+
+	return result
+
+}
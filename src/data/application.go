@@ -126,3 +126,40 @@ func GetStorageDirectory() (string, error) {
 	return storageDirectory, nil
 
 }
+
+// GetCollectionDirectory gets the directory in which to write the files of a
+// collection, which holds the write-ahead logs of all nodes for it
+func GetCollectionDirectory(collection string) (string, error) {
+
+	storageDirectory, err := GetStorageDirectory()
+
+	if err != nil {
+		return "", err
+	}
+
+	collectionDirectory := storageDirectory + "/" + collection
+
+	err = createDirectoryIfNotExists(collectionDirectory)
+
+	if err != nil {
+		return "", err
+	}
+
+	return collectionDirectory, nil
+
+}
+
+// GetWALDirectory gets the directory in which the write-ahead logs of all
+// nodes were written before documents were split into collections (it is not
+// created if it does not exist)
+func GetWALDirectory() (string, error) {
+
+	baseDirectory, err := GetBaseDirectory()
+
+	if err != nil {
+		return "", err
+	}
+
+	return baseDirectory + "/wal", nil
+
+}
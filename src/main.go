@@ -1,6 +1,8 @@
 package main
 
 import (
+	"log"
+
 	"github.com/D-L-M/jsonserver"
 	"github.com/D-L-M/mem-db/src/auth"
 	"github.com/D-L-M/mem-db/src/data"
@@ -8,6 +10,7 @@ import (
 	"github.com/D-L-M/mem-db/src/output"
 	"github.com/D-L-M/mem-db/src/routing"
 	"github.com/D-L-M/mem-db/src/store"
+	"github.com/D-L-M/mem-db/src/wal"
 )
 
 // Entry point
@@ -17,7 +20,14 @@ func main() {
 	output.Log("Initialising channels")
 	initialiseChannelListeners()
 
-	// Reindex all documents previously flushed to disk
+	// Open this node's write-ahead log, then reindex all documents previously
+	// flushed to disk
+	output.Log("Opening write-ahead log")
+
+	if err := wal.Open(); err != nil {
+		log.Fatal(err)
+	}
+
 	output.Log("Restoring index from disk")
 	store.IndexAllFromDisk()
 
@@ -27,7 +37,14 @@ func main() {
 
 	// Create a root user if one does not exist
 	if auth.UserExists("root") == false {
-		go messaging.AddUser("root", "password")
+		go messaging.AddUser("root", "password", nil, nil)
+	}
+
+	// Load the queries documents are percolated against
+	output.Log("Loading percolator queries")
+
+	if err := store.LoadPercolatorQueries(); err != nil {
+		log.Fatal(err)
 	}
 
 	// Register HTTP routes
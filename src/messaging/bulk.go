@@ -0,0 +1,325 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/output"
+	"github.com/D-L-M/mem-db/src/store"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+	"github.com/D-L-M/mem-db/src/wal"
+)
+
+// Bulk items are written to the write-ahead log, and announced to peers, in
+// batches of up to this many
+const bulkBatchSize = 1000
+
+// WriteBulkItems performs the actions of a bulk request against a collection
+// in batches, blocking until each batch has reached a stage of being written
+// and returning the result of every item in order
+func WriteBulkItems(collection string, items []types.BulkItem, waitFor string) []types.WriteResult {
+
+	results := []types.WriteResult{}
+
+	for start := 0; start < len(items); start += bulkBatchSize {
+
+		end := start + bulkBatchSize
+
+		if end > len(items) {
+			end = len(items)
+		}
+
+		// Peers are contacted here rather than in the background when the
+		// caller needs to know that they have acted upon the batch
+		message := types.DocumentMessage{Collection: collection, Action: "bulk", Items: items[start:end], PropagateToPeers: waitFor != "replicated", Result: make(chan types.WriteResult, 1)}
+
+		DocumentMessageQueue <- message
+
+		batchResult := <-message.Result
+
+		if waitFor == "replicated" && batchResult.Persisted && len(batchResult.WrittenIDs) > 0 {
+
+			peerErrors := ContactAllPeersAndWait(types.PeerMessage{Action: "reindex_documents", Collection: collection, DocumentIDs: batchResult.WrittenIDs, Position: batchResult.Position})
+
+			for i := range batchResult.Items {
+
+				if batchResult.Items[i].Persisted {
+					batchResult.Items[i].Errors = append(batchResult.Items[i].Errors, peerErrors...)
+					batchResult.Items[i].Replicated = len(peerErrors) == 0
+				}
+
+			}
+
+		}
+
+		results = append(results, batchResult.Items...)
+
+	}
+
+	return results
+
+}
+
+// IndexDocumentsFromDisk reapplies a batch of changes written to a peer's
+// write-ahead log in a collection
+func IndexDocumentsFromDisk(collection string, ids []string, source string, position int64) {
+
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, DocumentIDs: ids, Document: []byte{}, Action: "index_batch_from_disk", Source: source, Position: position}
+
+}
+
+// IndexDocumentsFromDiskAndWait reapplies a batch of changes written to a
+// peer's write-ahead log in a collection, blocking until they have been
+// applied
+func IndexDocumentsFromDiskAndWait(collection string, ids []string, source string, position int64) error {
+
+	if data.GetState() != "active" {
+		return errors.New("Node is not active")
+	}
+
+	result := make(chan types.WriteResult, 1)
+
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, DocumentIDs: ids, Document: []byte{}, Action: "index_batch_from_disk", Source: source, Position: position, Result: result}
+
+	if outcome := <-result; len(outcome.Errors) > 0 {
+		return errors.New(outcome.Errors[0])
+	}
+
+	return nil
+
+}
+
+// writeBulkItems turns a batch of bulk items into changes, appends them to
+// this node's write-ahead log in a collection with a single write, applies
+// them to the collection's index and optionally tells peers where to find them
+func writeBulkItems(collection string, items []types.BulkItem, propagateToPeers bool) types.WriteResult {
+
+	result := types.WriteResult{Items: make([]types.WriteResult, len(items))}
+	entries := []types.JournalEntry{}
+	entryItems := []int{}
+
+	// Later items in a batch must see the changes made by earlier ones
+	pendingEntries := map[string]types.JournalEntry{}
+
+	for i, item := range items {
+
+		entry, err := getBulkJournalEntry(collection, item, pendingEntries)
+
+		if err != nil {
+			result.Items[i].Errors = []string{err.Error()}
+			continue
+		}
+
+		entry.Sequence = wal.NextSequence()
+		pendingEntries[entry.ID] = entry
+		entries = append(entries, entry)
+		entryItems = append(entryItems, i)
+
+	}
+
+	if len(entries) == 0 {
+		return result
+	}
+
+	positions, err := wal.AppendBatch(collection, entries)
+
+	// Changes that could not be logged are not applied either, as they would
+	// be lost on restart and peers would never hear of them
+	if err != nil {
+
+		output.Log("Could not write a batch of " + strconv.Itoa(len(entries)) + " changes to the write-ahead log: " + err.Error())
+		result.Errors = append(result.Errors, "Could not write to the write-ahead log: "+err.Error())
+
+		for _, i := range entryItems {
+			result.Items[i].Errors = result.Errors
+		}
+
+		return result
+
+	}
+
+	result.Persisted = true
+	result.Position = positions[0]
+	result.Indexed = true
+	indexedEntries := []types.JournalEntry{}
+
+	for i, entry := range entries {
+
+		itemResult := &result.Items[entryItems[i]]
+		itemResult.Indexed = store.ApplyJournalEntry(collection, entry)
+		itemResult.Persisted = true
+		itemResult.Position = positions[i]
+
+		if itemResult.Indexed == false {
+			itemResult.Errors = append(itemResult.Errors, "Could not index the change")
+			result.Indexed = false
+		} else if entry.Action == "add" {
+			indexedEntries = append(indexedEntries, entry)
+		}
+
+		itemResult.Version = entry.Version
+
+		if entry.Action == "add" {
+			itemResult.ETag = store.GenerateETag(entry.Version, entry.Sequence)
+		}
+
+		result.WrittenIDs = append(result.WrittenIDs, entry.ID)
+
+	}
+
+	if propagateToPeers {
+		go ContactAllPeers(types.PeerMessage{Action: "reindex_documents", Collection: collection, DocumentIDs: result.WrittenIDs, Position: result.Position})
+	}
+
+	if len(indexedEntries) > 0 {
+		go percolateDocuments(collection, indexedEntries)
+	}
+
+	compactIfNeeded(collection)
+
+	return result
+
+}
+
+// getBulkJournalEntry turns a bulk item into the change it makes to a
+// collection, given the changes already made by earlier items in the same
+// batch
+func getBulkJournalEntry(collection string, item types.BulkItem, pendingEntries map[string]types.JournalEntry) (types.JournalEntry, error) {
+
+	var existingDocument []byte
+	var existingVersion int64
+
+	if pendingEntry, pending := pendingEntries[item.ID]; pending {
+
+		existingVersion = pendingEntry.Version
+
+		if pendingEntry.Action == "add" {
+			existingDocument = []byte(pendingEntry.Document)
+		}
+
+	} else {
+
+		existingDocument, _ = store.GetRawDocument(collection, item.ID)
+		existingVersion = store.GetLatestVersion(collection, item.ID)
+
+	}
+
+	// Items can be made conditional on the document being at a particular
+	// version
+	if item.ExpectedVersion != 0 && (existingDocument == nil || item.ExpectedVersion != existingVersion) {
+		return types.JournalEntry{}, errors.New("Document is not at version " + strconv.FormatInt(item.ExpectedVersion, 10))
+	}
+
+	entry, err := getBulkChange(item, existingDocument)
+	entry.Version = existingVersion + 1
+
+	// Documents must conform to the collection's mapping if it is strict
+	if err == nil && entry.Action == "add" {
+		err = store.ValidateDocument(collection, []byte(entry.Document))
+	}
+
+	return entry, err
+
+}
+
+// getBulkChange turns a bulk item into the change it makes to a document
+// (which is nil if the document does not exist)
+func getBulkChange(item types.BulkItem, existingDocument []byte) (types.JournalEntry, error) {
+
+	switch item.Action {
+
+	case "index":
+
+		if _, err := store.ParseDocument(item.Document); err != nil {
+			return types.JournalEntry{}, errors.New("Document is not valid JSON")
+		}
+
+		return types.JournalEntry{Action: "add", ID: item.ID, Document: string(item.Document[:])}, nil
+
+	case "update":
+
+		var update map[string]interface{}
+
+		err := json.Unmarshal(item.Document, &update)
+		patch, ok := update["doc"].(map[string]interface{})
+
+		if err != nil || ok == false {
+			return types.JournalEntry{}, errors.New("Update must contain a doc object")
+		}
+
+		if existingDocument == nil {
+
+			// Documents that don't exist can optionally be created by the update
+			if upsert, _ := update["doc_as_upsert"].(bool); upsert == false {
+				return types.JournalEntry{}, errors.New("Document does not exist")
+			}
+
+			existingDocument = []byte("{}")
+
+		}
+
+		encodedPatch, err := json.Marshal(patch)
+
+		if err != nil {
+			return types.JournalEntry{}, err
+		}
+
+		updatedDocument, err := patchDocument(existingDocument, encodedPatch, "merge_patch")
+
+		if err != nil {
+			return types.JournalEntry{}, err
+		}
+
+		return types.JournalEntry{Action: "add", ID: item.ID, Document: string(updatedDocument[:])}, nil
+
+	// Update operations are only used internally, by update-by-query tasks,
+	// and are applied to the latest version of the document
+	case "update_operations":
+
+		var document interface{}
+		var operations interface{}
+
+		if existingDocument == nil {
+			return types.JournalEntry{}, errors.New("Document does not exist")
+		}
+
+		err := json.Unmarshal(existingDocument, &document)
+
+		if err == nil {
+			err = json.Unmarshal(item.Document, &operations)
+		}
+
+		if err != nil {
+			return types.JournalEntry{}, err
+		}
+
+		updatedDocument, err := utils.ApplyUpdateOperations(document, operations)
+
+		if err != nil {
+			return types.JournalEntry{}, err
+		}
+
+		encodedDocument, err := json.Marshal(updatedDocument)
+
+		if err != nil {
+			return types.JournalEntry{}, err
+		}
+
+		return types.JournalEntry{Action: "add", ID: item.ID, Document: string(encodedDocument[:])}, nil
+
+	case "delete":
+
+		if existingDocument == nil {
+			return types.JournalEntry{}, errors.New("Document does not exist")
+		}
+
+		return types.JournalEntry{Action: "remove", ID: item.ID}, nil
+
+	}
+
+	return types.JournalEntry{}, errors.New("Action '" + item.Action + "' is not supported")
+
+}
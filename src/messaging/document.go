@@ -2,132 +2,429 @@ package messaging
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"os"
+	"errors"
+	"strconv"
+	"strings"
 
-	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/output"
 	"github.com/D-L-M/mem-db/src/store"
 	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+	"github.com/D-L-M/mem-db/src/wal"
 )
 
-// ProcessDocumentMessages performs queued actions and flush document changes to disk
+// WriteStages are the stages of a document change that a caller can wait for,
+// in the order they are reached
+var WriteStages = []string{"indexed", "persisted", "replicated"}
+
+// ProcessDocumentMessages performs queued actions and writes document changes to the write-ahead log
 func ProcessDocumentMessages() {
 
 	// Listen for messages to process
 	for {
 
 		message := <-DocumentMessageQueue
-		documentFilename, err := store.GetDocumentFilePath(message.ID)
+
+		var result types.WriteResult
+
+		// Changes can be made conditional on the document being at a
+		// particular version, and are rejected if it isn't
+		err := checkExpectedVersion(message.Collection, message.ID, message.ExpectedVersion, message.ExpectedETag)
+
+		if err != nil {
+			result = types.WriteResult{Rejected: true, Conflict: true, Errors: []string{err.Error()}}
+		} else {
+			result = performDocumentMessage(message)
+		}
+
+		// Let anyone waiting on the change know how far it got
+		if message.Result != nil {
+			message.Result <- result
+		}
+
+	}
+
+}
+
+// performDocumentMessage performs the action of a document message
+func performDocumentMessage(message types.DocumentMessage) types.WriteResult {
+
+	result := types.WriteResult{}
+
+	// Add a document to the index and write it to disk, as long as it
+	// conforms to the collection's mapping
+	if message.Action == "add" {
+
+		err := store.ValidateDocument(message.Collection, message.Document)
+
+		if err != nil {
+			result.Rejected = true
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			result = writeJournalEntry(message.Collection, types.JournalEntry{Action: "add", ID: message.ID, Document: string(message.Document[:])}, message.PropagateToPeers, "reindex_document")
+		}
+
+	}
+
+	// Replace the mapping of a collection, which reindexes its documents
+	if message.Action == "mapping" {
+		result = writeJournalEntry(message.Collection, types.JournalEntry{Action: "mapping", ID: "_mapping", Document: string(message.Document[:])}, message.PropagateToPeers, "reindex_document")
+	}
+
+	// Reapply a change another node has written to disk
+	if message.Action == "index_from_disk" {
+
+		err := store.IndexDocumentFromDisk(message.Collection, message.ID, message.Source, message.Position)
 
 		if err != nil {
-			continue
+			result.Errors = append(result.Errors, "Could not read '"+message.ID+"' from the write-ahead log of "+message.Source+": "+err.Error())
+		} else {
+			result.Indexed = true
 		}
 
-		// Add a document to the index and write it to disk
-		if message.Action == "add" {
+	}
 
-			store.IndexDocument(message.ID, message.Document, true)
+	// Patch a document, which has to be done here so that the patch is
+	// applied to the latest version of it
+	if message.Action == "merge_patch" || message.Action == "json_patch" {
 
-			documentFile, err := json.Marshal(jsonserver.JSON{"id": message.ID, "document": string(message.Document[:])})
+		existingDocument, err := store.GetRawDocument(message.Collection, message.ID)
 
-			if err == nil {
-				ioutil.WriteFile(documentFilename, documentFile, os.FileMode(0600))
-			}
+		if err == nil {
+			existingDocument, err = patchDocument(existingDocument, message.Document, message.Action)
+		}
 
-			if message.PropagateToPeers {
-				go ContactAllPeers(types.PeerMessage{Action: "reindex_document", DocumentID: message.ID})
-			}
+		if err == nil {
+			err = store.ValidateDocument(message.Collection, existingDocument)
+		}
 
+		if err != nil {
+			result.Rejected = true
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			result = writeJournalEntry(message.Collection, types.JournalEntry{Action: "add", ID: message.ID, Document: string(existingDocument[:])}, message.PropagateToPeers, "reindex_document")
 		}
 
-		// Reindex a document from disk
-		if message.Action == "index_from_disk" {
+	}
+
+	// Perform a batch of actions from a bulk request
+	if message.Action == "bulk" {
+		result = writeBulkItems(message.Collection, message.Items, message.PropagateToPeers)
+	}
 
-			store.IndexDocumentFromDisk(message.ID)
+	// Reapply a batch of changes another node has written to disk
+	if message.Action == "index_batch_from_disk" {
 
-			if message.PropagateToPeers {
-				go ContactAllPeers(types.PeerMessage{Action: "reindex_document", DocumentID: message.ID})
-			}
+		err := store.IndexDocumentsFromDisk(message.Collection, message.DocumentIDs, message.Source, message.Position)
 
+		if err != nil {
+			result.Errors = append(result.Errors, "Could not read a batch of changes from the write-ahead log of "+message.Source+": "+err.Error())
+		} else {
+			result.Indexed = true
 		}
 
-		// Remove a document from the index and disk
-		if message.Action == "remove" {
+	}
+
+	// Remove a document from the index and disk
+	if message.Action == "remove" {
+
+		// Remove all documents
+		if message.ID == "_all" {
+
+			result = writeJournalEntry(message.Collection, types.JournalEntry{Action: "truncate", ID: "_all"}, message.PropagateToPeers, "remove_all_documents")
+
+			// Remove a single document
+		} else {
+
+			result = writeJournalEntry(message.Collection, types.JournalEntry{Action: "remove", ID: message.ID}, message.PropagateToPeers, "remove_document")
+
+		}
+
+	}
+
+	return result
+
+}
+
+// checkExpectedVersion checks that a document in a collection is at the
+// version and/or has the entity tag (from an If-Match header) that a change
+// expects it to, if the change expects either
+func checkExpectedVersion(collection string, id string, expectedVersion int64, expectedETag string) error {
+
+	if expectedVersion == 0 && expectedETag == "" {
+		return nil
+	}
+
+	version, etag, err := store.GetDocumentVersion(collection, id)
+
+	if err != nil {
+		return errors.New("Document does not exist")
+	}
+
+	if expectedVersion != 0 && expectedVersion != version {
+		return errors.New("Document is at version " + strconv.FormatInt(version, 10) + ", not version " + strconv.FormatInt(expectedVersion, 10))
+	}
+
+	if expectedETag != "" && matchesETag(expectedETag, etag) == false {
+		return errors.New("Document does not match any of the expected entity tags")
+	}
+
+	return nil
+
+}
+
+// matchesETag checks whether an entity tag is one of those listed in an
+// If-Match header
+func matchesETag(ifMatch string, etag string) bool {
+
+	for _, expectedETag := range strings.Split(ifMatch, ",") {
+
+		expectedETag = strings.TrimSpace(expectedETag)
+
+		if expectedETag == "*" || expectedETag == etag {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+// writeJournalEntry appends a change to this node's write-ahead log in a
+// collection, applies it to the collection's index and optionally tells peers
+// where to find it
+func writeJournalEntry(collection string, entry types.JournalEntry, propagateToPeers bool, peerAction string) types.WriteResult {
+
+	result := types.WriteResult{}
 
-			// Remove all documents
-			if message.ID == "_all" {
+	// Every change to a document moves it on to its next version
+	if entry.Action != "truncate" && entry.Action != "mapping" {
+		entry.Version = store.GetLatestVersion(collection, entry.ID) + 1
+		result.Version = entry.Version
+	}
+
+	entry.Sequence = wal.NextSequence()
+
+	if entry.Action == "add" {
+		result.ETag = store.GenerateETag(entry.Version, entry.Sequence)
+	}
+
+	position, err := wal.Append(collection, entry)
+
+	// A change that could not be logged is not applied either, as it would be
+	// lost on restart and peers would never hear of it
+	if err != nil {
+		output.Log("Could not write '" + entry.ID + "' to the write-ahead log: " + err.Error())
+		return types.WriteResult{Errors: []string{"Could not write to the write-ahead log: " + err.Error()}}
+	}
+
+	result.Persisted = true
+	result.Position = position
+	result.Indexed = store.ApplyJournalEntry(collection, entry)
+
+	if result.Indexed == false {
+		result.Errors = append(result.Errors, "Could not index the change")
+	} else if entry.Action == "add" {
+		go percolateDocuments(collection, []types.JournalEntry{entry})
+	}
+
+	if propagateToPeers {
+		go ContactAllPeers(types.PeerMessage{Action: peerAction, Collection: collection, DocumentID: entry.ID, Position: position})
+	}
 
-				store.RemoveAllDocuments(true)
+	compactIfNeeded(collection)
 
-				if message.PropagateToPeers {
-					go ContactAllPeers(types.PeerMessage{Action: "remove_all_documents", DocumentID: ""})
-				}
+	return result
+
+}
 
-				// Remove a single document
-			} else {
+// compactIfNeeded periodically folds a collection's write-ahead log into a
+// snapshot so that it doesn't grow forever
+func compactIfNeeded(collection string) {
 
-				store.RemoveDocument(message.ID, documentFilename, true)
+	if wal.NeedsCompaction(collection) {
 
-				if message.PropagateToPeers {
-					go ContactAllPeers(types.PeerMessage{Action: "remove_document", DocumentID: message.ID})
-				}
+		output.Log("Compacting write-ahead log of collection '" + collection + "'")
 
-			}
+		err := wal.Compact(collection, func(emit func(types.JournalEntry) error) error {
+			return store.ForEachJournalEntry(collection, emit)
+		})
 
+		if err != nil {
+			output.Log("Could not compact the write-ahead log of collection '" + collection + "': " + err.Error())
 		}
 
-		// Remove a document from the index
-		if message.Action == "remove_from_memory" {
+	}
+
+}
+
+// patchDocument applies a JSON merge patch or JSON patch to a document
+func patchDocument(document []byte, patch []byte, patchType string) ([]byte, error) {
+
+	var parsedDocument interface{}
+	var parsedPatch interface{}
 
-			// Remove all documents from memory
-			if message.ID == "_all" {
+	err := json.Unmarshal(document, &parsedDocument)
 
-				store.RemoveAllDocuments(false)
+	if err == nil {
+		err = json.Unmarshal(patch, &parsedPatch)
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
-				// Remove a single document from memory
-			} else {
+	var patchedDocument interface{}
 
-				store.RemoveDocument(message.ID, documentFilename, false)
+	if patchType == "json_patch" {
 
-			}
+		patchedDocument, err = utils.JSONPatch(parsedDocument, parsedPatch)
 
+		if err != nil {
+			return nil, err
 		}
 
+	} else {
+
+		patchedDocument = utils.MergePatch(parsedDocument, parsedPatch)
+
+	}
+
+	if _, ok := patchedDocument.(map[string]interface{}); ok == false {
+		return nil, errors.New("Patched document must be a JSON object")
 	}
 
+	return json.Marshal(patchedDocument)
+
 }
 
-// AddDocument adds a new document
-func AddDocument(id string, body *[]byte, propagateToPeers bool) {
+// ReachedWriteStage checks whether a write has reached the stage waited for,
+// along with every stage before it
+func ReachedWriteStage(result types.WriteResult, waitFor string) bool {
+
+	reachedStage := result.Indexed
+
+	if waitFor == "persisted" || waitFor == "replicated" {
+		reachedStage = reachedStage && result.Persisted
+	}
+
+	if waitFor == "replicated" {
+		reachedStage = reachedStage && result.Replicated
+	}
+
+	return reachedStage
+
+}
+
+// waitForDocumentMessage queues a document message and blocks until the change
+// has been indexed, persisted or replicated to all peers -- any failures along
+// the way are reported in the result
+func waitForDocumentMessage(message types.DocumentMessage, waitFor string, peerAction string) types.WriteResult {
+
+	// Peers are contacted here rather than in the background when the caller
+	// needs to know that they have acted upon the change
+	message.PropagateToPeers = waitFor != "replicated"
+	message.Result = make(chan types.WriteResult, 1)
+
+	DocumentMessageQueue <- message
+
+	result := <-message.Result
+
+	if waitFor == "replicated" && result.Persisted {
+
+		peerErrors := ContactAllPeersAndWait(types.PeerMessage{Action: peerAction, Collection: message.Collection, DocumentID: message.ID, Position: result.Position})
+		result.Errors = append(result.Errors, peerErrors...)
+		result.Replicated = len(peerErrors) == 0
+
+	}
+
+	return result
+
+}
+
+// AddDocument adds a new document to a collection
+func AddDocument(collection string, id string, body *[]byte, propagateToPeers bool) {
+
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, ID: id, Document: *body, Action: "add", PropagateToPeers: propagateToPeers}
+
+}
+
+// AddDocumentAndWait adds a new document to a collection, optionally only if
+// the existing document is at an expected version, blocking until the change
+// has reached a stage of being written
+func AddDocumentAndWait(collection string, id string, body *[]byte, waitFor string, expectedVersion int64, expectedETag string) types.WriteResult {
+
+	return waitForDocumentMessage(types.DocumentMessage{Collection: collection, ID: id, Document: *body, Action: "add", ExpectedVersion: expectedVersion, ExpectedETag: expectedETag}, waitFor, "reindex_document")
+
+}
+
+// PatchDocumentAndWait applies a JSON merge patch (merge_patch) or JSON patch
+// (json_patch) to a document in a collection, optionally only if it is at an
+// expected version, blocking until the change has reached a stage of being
+// written
+func PatchDocumentAndWait(collection string, id string, patch *[]byte, patchType string, waitFor string, expectedVersion int64, expectedETag string) types.WriteResult {
+
+	return waitForDocumentMessage(types.DocumentMessage{Collection: collection, ID: id, Document: *patch, Action: patchType, ExpectedVersion: expectedVersion, ExpectedETag: expectedETag}, waitFor, "reindex_document")
+
+}
+
+// IndexDocumentFromDisk reapplies a change written to a peer's write-ahead log
+// in a collection
+func IndexDocumentFromDisk(collection string, id string, source string, position int64) {
+
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, ID: id, Document: []byte{}, Action: "index_from_disk", Source: source, Position: position}
+
+}
+
+// IndexDocumentFromDiskAndWait reapplies a change written to a peer's
+// write-ahead log in a collection, blocking until it has been applied
+func IndexDocumentFromDiskAndWait(collection string, id string, source string, position int64) error {
+
+	if data.GetState() != "active" {
+		return errors.New("Node is not active")
+	}
+
+	result := make(chan types.WriteResult, 1)
+
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, ID: id, Document: []byte{}, Action: "index_from_disk", Source: source, Position: position, Result: result}
+
+	if outcome := <-result; len(outcome.Errors) > 0 {
+		return errors.New(outcome.Errors[0])
+	}
 
-	DocumentMessageQueue <- types.DocumentMessage{ID: id, Document: *body, Action: "add", PropagateToPeers: propagateToPeers}
+	return nil
 
 }
 
-// IndexDocumentFromDisk reindexes a document from disk
-func IndexDocumentFromDisk(id string, propagateToPeers bool) {
+// SetMappingAndWait replaces the mapping of a collection, blocking until the
+// change has reached a stage of being written
+func SetMappingAndWait(collection string, mapping *[]byte, waitFor string) types.WriteResult {
 
-	DocumentMessageQueue <- types.DocumentMessage{ID: id, Document: []byte{}, Action: "index_from_disk", PropagateToPeers: propagateToPeers}
+	return waitForDocumentMessage(types.DocumentMessage{Collection: collection, ID: "_mapping", Document: *mapping, Action: "mapping"}, waitFor, "reindex_document")
 
 }
 
-// RemoveDocument removes a document
-func RemoveDocument(id string, propagateToPeers bool) {
+// RemoveDocument removes a document from a collection
+func RemoveDocument(collection string, id string, propagateToPeers bool) {
 
-	DocumentMessageQueue <- types.DocumentMessage{ID: id, Document: []byte{}, Action: "remove", PropagateToPeers: propagateToPeers}
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, ID: id, Document: []byte{}, Action: "remove", PropagateToPeers: propagateToPeers}
 
 }
 
-// RemoveDocumentFromMemory removes a document from memory but not from disk
-func RemoveDocumentFromMemory(id string, propagateToPeers bool) {
+// RemoveDocumentAndWait removes a document from a collection, optionally only
+// if it is at an expected version, blocking until the change has reached a
+// stage of being written
+func RemoveDocumentAndWait(collection string, id string, waitFor string, expectedVersion int64, expectedETag string) types.WriteResult {
 
-	DocumentMessageQueue <- types.DocumentMessage{ID: id, Document: []byte{}, Action: "remove_from_memory", PropagateToPeers: propagateToPeers}
+	return waitForDocumentMessage(types.DocumentMessage{Collection: collection, ID: id, Document: []byte{}, Action: "remove", ExpectedVersion: expectedVersion, ExpectedETag: expectedETag}, waitFor, "remove_document")
 
 }
 
-// RemoveAllDocuments removes all documents
-func RemoveAllDocuments(propagateToPeers bool) {
+// RemoveAllDocuments removes all documents from a collection
+func RemoveAllDocuments(collection string, propagateToPeers bool) {
 
-	DocumentMessageQueue <- types.DocumentMessage{ID: "_all", Document: []byte{}, Action: "remove", PropagateToPeers: propagateToPeers}
+	DocumentMessageQueue <- types.DocumentMessage{Collection: collection, ID: "_all", Document: []byte{}, Action: "remove", PropagateToPeers: propagateToPeers}
 
 }
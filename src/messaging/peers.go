@@ -3,8 +3,11 @@ package messaging
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/D-L-M/mem-db/src/auth"
 	"github.com/D-L-M/mem-db/src/crypt"
@@ -13,6 +16,9 @@ import (
 	"github.com/D-L-M/mem-db/src/types"
 )
 
+// How long to wait for a peer to acknowledge an instruction
+const peerAcknowledgementTimeout = 30 * time.Second
+
 // Hostname of the running application
 var hostname = ""
 
@@ -101,12 +107,117 @@ func ContactAllPeers(message types.PeerMessage) {
 // ContactPeer sends a HMAC signed message to a peer server
 func ContactPeer(message types.PeerMessage) bool {
 
+	payload, signature, nonce, err := signPeerMessage(message)
+
+	if err != nil {
+		return false
+	}
+
+	go sendPeerMessage(message.To, payload, signature, nonce)
+
+	return true
+
+}
+
+// ContactAllPeersAndWait sends a HMAC signed message to all peer servers and
+// waits for each of them to acknowledge that it has acted upon it, returning
+// an error message for each peer that did not
+func ContactAllPeersAndWait(message types.PeerMessage) []string {
+
+	activePeers := GetPeers()
+	peerErrors := make(chan string, len(activePeers))
+	result := []string{}
+
+	for _, peer := range activePeers {
+
+		peerMessage := message
+		peerMessage.To = peer
+		peerMessage.Acknowledge = true
+
+		go func() {
+
+			err := contactPeerAndWait(peerMessage)
+
+			if err != nil {
+				peerErrors <- peerMessage.To + ": " + err.Error()
+			} else {
+				peerErrors <- ""
+			}
+
+		}()
+
+	}
+
+	for range activePeers {
+
+		if peerError := <-peerErrors; peerError != "" {
+			result = append(result, peerError)
+		}
+
+	}
+
+	return result
+
+}
+
+// contactPeerAndWait sends a HMAC signed message to a peer server and waits
+// for it to acknowledge that it has acted upon it
+func contactPeerAndWait(message types.PeerMessage) error {
+
+	payload, signature, nonce, err := signPeerMessage(message)
+
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", message.To+"/_peer-message", bytes.NewBuffer(payload))
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("x-hmac-auth", signature)
+	request.Header.Set("x-hmac-nonce", nonce)
+
+	client := &http.Client{Timeout: peerAcknowledgementTimeout}
+	response, err := client.Do(request)
+
+	if err != nil {
+		RemovePeer(message.To)
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+
+		var responseBody map[string]interface{}
+
+		json.NewDecoder(response.Body).Decode(&responseBody)
+
+		if responseMessage, ok := responseBody["message"].(string); ok {
+			return errors.New(responseMessage)
+		}
+
+		return errors.New("Peer responded with status " + strconv.Itoa(response.StatusCode))
+
+	}
+
+	return nil
+
+}
+
+// signPeerMessage prepares a message for a peer server, returning its payload
+// along with a HMAC signature and the nonce used to create it
+func signPeerMessage(message types.PeerMessage) ([]byte, string, string, error) {
+
 	peersLock.RLock()
 	peerStatus := peers[message.To]
 	peersLock.RUnlock()
 
 	if peerStatus == false {
-		return false
+		return nil, "", "", errors.New("Peer is not active")
 	}
 
 	message.From = hostname
@@ -114,20 +225,18 @@ func ContactPeer(message types.PeerMessage) bool {
 	payload, err := json.Marshal(message)
 
 	if err != nil {
-		return false
+		return nil, "", "", err
 	}
 
 	nonce, err := crypt.GenerateUUID()
 
 	if err != nil {
-		return false
+		return nil, "", "", err
 	}
 
 	signature := crypt.Sha512HMAC([]byte(string(payload[:]) + nonce))
 
-	go sendPeerMessage(message.To, payload, signature, nonce)
-
-	return true
+	return payload, signature, nonce, nil
 
 }
 
@@ -157,6 +266,45 @@ func sendPeerMessage(peerHostname string, message []byte, signature string, nonc
 
 }
 
+// getPeerMessageCollection gets the collection a peer instruction is about --
+// peers that predate collections only ever refer to the default collection
+func getPeerMessageCollection(message types.PeerMessage) string {
+
+	if message.Collection == "" {
+		return data.DefaultCollection
+	}
+
+	return message.Collection
+
+}
+
+// ActOnPeerMessageAndWait performs a peer instruction straight away rather
+// than queueing it, for peers waiting on an acknowledgement
+func ActOnPeerMessageAndWait(message types.PeerMessage) error {
+
+	collection := getPeerMessageCollection(message)
+
+	switch message.Action {
+
+	case "reindex_document", "remove_document":
+		return IndexDocumentFromDiskAndWait(collection, message.DocumentID, message.From, message.Position)
+
+	case "reindex_documents":
+		return IndexDocumentsFromDiskAndWait(collection, message.DocumentIDs, message.From, message.Position)
+
+	case "remove_all_documents":
+		return IndexDocumentFromDiskAndWait(collection, "_all", message.From, message.Position)
+
+	case "reload_percolator":
+		output.Log(message.From + " instructed to reload percolator queries")
+		return reloadPercolatorQueries()
+
+	}
+
+	return errors.New("Instruction cannot be acknowledged")
+
+}
+
 // ProcessPeerQueue redrives the processing queue to the channel
 func ProcessPeerQueue() {
 
@@ -223,6 +371,8 @@ func ProcessPeerMessages() {
 
 		} else {
 
+			collection := getPeerMessageCollection(message)
+
 			// Update the peers list
 			if message.Action == "update_peers" {
 
@@ -236,20 +386,26 @@ func ProcessPeerMessages() {
 
 			// Reindex a document from disk
 			if message.Action == "reindex_document" {
-				output.Log(message.From + " instructed to reindex document '" + message.DocumentID + "' from disk")
-				IndexDocumentFromDisk(message.DocumentID, false)
+				output.Log(message.From + " instructed to reindex document '" + message.DocumentID + "' in collection '" + collection + "' from disk")
+				IndexDocumentFromDisk(collection, message.DocumentID, message.From, message.Position)
+			}
+
+			// Reindex a batch of documents from disk
+			if message.Action == "reindex_documents" {
+				output.Log(message.From + " instructed to reindex " + strconv.Itoa(len(message.DocumentIDs)) + " document(s) in collection '" + collection + "' from disk")
+				IndexDocumentsFromDisk(collection, message.DocumentIDs, message.From, message.Position)
 			}
 
 			// Remove a document from memory
 			if message.Action == "remove_document" {
-				output.Log(message.From + " instructed to remove document '" + message.DocumentID + "' from memory")
-				RemoveDocumentFromMemory(message.DocumentID, false)
+				output.Log(message.From + " instructed to remove document '" + message.DocumentID + "' in collection '" + collection + "' from memory")
+				IndexDocumentFromDisk(collection, message.DocumentID, message.From, message.Position)
 			}
 
 			// Remove all documents from memory
 			if message.Action == "remove_all_documents" {
-				output.Log(message.From + " instructed to remove all documents from memory")
-				RemoveDocumentFromMemory("_all", false)
+				output.Log(message.From + " instructed to remove all documents in collection '" + collection + "' from memory")
+				IndexDocumentFromDisk(collection, "_all", message.From, message.Position)
 			}
 
 			// Reload the user's list
@@ -258,6 +414,12 @@ func ProcessPeerMessages() {
 				auth.Init()
 			}
 
+			// Reload the percolator queries
+			if message.Action == "reload_percolator" {
+				output.Log(message.From + " instructed to reload percolator queries")
+				reloadPercolatorQueries()
+			}
+
 		}
 
 	}
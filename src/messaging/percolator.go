@@ -0,0 +1,175 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/D-L-M/mem-db/src/output"
+	"github.com/D-L-M/mem-db/src/store"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// The most percolator matches that are remembered, after which the oldest are
+// forgotten
+const maxPercolatorMatches = 1000
+
+// How long a webhook has to respond to a percolator match
+const percolatorWebhookTimeout = 10 * time.Second
+
+// Documents that have matched percolator queries, oldest first
+var percolatorMatches = []types.PercolatorMatch{}
+
+// percolatorMatchesLock allows locking of the percolator matches during
+// reads/writes
+var percolatorMatchesLock = sync.RWMutex{}
+
+// SavePercolatorQuery registers a percolator query and has peers reload their
+// queries, so that documents stored on any node are checked against it
+func SavePercolatorQuery(query types.PercolatorQuery) error {
+
+	if err := store.SavePercolatorQuery(query); err != nil {
+		return err
+	}
+
+	reloadPeerPercolatorQueries()
+
+	return nil
+
+}
+
+// DeletePercolatorQuery removes a percolator query and has peers reload their
+// queries, returning false if it did not exist
+func DeletePercolatorQuery(collection string, name string) (bool, error) {
+
+	deleted, err := store.DeletePercolatorQuery(collection, name)
+
+	if deleted && err == nil {
+		reloadPeerPercolatorQueries()
+	}
+
+	return deleted, err
+
+}
+
+// Have peers reload the percolator queries, waiting until they have done so
+func reloadPeerPercolatorQueries() {
+
+	for _, peerError := range ContactAllPeersAndWait(types.PeerMessage{Action: "reload_percolator"}) {
+		output.Log("Could not reload percolator queries on " + peerError)
+	}
+
+}
+
+// Reload this node's percolator queries from disk, keeping the ones already
+// loaded if they cannot be read
+func reloadPercolatorQueries() error {
+
+	err := store.LoadPercolatorQueries()
+
+	if err != nil {
+		output.Log("Could not reload percolator queries: " + err.Error())
+	}
+
+	return err
+
+}
+
+// GetPercolatorMatches gets the documents that have recently matched a
+// percolator query on this node, oldest first
+func GetPercolatorMatches(collection string, name string) []types.PercolatorMatch {
+
+	percolatorMatchesLock.RLock()
+	defer percolatorMatchesLock.RUnlock()
+
+	result := []types.PercolatorMatch{}
+
+	for _, match := range percolatorMatches {
+
+		if match.Collection == collection && match.Query == name {
+			result = append(result, match)
+		}
+
+	}
+
+	return result
+
+}
+
+// percolateDocuments checks documents that have just been stored on this node
+// against the percolator queries registered against their collection,
+// recording each match and sending it to the query's webhook, if it has one --
+// documents stored on other nodes are percolated by those nodes, so that each
+// match is only reported once
+func percolateDocuments(collection string, entries []types.JournalEntry) {
+
+	for _, entry := range entries {
+
+		document := []byte(entry.Document)
+
+		for _, query := range store.PercolateDocument(collection, entry.ID, document) {
+
+			match := types.PercolatorMatch{Query: query.Name, Collection: collection, ID: entry.ID, Version: entry.Version, MatchedAt: time.Now()}
+
+			recordPercolatorMatch(match)
+
+			if query.Webhook != "" {
+				go sendPercolatorWebhook(query.Webhook, match, document)
+			}
+
+		}
+
+	}
+
+}
+
+// Record a percolator match, forgetting the oldest matches if too many are
+// being kept
+func recordPercolatorMatch(match types.PercolatorMatch) {
+
+	percolatorMatchesLock.Lock()
+	defer percolatorMatchesLock.Unlock()
+
+	percolatorMatches = append(percolatorMatches, match)
+
+	if len(percolatorMatches) > maxPercolatorMatches {
+		percolatorMatches = percolatorMatches[1:]
+	}
+
+}
+
+// Send a percolator match, along with the document that matched, to a
+// webhook
+func sendPercolatorWebhook(webhook string, match types.PercolatorMatch, document []byte) {
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"query":      match.Query,
+		"collection": match.Collection,
+		"id":         match.ID,
+		"version":    match.Version,
+		"matched_at": match.MatchedAt.UTC().Format(time.RFC3339Nano),
+		"document":   json.RawMessage(document)})
+
+	if err != nil {
+		output.Log("Could not encode the match of '" + match.ID + "' to percolator query '" + match.Query + "': " + err.Error())
+		return
+	}
+
+	client := &http.Client{Timeout: percolatorWebhookTimeout}
+	response, err := client.Post(webhook, "application/json", bytes.NewBuffer(payload))
+
+	if err != nil {
+		output.Log("Could not send the match of '" + match.ID + "' to percolator query '" + match.Query + "' to its webhook: " + err.Error())
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		output.Log("Webhook of percolator query '" + match.Query + "' responded with status " + strconv.Itoa(response.StatusCode))
+	}
+
+}
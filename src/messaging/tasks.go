@@ -0,0 +1,251 @@
+package messaging
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/D-L-M/mem-db/src/crypt"
+	"github.com/D-L-M/mem-db/src/store"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// The most finished tasks that are remembered, after which the oldest are
+// forgotten
+const maxFinishedTasks = 100
+
+// Tasks being tracked, keyed by their IDs
+var tasks = map[string]*types.Task{}
+
+// IDs of the finished tasks still being tracked, oldest first
+var finishedTaskIds = []string{}
+
+// tasksLock allows locking of the tasks map and finished task IDs during
+// reads/writes
+var tasksLock = sync.RWMutex{}
+
+// createTask starts tracking a task that acts on a number of documents in a
+// collection
+func createTask(action string, collection string, total int, dryRun bool) (string, error) {
+
+	id, err := crypt.GenerateUUID()
+
+	if err != nil {
+		return "", err
+	}
+
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	tasks[id] = &types.Task{ID: id, Action: action, Collection: collection, Status: "running", DryRun: dryRun, Total: total, Failures: []types.TaskFailure{}, StartedAt: time.Now()}
+
+	return id, nil
+
+}
+
+// GetTask gets a copy of a task's progress so far
+func GetTask(id string) (types.Task, bool) {
+
+	tasksLock.RLock()
+	defer tasksLock.RUnlock()
+
+	task, ok := tasks[id]
+
+	if ok == false {
+		return types.Task{}, false
+	}
+
+	return copyTask(task), true
+
+}
+
+// GetTasks gets copies of every task being tracked, oldest first
+func GetTasks() []types.Task {
+
+	tasksLock.RLock()
+
+	result := []types.Task{}
+
+	for _, task := range tasks {
+		result = append(result, copyTask(task))
+	}
+
+	tasksLock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+
+	return result
+
+}
+
+// Copy a task so that it can be read while the original carries on changing
+// -- the tasks map must already be locked
+func copyTask(task *types.Task) types.Task {
+
+	taskCopy := *task
+	taskCopy.Failures = append([]types.TaskFailure{}, task.Failures...)
+
+	return taskCopy
+
+}
+
+// Record the outcome of a batch of a task's changes
+func recordTaskProgress(id string, succeeded int, failures []types.TaskFailure) {
+
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	if task, ok := tasks[id]; ok {
+		task.Processed += succeeded + len(failures)
+		task.Succeeded += succeeded
+		task.Failures = append(task.Failures, failures...)
+	}
+
+}
+
+// Mark a task as completed, forgetting the oldest finished tasks if too many
+// are being tracked
+func completeTask(id string) {
+
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	if task, ok := tasks[id]; ok {
+		task.Status = "completed"
+		task.CompletedAt = time.Now()
+		finishedTaskIds = append(finishedTaskIds, id)
+	}
+
+	for len(finishedTaskIds) > maxFinishedTasks {
+		delete(tasks, finishedTaskIds[0])
+		finishedTaskIds = finishedTaskIds[1:]
+	}
+
+}
+
+// runTask performs a task's bulk actions against a collection one batch at a
+// time, recording the outcome of each batch as it goes, then marks the task
+// as completed
+func runTask(id string, collection string, items []types.BulkItem, waitFor string) {
+
+	for start := 0; start < len(items); start += bulkBatchSize {
+
+		end := start + bulkBatchSize
+
+		if end > len(items) {
+			end = len(items)
+		}
+
+		succeeded := 0
+		failures := []types.TaskFailure{}
+
+		for i, result := range WriteBulkItems(collection, items[start:end], waitFor) {
+
+			if ReachedWriteStage(result, waitFor) {
+				succeeded++
+			} else {
+				failures = append(failures, types.TaskFailure{ID: items[start+i].ID, Errors: result.Errors})
+			}
+
+		}
+
+		recordTaskProgress(id, succeeded, failures)
+
+	}
+
+	completeTask(id)
+
+}
+
+// RemoveDocumentsByQuery starts a task that removes the documents in a
+// collection matching a set of criteria (up to a maximum number of them, if
+// the maximum is above 0), returning the task once it has completed or, if
+// not waiting for it to complete, as soon as it has started -- documents that
+// change after they are matched are left alone, and a dry run only counts the
+// documents that would be removed
+func RemoveDocumentsByQuery(collection string, criteria map[string][]interface{}, maxDocs int, dryRun bool, waitFor string, waitForCompletion bool) (types.Task, error) {
+
+	// Each removal only goes ahead if the document is still at the version
+	// it was matched at
+	items := []types.BulkItem{}
+	ids, versions := getTaskDocuments(collection, criteria, maxDocs)
+
+	for _, id := range ids {
+		items = append(items, types.BulkItem{Action: "delete", ID: id, ExpectedVersion: versions[id]})
+	}
+
+	return startTask("delete_by_query", collection, items, dryRun, waitFor, waitForCompletion)
+
+}
+
+// UpdateDocumentsByQuery starts a task that applies a list of update
+// operations to the documents in a collection matching a set of criteria, in
+// the same way as RemoveDocumentsByQuery
+func UpdateDocumentsByQuery(collection string, criteria map[string][]interface{}, operations interface{}, maxDocs int, dryRun bool, waitFor string, waitForCompletion bool) (types.Task, error) {
+
+	encodedOperations, err := json.Marshal(operations)
+
+	if err != nil {
+		return types.Task{}, err
+	}
+
+	items := []types.BulkItem{}
+	ids, versions := getTaskDocuments(collection, criteria, maxDocs)
+
+	for _, id := range ids {
+		items = append(items, types.BulkItem{Action: "update_operations", ID: id, Document: encodedOperations, ExpectedVersion: versions[id]})
+	}
+
+	return startTask("update_by_query", collection, items, dryRun, waitFor, waitForCompletion)
+
+}
+
+// Get the IDs of the documents in a collection matching a set of criteria, in
+// order, up to a maximum number of them (if the maximum is above 0), along
+// with the version each was at when it matched
+func getTaskDocuments(collection string, criteria map[string][]interface{}, maxDocs int) ([]string, map[string]int64) {
+
+	versions := store.SearchDocumentVersions(collection, criteria)
+	ids := []string{}
+
+	for id := range versions {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	if maxDocs > 0 && len(ids) > maxDocs {
+		ids = ids[:maxDocs]
+	}
+
+	return ids, versions
+
+}
+
+// Start a task that performs bulk actions against a collection, returning
+// the task once it has completed or, if not waiting for it to complete, as
+// soon as it has started
+func startTask(action string, collection string, items []types.BulkItem, dryRun bool, waitFor string, waitForCompletion bool) (types.Task, error) {
+
+	id, err := createTask(action, collection, len(items), dryRun)
+
+	if err != nil {
+		return types.Task{}, err
+	}
+
+	if dryRun {
+		completeTask(id)
+	} else if waitForCompletion {
+		runTask(id, collection, items, waitFor)
+	} else {
+		go runTask(id, collection, items, waitFor)
+	}
+
+	task, _ := GetTask(id)
+
+	return task, nil
+
+}
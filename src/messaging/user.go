@@ -14,7 +14,7 @@ func ProcessUserMessages() {
 		message := <-UserMessageQueue
 
 		if message.Action == "create" {
-			auth.AddUser(message.Username, message.Value)
+			auth.AddUser(message.Username, message.Value, message.Roles, message.Permissions)
 		}
 
 		if message.Action == "delete" {
@@ -27,10 +27,11 @@ func ProcessUserMessages() {
 
 }
 
-// AddUser adds a new user
-func AddUser(username string, password string) {
+// AddUser adds a new user or updates an existing one, optionally setting the
+// roles and permissions they are granted
+func AddUser(username string, password string, roles []string, permissions []string) {
 
-	UserMessageQueue <- types.UserMessage{Username: username, Value: password, Action: "create"}
+	UserMessageQueue <- types.UserMessage{Username: username, Value: password, Action: "create", Roles: roles, Permissions: permissions}
 
 }
 
@@ -2,9 +2,11 @@ package routing
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/D-L-M/jsonserver"
@@ -25,16 +27,19 @@ func RegisterRoutes() {
 		return auth.CheckCredentials(request, body), 401
 	}
 
-	// Check that the user is the root user
-	adminMiddleware := func(request *http.Request, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) (bool, int) {
+	// Check that the user has been granted a permission
+	permissionMiddleware := func(permission string) jsonserver.Middleware {
 
-		username, _, _ := auth.GetCredentials(request)
-		isRootUser := username == "root"
-
-		return isRootUser, 401
+		return func(request *http.Request, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) (bool, int) {
+			return auth.CheckPermission(request, body, permission), 403
+		}
 
 	}
 
+	readMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("documents:read")}
+	writeMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("documents:write")}
+	userMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("users:manage")}
+
 	// Welcome message
 	jsonserver.RegisterRoute("GET", "/", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
@@ -44,18 +49,48 @@ func RegisterRoutes() {
 
 	})
 
+	statsMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("stats:read")}
+
 	// Database stats
-	jsonserver.RegisterRoute("GET", "/_stats", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	statsAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else {
+
+			stats := store.GetStats(collection)
+			stats["collection"] = collection
+			stats["collections"] = store.GetCollectionNames()
+			stats["peers"] = messaging.GetPeers()
+
+			jsonserver.WriteResponse(response, &stats, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET", "/_stats", statsMiddleware, statsAction)
+	jsonserver.RegisterRoute("GET", "/{collection}/_stats", statsMiddleware, statsAction)
 
-		stats := store.GetStats()
-		stats["peers"] = messaging.GetPeers()
+	// List collections along with the number of documents in each
+	jsonserver.RegisterRoute("GET", "/_collections", statsMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
-		jsonserver.WriteResponse(response, &stats, http.StatusOK)
+		collections := []jsonserver.JSON{}
+
+		for _, collection := range store.GetCollectionNames() {
+			collections = append(collections, jsonserver.JSON{"name": collection, "totals": store.GetStats(collection)["totals"]})
+		}
+
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"default": data.DefaultCollection, "collections": collections}, http.StatusOK)
 
 	})
 
 	// Create or update/delete a user
-	jsonserver.RegisterRoute("POST|PUT", "/_user", []jsonserver.Middleware{authMiddleware, adminMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	jsonserver.RegisterRoute("POST|PUT", "/_user", userMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
 		var credentials map[string]interface{}
 
@@ -66,11 +101,18 @@ func RegisterRoutes() {
 		isCreateAction := err == nil && utils.MapHasKey(&credentials, "action") && credentials["action"] == "create"
 		isUpdateAction := err == nil && utils.MapHasKey(&credentials, "action") && credentials["action"] == "update"
 		isDeleteAction := err == nil && utils.MapHasKey(&credentials, "action") && credentials["action"] == "delete"
-		isCreateOrUpdateAction := isCreateAction || isUpdateAction
+		roles, permissions, accessErr := parseUserAccess(credentials)
+		isAccessChange := roles != nil || permissions != nil
+
+		if accessErr != nil {
 
-		if isCreateOrUpdateAction && hasUsername && hasPassword {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": accessErr.Error()}, http.StatusBadRequest)
 
-			go messaging.AddUser(credentials["username"].(string), credentials["password"].(string))
+		} else if hasUsername && ((isCreateAction && hasPassword) || (isUpdateAction && (hasPassword || isAccessChange))) {
+
+			password, _ := credentials["password"].(string)
+
+			go messaging.AddUser(credentials["username"].(string), password, roles, permissions)
 			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": "User will be created or updated"}, http.StatusAccepted)
 
 		} else if isDeleteAction && hasUsername && credentials["username"].(string) != "root" {
@@ -86,8 +128,89 @@ func RegisterRoutes() {
 
 	})
 
+	// List users along with their roles and permissions
+	jsonserver.RegisterRoute("GET", "/_user", userMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"users": auth.GetUsers(), "roles": auth.Roles}, http.StatusOK)
+
+	})
+
+	// Get a user's roles and permissions
+	jsonserver.RegisterRoute("GET", "/_user/{username}", userMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		username := routeParams["username"]
+		user, err := auth.GetUser(username)
+
+		if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "username": username, "message": "User does not exist"}, http.StatusNotFound)
+
+		} else {
+
+			userResponse := jsonserver.JSON(user)
+
+			jsonserver.WriteResponse(response, &userResponse, http.StatusOK)
+
+		}
+
+	})
+
+	// Create or update a user, optionally changing their roles and permissions
+	jsonserver.RegisterRoute("PUT", "/_user/{username}", userMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		username := routeParams["username"]
+
+		var account map[string]interface{}
+
+		err := json.Unmarshal(*body, &account)
+		roles, permissions, accessErr := parseUserAccess(account)
+		password, _ := account["password"].(string)
+
+		if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "username": username, "message": "Malformed request"}, http.StatusBadRequest)
+
+		} else if accessErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "username": username, "message": accessErr.Error()}, http.StatusBadRequest)
+
+		} else if password == "" && auth.UserExists(username) == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "username": username, "message": "New users must have a password"}, http.StatusBadRequest)
+
+		} else {
+
+			go messaging.AddUser(username, password, roles, permissions)
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "username": username, "message": "User will be created or updated"}, http.StatusAccepted)
+
+		}
+
+	})
+
+	// Delete a user
+	jsonserver.RegisterRoute("DELETE", "/_user/{username}", userMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		username := routeParams["username"]
+
+		if username == "root" {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "username": username, "message": "The root user cannot be deleted"}, http.StatusBadRequest)
+
+		} else if auth.UserExists(username) == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "username": username, "message": "User does not exist"}, http.StatusNotFound)
+
+		} else {
+
+			go messaging.DeleteUser(username)
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "username": username, "message": "User will be deleted"}, http.StatusAccepted)
+
+		}
+
+	})
+
 	// Receive an instructional message from a peer server
-	jsonserver.RegisterRoute("POST", "/_peer-message", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	jsonserver.RegisterRoute("POST", "/_peer-message", []jsonserver.Middleware{authMiddleware, permissionMiddleware("peers:message")}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
 		var message types.PeerMessage
 
@@ -97,6 +220,18 @@ func RegisterRoutes() {
 
 			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Malformed request"}, http.StatusBadRequest)
 
+		} else if message.Acknowledge {
+
+			// The peer is waiting to hear that the instructions have been
+			// acted upon
+			err := messaging.ActOnPeerMessageAndWait(message)
+
+			if err != nil {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusInternalServerError)
+			} else {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": "Instructions have been acted upon"}, http.StatusOK)
+			}
+
 		} else {
 
 			messaging.PeerMessageQueue <- message
@@ -107,204 +242,1631 @@ func RegisterRoutes() {
 
 	})
 
-	// Store a document
-	putDocumentAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
-
-		id, ok := routeParams["id"]
+	// Perform a batch of index, update and delete actions
+	bulkAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
-		// If an ID was not provided, create one
-		if ok == false {
+		// Bulk requests wait for their items to be persisted by default, so that
+		// the result of each can be reported
+		collection := getRouteCollection(routeParams)
+		waitFor := GetFirstParamValue(queryParams, "wait_for", "persisted")
+		items, err := parseBulkBody(body)
 
-			id, _ = crypt.GenerateUUID()
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
 
-			if id == "" {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
 
-				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "An error occurred whilst generating a document ID"}, http.StatusInternalServerError)
+		} else if isValidWaitFor(waitFor) == false {
 
-			}
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "The wait_for parameter must be one of indexed, persisted or replicated"}, http.StatusBadRequest)
 
-		}
+		} else if err != nil {
 
-		// If an ID was provided or has been generated, attempt to store the
-		// document under it
-		if id != "" {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusBadRequest)
 
-			_, err := store.ParseDocument(*body)
+		} else {
 
-			if err != nil {
+			startTime := time.Now()
+			results := messaging.WriteBulkItems(collection, items, waitFor)
+			itemResponses := []jsonserver.JSON{}
+			allSucceeded := true
 
-				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document is not valid JSON"}, http.StatusBadRequest)
+			for i, result := range results {
 
-			} else {
+				itemResponse := jsonserver.JSON{"action": items[i].Action, "id": items[i].ID, "success": true}
 
-				go messaging.AddDocument(id, body, true)
+				if messaging.ReachedWriteStage(result, waitFor) {
+					itemResponse["message"] = bulkItemMessages[items[i].Action]
+					itemResponse["version"] = result.Version
+				} else {
+					itemResponse["success"] = false
+					itemResponse["errors"] = result.Errors
+					allSucceeded = false
+				}
 
-				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "id": id, "message": "Document will be stored"}, http.StatusAccepted)
+				itemResponses = append(itemResponses, itemResponse)
 
 			}
 
+			timeTaken := (time.Since(startTime).Nanoseconds() / int64(time.Millisecond))
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": allSucceeded, "time_taken": timeTaken, "wait_for": waitFor, "items": itemResponses}, http.StatusOK)
+
 		}
 
 	}
 
-	jsonserver.RegisterRoute("PUT", "/", []jsonserver.Middleware{authMiddleware}, putDocumentAction)
-	jsonserver.RegisterRoute("PUT", "/{id}", []jsonserver.Middleware{authMiddleware}, putDocumentAction)
+	jsonserver.RegisterRoute("POST|PUT", "/_bulk", writeMiddleware, bulkAction)
+	jsonserver.RegisterRoute("POST|PUT", "/{collection}/_bulk", writeMiddleware, bulkAction)
 
-	// Truncate the database
-	jsonserver.RegisterRoute("DELETE", "/_all", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	mappingMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("mappings:manage")}
 
-		go messaging.RemoveAllDocuments(true)
+	// Declare the types of a collection's fields
+	putMappingAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
-		jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": "All documents will be removed"}, http.StatusAccepted)
+		collection := getRouteCollection(routeParams)
+		waitFor := GetFirstParamValue(queryParams, "wait_for", "persisted")
+		collectionErr := store.ValidateCollectionName(collection)
+		mapping, err := store.ParseMapping(*body)
 
-	})
+		if collectionErr != nil {
 
-	// Remove a document
-	jsonserver.RegisterRoute("DELETE", "/{id}", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
 
-		id := routeParams["id"]
-		_, err := store.GetRawDocument(id)
+		} else if waitFor == "" || isValidWaitFor(waitFor) == false {
 
-		if err != nil {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "The wait_for parameter must be one of indexed, persisted or replicated"}, http.StatusBadRequest)
 
-			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document does not exist"}, http.StatusNotFound)
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "collection": collection, "message": err.Error()}, http.StatusBadRequest)
 
 		} else {
 
-			go messaging.RemoveDocument(id, true)
+			result := messaging.SetMappingAndWait(collection, body, waitFor)
 
-			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "id": id, "message": "Document will be removed"}, http.StatusAccepted)
+			if messaging.ReachedWriteStage(result, waitFor) {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "collection": collection, "message": "Mapping has been updated", "wait_for": waitFor, "mapping": store.EncodeMapping(mapping)}, http.StatusOK)
+			} else {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "collection": collection, "message": "Mapping was not " + waitFor, "wait_for": waitFor, "errors": result.Errors}, http.StatusInternalServerError)
+			}
 
 		}
 
-	})
+	}
 
-	// Search for documents by criteria
-	jsonserver.RegisterRoute("GET|POST", "/_search", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	jsonserver.RegisterRoute("PUT", "/_mapping", mappingMiddleware, putMappingAction)
+	jsonserver.RegisterRoute("PUT", "/{collection}/_mapping", mappingMiddleware, putMappingAction)
 
-		// If no body sent, assume an empty criteria
+	// Get the declared types of a collection's fields
+	getMappingAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"collection": collection, "mapping": store.EncodeMapping(store.GetMapping(collection))}, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET", "/_mapping", readMiddleware, getMappingAction)
+	jsonserver.RegisterRoute("GET", "/{collection}/_mapping", readMiddleware, getMappingAction)
+
+	percolatorMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("percolator:manage")}
+
+	// Register a query that stored documents are percolated against
+	putPercolatorQueryAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+		name := routeParams["name"]
+		collectionErr := store.ValidateCollectionName(collection)
+
+		// If no body sent, match every document
 		if string((*body)[:]) == "" {
 			emptyBody := []byte("{}")
 			body = &emptyBody
 		}
 
-		// Get the actual JSON criteria
-		var criteria map[string][]interface{}
+		criteria, options, err := parseSearchBody(body, []string{"webhook"})
+		webhook, webhookOk := options["webhook"].(string)
 
-		err := json.Unmarshal(*body, &criteria)
+		if collectionErr != nil {
 
-		if err != nil {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
 
-			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Search criteria is not valid JSON"}, http.StatusBadRequest)
+		} else if err != nil {
 
-			// Retrieve documents matching the search criteria
-		} else {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": err.Error()}, http.StatusBadRequest)
 
-			from, _ := strconv.Atoi(GetFirstParamValue(queryParams, "from", "0"))
-			size, _ := strconv.Atoi(GetFirstParamValue(queryParams, "size", "25"))
-			significantTermsField := GetFirstParamValue(queryParams, "significant_terms_field", "")
-			significantTermsThreshold, _ := strconv.Atoi(GetFirstParamValue(queryParams, "significant_terms_threshold", "200"))
-			significantTermsMinimumOccurrencePercentage, _ := strconv.ParseFloat(GetFirstParamValue(queryParams, "significant_terms_minimum", "33.34"), 64)
-			criteria := map[string][]interface{}(criteria)
-			startTime := time.Now()
+		} else if options["webhook"] != nil && webhookOk == false {
 
-			includeAllMatches := false
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": "The webhook must be an HTTP or HTTPS URL"}, http.StatusBadRequest)
 
-			if significantTermsField != "" {
-				includeAllMatches = true
-			}
+		} else {
 
-			totalDocumentCount, documents, allDocuments := store.SearchDocuments(criteria, from, size, includeAllMatches)
-			significantTerms := []map[string]interface{}{}
+			query := types.PercolatorQuery{Name: name, Collection: collection, Criteria: criteria, Webhook: webhook}
 
-			// Optionally get significant terms
-			if significantTermsField != "" {
-				significantTerms = store.DiscoverSignificantTerms(&allDocuments, significantTermsField, significantTermsThreshold, significantTermsMinimumOccurrencePercentage)
+			if queryErr := store.ValidatePercolatorQuery(query); queryErr != nil {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": queryErr.Error()}, http.StatusBadRequest)
+			} else if saveErr := messaging.SavePercolatorQuery(query); saveErr != nil {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": saveErr.Error()}, http.StatusInternalServerError)
+			} else {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "name": name, "message": "Percolator query has been saved", "query": getPercolatorQueryResponse(query)}, http.StatusOK)
 			}
 
-			timeTaken := (time.Since(startTime).Nanoseconds() / int64(time.Millisecond))
-			info := map[string]interface{}{"total_matches": totalDocumentCount, "time_taken": timeTaken}
-			searchResults := jsonserver.JSON{"criteria": criteria, "information": info, "results": documents}
+		}
 
-			// Optionally include significant terms
-			if significantTermsField != "" {
-				searchResults["significant_terms"] = significantTerms
+	}
+
+	jsonserver.RegisterRoute("PUT", "/_percolator/{name}", percolatorMiddleware, putPercolatorQueryAction)
+	jsonserver.RegisterRoute("PUT", "/{collection}/_percolator/{name}", percolatorMiddleware, putPercolatorQueryAction)
+
+	// List the queries that stored documents are percolated against
+	listPercolatorQueriesAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
+
+		} else {
+
+			queries := []jsonserver.JSON{}
+
+			for _, query := range store.GetPercolatorQueries(collection) {
+				queries = append(queries, getPercolatorQueryResponse(query))
 			}
 
-			jsonserver.WriteResponse(response, &searchResults, http.StatusOK)
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"queries": queries}, http.StatusOK)
 
 		}
 
-	})
+	}
 
-	// Delete documents by criteria
-	jsonserver.RegisterRoute("GET|POST", "/_delete", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	jsonserver.RegisterRoute("GET", "/_percolator", readMiddleware, listPercolatorQueriesAction)
+	jsonserver.RegisterRoute("GET", "/{collection}/_percolator", readMiddleware, listPercolatorQueriesAction)
 
-		// If no body sent, assume an empty criteria
-		if string((*body)[:]) == "" {
-			emptyBody := []byte("{}")
-			body = &emptyBody
+	// Get a query that stored documents are percolated against
+	getPercolatorQueryAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+		name := routeParams["name"]
+
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
+		} else if query, ok := store.GetPercolatorQuery(collection, name); ok {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"query": getPercolatorQueryResponse(query)}, http.StatusOK)
+		} else {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": "Percolator query does not exist"}, http.StatusNotFound)
 		}
 
-		// Get the actual JSON criteria
-		var criteria map[string][]interface{}
+	}
+
+	jsonserver.RegisterRoute("GET", "/_percolator/{name}", readMiddleware, getPercolatorQueryAction)
+	jsonserver.RegisterRoute("GET", "/{collection}/_percolator/{name}", readMiddleware, getPercolatorQueryAction)
 
-		err := json.Unmarshal(*body, &criteria)
+	// Remove a query that stored documents are percolated against
+	deletePercolatorQueryAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
-		if err != nil {
+		collection := getRouteCollection(routeParams)
+		name := routeParams["name"]
 
-			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Search criteria is not valid JSON"}, http.StatusBadRequest)
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
 
-			// Retrieve documents matching the search criteria
 		} else {
 
-			criteria := map[string][]interface{}(criteria)
+			deleted, err := messaging.DeletePercolatorQuery(collection, name)
+
+			if err != nil {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": err.Error()}, http.StatusInternalServerError)
+			} else if deleted == false {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": "Percolator query does not exist"}, http.StatusNotFound)
+			} else {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "name": name, "message": "Percolator query has been removed"}, http.StatusOK)
+			}
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("DELETE", "/_percolator/{name}", percolatorMiddleware, deletePercolatorQueryAction)
+	jsonserver.RegisterRoute("DELETE", "/{collection}/_percolator/{name}", percolatorMiddleware, deletePercolatorQueryAction)
+
+	// Get the documents stored on this node that have recently matched a
+	// percolator query
+	percolatorMatchesAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+		name := routeParams["name"]
+
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
+
+		} else if _, ok := store.GetPercolatorQuery(collection, name); ok == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "name": name, "message": "Percolator query does not exist"}, http.StatusNotFound)
+
+		} else {
 
-			documentIds := store.SearchDocumentIds(criteria)
+			matches := []jsonserver.JSON{}
 
-			for _, documentID := range documentIds {
-				go messaging.RemoveDocument(documentID, true)
+			for _, match := range messaging.GetPercolatorMatches(collection, name) {
+				matches = append(matches, jsonserver.JSON{"id": match.ID, "version": match.Version, "matched_at": match.MatchedAt.UTC().Format(time.RFC3339Nano)})
 			}
 
-			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": strconv.Itoa(len(documentIds)) + " document(s) will be removed"}, http.StatusAccepted)
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"name": name, "matches": matches}, http.StatusOK)
 
 		}
 
-	})
+	}
 
-	// Get a document
-	jsonserver.RegisterRoute("GET", "/{id}", []jsonserver.Middleware{authMiddleware}, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+	jsonserver.RegisterRoute("GET", "/_percolator/{name}/_matches", readMiddleware, percolatorMatchesAction)
+	jsonserver.RegisterRoute("GET", "/{collection}/_percolator/{name}/_matches", readMiddleware, percolatorMatchesAction)
 
-		id := routeParams["id"]
-		document, err := store.GetDocument(id)
+	// Find the percolator queries a document would match, without storing it
+	percolateAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
-		if err != nil {
+		collection := getRouteCollection(routeParams)
 
-			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document does not exist"}, http.StatusNotFound)
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
+
+		} else if _, err := store.ParseDocument(*body); err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Document is not valid JSON"}, http.StatusBadRequest)
 
 		} else {
 
-			jsonserver.WriteResponse(response, &document, http.StatusOK)
+			names := []string{}
+
+			for _, query := range store.PercolateDocument(collection, "_percolate", *body) {
+				names = append(names, query.Name)
+			}
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"matches": names}, http.StatusOK)
 
 		}
 
-	})
+	}
 
-}
+	jsonserver.RegisterRoute("POST", "/_percolate", readMiddleware, percolateAction)
+	jsonserver.RegisterRoute("POST", "/{collection}/_percolate", readMiddleware, percolateAction)
 
-// GetFirstParamValue extracts the first value for a key from a route's URL parameters
-func GetFirstParamValue(params url.Values, key string, fallback string) string {
+	// Store a document
+	putDocumentAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
 
-	if _, ok := params[key]; ok {
+		collection := getRouteCollection(routeParams)
+		id, ok := routeParams["id"]
+		waitFor := GetFirstParamValue(queryParams, "wait_for", "")
+		expectedVersion, expectedETag, conditionsErr := getWriteConditions(request, queryParams)
 
-		values := params[key]
+		// Documents can only be stored in collections with valid names
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
+
+			return
 
-		if len(values) >= 1 {
-			return values[0]
 		}
 
-	}
+		// Only known stages of a write can be waited for
+		if isValidWaitFor(waitFor) == false {
 
-	return fallback
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "The wait_for parameter must be one of indexed, persisted or replicated"}, http.StatusBadRequest)
+
+			return
+
+		}
+
+		if conditionsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": conditionsErr.Error()}, http.StatusBadRequest)
+
+			return
+
+		}
+
+		// Conditional writes have to wait in order to report a conflict
+		if waitFor == "" && (expectedVersion != 0 || expectedETag != "") {
+			waitFor = "persisted"
+		}
+
+		// If an ID was not provided, create one
+		if ok == false {
+
+			id, _ = crypt.GenerateUUID()
+
+			if id == "" {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "An error occurred whilst generating a document ID"}, http.StatusInternalServerError)
+
+			}
+
+		}
+
+		// If an ID was provided or has been generated, attempt to store the
+		// document under it
+		if id != "" {
+
+			_, err := store.ParseDocument(*body)
+
+			if err != nil {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document is not valid JSON"}, http.StatusBadRequest)
+
+			} else if mappingErr := store.ValidateDocument(collection, *body); mappingErr != nil {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": mappingErr.Error()}, http.StatusBadRequest)
+
+			} else if waitFor != "" {
+
+				result := messaging.AddDocumentAndWait(collection, id, body, waitFor, expectedVersion, expectedETag)
+
+				writeWaitedResponse(response, id, waitFor, result, "Document has been stored")
+
+			} else {
+
+				go messaging.AddDocument(collection, id, body, true)
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "id": id, "message": "Document will be stored"}, http.StatusAccepted)
+
+			}
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("PUT", "/", writeMiddleware, putDocumentAction)
+	jsonserver.RegisterRoute("PUT", "/{collection}/_doc", writeMiddleware, putDocumentAction)
+	jsonserver.RegisterRoute("PUT", "/{id}", writeMiddleware, putDocumentAction)
+	jsonserver.RegisterRoute("PUT", "/{collection}/{id}", writeMiddleware, putDocumentAction)
+
+	// Partially update a document
+	patchDocumentAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		// Patches are applied by the document worker, so they always wait for
+		// at least that to happen in order to report whether they applied
+		collection := getRouteCollection(routeParams)
+		id := routeParams["id"]
+		waitFor := GetFirstParamValue(queryParams, "wait_for", "persisted")
+		patchType, err := getPatchType(request, body)
+		expectedVersion, expectedETag, conditionsErr := getWriteConditions(request, queryParams)
+		_, existsErr := store.GetRawDocument(collection, id)
+
+		if isValidWaitFor(waitFor) == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "The wait_for parameter must be one of indexed, persisted or replicated"}, http.StatusBadRequest)
+
+		} else if conditionsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": conditionsErr.Error()}, http.StatusBadRequest)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Patch is not valid JSON"}, http.StatusBadRequest)
+
+		} else if existsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document does not exist"}, http.StatusNotFound)
+
+		} else {
+
+			result := messaging.PatchDocumentAndWait(collection, id, body, patchType, waitFor, expectedVersion, expectedETag)
+
+			if result.Rejected && result.Conflict == false {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Patch could not be applied", "errors": result.Errors}, http.StatusUnprocessableEntity)
+			} else {
+				writeWaitedResponse(response, id, waitFor, result, "Document has been updated")
+			}
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("PATCH", "/{id}", writeMiddleware, patchDocumentAction)
+	jsonserver.RegisterRoute("PATCH", "/{collection}/{id}", writeMiddleware, patchDocumentAction)
+
+	truncateMiddleware := []jsonserver.Middleware{authMiddleware, permissionMiddleware("documents:truncate")}
+
+	// Truncate a collection
+	truncateAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		if collectionErr := store.ValidateCollectionName(collection); collectionErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": collectionErr.Error()}, http.StatusBadRequest)
+
+		} else if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else {
+
+			go messaging.RemoveAllDocuments(collection, true)
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": "All documents will be removed"}, http.StatusAccepted)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("DELETE", "/_all", truncateMiddleware, truncateAction)
+	jsonserver.RegisterRoute("DELETE", "/{collection}/_all", truncateMiddleware, truncateAction)
+
+	// Get the next page of a scroll through the documents matched by a search
+	continueScrollAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		scrollID := GetFirstParamValue(queryParams, "scroll_id", "")
+		ttl, ttlErr := store.ParseScrollTTL(GetFirstParamValue(queryParams, "scroll", "1m"))
+
+		if ttlErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": ttlErr.Error()}, http.StatusBadRequest)
+
+		} else {
+
+			startTime := time.Now()
+			collection, totalDocumentCount, documents, err := store.ContinueScroll(scrollID, ttl)
+
+			if err != nil {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "scroll_id": scrollID, "message": err.Error()}, http.StatusNotFound)
+
+			} else {
+
+				projectHits(documents, queryParams)
+
+				timeTaken := (time.Since(startTime).Nanoseconds() / int64(time.Millisecond))
+				info := map[string]interface{}{"total_matches": totalDocumentCount, "time_taken": timeTaken, "scroll_id": scrollID}
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"collection": collection, "information": info, "results": documents}, http.StatusOK)
+
+			}
+
+		}
+
+	}
+
+	// Close a scroll before it expires -- registered ahead of document removal
+	// so that it isn't mistaken for a document
+	clearScrollAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		scrollID := GetFirstParamValue(queryParams, "scroll_id", "")
+
+		if store.ClearScroll(scrollID) {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "scroll_id": scrollID, "message": "Scroll has been cleared"}, http.StatusOK)
+		} else {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "scroll_id": scrollID, "message": "Scroll does not exist or has expired"}, http.StatusNotFound)
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET|POST", "/_search/scroll", readMiddleware, continueScrollAction)
+	jsonserver.RegisterRoute("DELETE", "/_search/scroll", readMiddleware, clearScrollAction)
+
+	// Remove a document
+	removeDocumentAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+		id := routeParams["id"]
+		waitFor := GetFirstParamValue(queryParams, "wait_for", "")
+		expectedVersion, expectedETag, conditionsErr := getWriteConditions(request, queryParams)
+		_, err := store.GetRawDocument(collection, id)
+
+		// Conditional writes have to wait in order to report a conflict
+		if waitFor == "" && (expectedVersion != 0 || expectedETag != "") {
+			waitFor = "persisted"
+		}
+
+		if isValidWaitFor(waitFor) == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "The wait_for parameter must be one of indexed, persisted or replicated"}, http.StatusBadRequest)
+
+		} else if conditionsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": conditionsErr.Error()}, http.StatusBadRequest)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document does not exist"}, http.StatusNotFound)
+
+		} else if waitFor != "" {
+
+			result := messaging.RemoveDocumentAndWait(collection, id, waitFor, expectedVersion, expectedETag)
+
+			writeWaitedResponse(response, id, waitFor, result, "Document has been removed")
+
+		} else {
+
+			go messaging.RemoveDocument(collection, id, true)
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "id": id, "message": "Document will be removed"}, http.StatusAccepted)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("DELETE", "/{id}", writeMiddleware, removeDocumentAction)
+	jsonserver.RegisterRoute("DELETE", "/{collection}/{id}", writeMiddleware, removeDocumentAction)
+
+	// Search for documents by criteria
+	searchAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		// If no body sent, assume an empty criteria
+		if string((*body)[:]) == "" {
+			emptyBody := []byte("{}")
+			body = &emptyBody
+		}
+
+		// Get the actual JSON criteria, separating out any search options
+		criteria, options, err := parseSearchBody(body, searchOptionKeys)
+		sortFields, sortErr := store.ParseSortFields(options["sort"])
+		aggregations, aggregationsErr := store.ParseAggregations(options["aggregations"])
+		highlight, highlightErr := store.ParseHighlight(options["highlight"])
+		significantTermsField := GetFirstParamValue(queryParams, "significant_terms_field", "")
+		searchAfter := GetFirstParamValue(queryParams, "search_after", "")
+		scroll := GetFirstParamValue(queryParams, "scroll", "")
+		scrollTTL, scrollErr := store.ParseScrollTTL(scroll)
+		from, _ := strconv.Atoi(GetFirstParamValue(queryParams, "from", "0"))
+		size, _ := strconv.Atoi(GetFirstParamValue(queryParams, "size", "25"))
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusBadRequest)
+
+		} else if sortErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": sortErr.Error()}, http.StatusBadRequest)
+
+		} else if aggregationsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": aggregationsErr.Error()}, http.StatusBadRequest)
+
+		} else if highlightErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": highlightErr.Error()}, http.StatusBadRequest)
+
+		} else if scroll != "" && scrollErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": scrollErr.Error()}, http.StatusBadRequest)
+
+		} else if scroll != "" && (size < 1 || searchAfter != "" || significantTermsField != "" || len(aggregations) > 0) {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Scrolls need a size of at least 1, and cannot be combined with search_after, significant terms or aggregations"}, http.StatusBadRequest)
+
+			// Start a scroll through the documents matching the search criteria
+		} else if scroll != "" {
+
+			startTime := time.Now()
+			scrollID, totalDocumentCount, documents, err := store.StartScroll(collection, criteria, size, sortFields, highlight, scrollTTL)
+
+			if err != nil {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusTooManyRequests)
+
+			} else {
+
+				projectHits(documents, queryParams)
+
+				timeTaken := (time.Since(startTime).Nanoseconds() / int64(time.Millisecond))
+				info := map[string]interface{}{"total_matches": totalDocumentCount, "time_taken": timeTaken, "scroll_id": scrollID}
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"criteria": criteria, "information": info, "results": documents}, http.StatusOK)
+
+			}
+
+			// Retrieve documents matching the search criteria
+		} else {
+
+			significantTermsThreshold, _ := strconv.Atoi(GetFirstParamValue(queryParams, "significant_terms_threshold", "200"))
+			significantTermsMinimumOccurrencePercentage, _ := strconv.ParseFloat(GetFirstParamValue(queryParams, "significant_terms_minimum", "33.34"), 64)
+			startTime := time.Now()
+
+			includeAllMatches := false
+
+			if significantTermsField != "" || len(aggregations) > 0 {
+				includeAllMatches = true
+			}
+
+			totalDocumentCount, documents, allDocuments, nextCursor, searchErr := store.SearchDocuments(collection, criteria, from, size, sortFields, searchAfter, includeAllMatches)
+			significantTerms := []map[string]interface{}{}
+
+			if searchErr != nil {
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": searchErr.Error()}, http.StatusBadRequest)
+				return
+			}
+
+			aggregationResults := jsonserver.JSON{}
+
+			// Optionally get significant terms
+			if significantTermsField != "" {
+				significantTerms = store.DiscoverSignificantTerms(collection, &allDocuments, significantTermsField, significantTermsThreshold, significantTermsMinimumOccurrencePercentage)
+			}
+
+			// Optionally compute aggregations over all matches
+			if len(aggregations) > 0 {
+				aggregationResults = store.Aggregate(&allDocuments, aggregations)
+			}
+
+			// Optionally highlight the matched terms in the returned documents
+			if highlight != nil {
+				store.HighlightDocuments(collection, criteria, &documents, *highlight)
+			}
+
+			// Optionally return only the requested parts of each document, once
+			// everything else has been worked out from the whole documents
+			projectHits(documents, queryParams)
+
+			timeTaken := (time.Since(startTime).Nanoseconds() / int64(time.Millisecond))
+			info := map[string]interface{}{"total_matches": totalDocumentCount, "time_taken": timeTaken}
+
+			// Hand out a cursor for the next page if there is one
+			if nextCursor != "" {
+				info["search_after"] = nextCursor
+			}
+			searchResults := jsonserver.JSON{"criteria": criteria, "information": info, "results": documents}
+
+			// Optionally include significant terms
+			if significantTermsField != "" {
+				searchResults["significant_terms"] = significantTerms
+			}
+
+			// Optionally include aggregations
+			if len(aggregations) > 0 {
+				searchResults["aggregations"] = aggregationResults
+			}
+
+			jsonserver.WriteResponse(response, &searchResults, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET|POST", "/_search", readMiddleware, searchAction)
+	jsonserver.RegisterRoute("GET|POST", "/{collection}/_search", readMiddleware, searchAction)
+
+	// Count the documents matching some criteria
+	countAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		// If no body sent, assume an empty criteria
+		if string((*body)[:]) == "" {
+			emptyBody := []byte("{}")
+			body = &emptyBody
+		}
+
+		// Search options don't affect the count, so they are ignored
+		criteria, _, err := parseSearchBody(body, searchOptionKeys)
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusBadRequest)
+
+		} else {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"criteria": criteria, "count": store.CountDocuments(collection, criteria)}, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET|POST", "/_count", readMiddleware, countAction)
+	jsonserver.RegisterRoute("GET|POST", "/{collection}/_count", readMiddleware, countAction)
+
+	// Delete documents by criteria
+	deleteByQueryAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		// If no body sent, assume an empty criteria
+		if string((*body)[:]) == "" {
+			emptyBody := []byte("{}")
+			body = &emptyBody
+		}
+
+		// Get the actual JSON criteria, and how the documents matching them
+		// should be removed
+		criteria, _, err := parseSearchBody(body, nil)
+		waitFor, maxDocs, dryRun, waitForCompletion, optionsErr := getTaskOptions(queryParams)
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusBadRequest)
+
+		} else if optionsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": optionsErr.Error()}, http.StatusBadRequest)
+
+			// Remove the documents matching the search criteria as a task
+		} else {
+
+			task, taskErr := messaging.RemoveDocumentsByQuery(collection, criteria, maxDocs, dryRun, waitFor, waitForCompletion)
+
+			if taskErr != nil {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": taskErr.Error()}, http.StatusInternalServerError)
+
+			} else if dryRun {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": strconv.Itoa(task.Total) + " document(s) would be removed", "task": getTaskResponse(task)}, http.StatusOK)
+
+			} else if waitForCompletion == false {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": strconv.Itoa(task.Total) + " document(s) will be removed", "task": getTaskResponse(task)}, http.StatusAccepted)
+
+			} else {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": len(task.Failures) == 0, "message": strconv.Itoa(task.Succeeded) + " of " + strconv.Itoa(task.Total) + " document(s) have been removed", "task": getTaskResponse(task)}, http.StatusOK)
+
+			}
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET|POST", "/_delete", writeMiddleware, deleteByQueryAction)
+	jsonserver.RegisterRoute("GET|POST", "/{collection}/_delete", writeMiddleware, deleteByQueryAction)
+
+	// Update documents by criteria
+	updateByQueryAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		// Get the JSON criteria and the operations to apply to the documents
+		// matching them, and how they should be applied
+		criteria, options, err := parseSearchBody(body, []string{"operations"})
+		waitFor, maxDocs, dryRun, waitForCompletion, optionsErr := getTaskOptions(queryParams)
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusBadRequest)
+
+		} else if optionsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": optionsErr.Error()}, http.StatusBadRequest)
+
+		} else if operationsErr := utils.ValidateUpdateOperations(options["operations"]); operationsErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": operationsErr.Error()}, http.StatusBadRequest)
+
+			// Update the documents matching the search criteria as a task
+		} else {
+
+			task, taskErr := messaging.UpdateDocumentsByQuery(collection, criteria, options["operations"], maxDocs, dryRun, waitFor, waitForCompletion)
+
+			if taskErr != nil {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": taskErr.Error()}, http.StatusInternalServerError)
+
+			} else if dryRun {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": strconv.Itoa(task.Total) + " document(s) would be updated", "task": getTaskResponse(task)}, http.StatusOK)
+
+			} else if waitForCompletion == false {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "message": strconv.Itoa(task.Total) + " document(s) will be updated", "task": getTaskResponse(task)}, http.StatusAccepted)
+
+			} else {
+
+				jsonserver.WriteResponse(response, &jsonserver.JSON{"success": len(task.Failures) == 0, "message": strconv.Itoa(task.Succeeded) + " of " + strconv.Itoa(task.Total) + " document(s) have been updated", "task": getTaskResponse(task)}, http.StatusOK)
+
+			}
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("POST", "/_update_by_query", writeMiddleware, updateByQueryAction)
+	jsonserver.RegisterRoute("POST", "/{collection}/_update_by_query", writeMiddleware, updateByQueryAction)
+
+	// List the tasks being tracked
+	jsonserver.RegisterRoute("GET", "/_tasks", readMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		taskResponses := []jsonserver.JSON{}
+
+		for _, task := range messaging.GetTasks() {
+			taskResponses = append(taskResponses, getTaskResponse(task))
+		}
+
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"tasks": taskResponses}, http.StatusOK)
+
+	})
+
+	// Get the progress of a task
+	jsonserver.RegisterRoute("GET", "/_tasks/{task_id}", readMiddleware, func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		if task, ok := messaging.GetTask(routeParams["task_id"]); ok {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"task": getTaskResponse(task)}, http.StatusOK)
+		} else {
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "task_id": routeParams["task_id"], "message": "Task does not exist"}, http.StatusNotFound)
+		}
+
+	})
+
+	// Follow the changes made to documents as they happen
+	changesAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		// If no body sent, follow every change
+		if string((*body)[:]) == "" {
+			emptyBody := []byte("{}")
+			body = &emptyBody
+		}
+
+		criteria, _, err := parseSearchBody(body, nil)
+		since, sinceErr := getChangesSince(request, queryParams)
+		timeout, timeoutErr := time.ParseDuration(GetFirstParamValue(queryParams, "timeout", "0s"))
+		fields, exclude := getProjection(queryParams)
+		flusher, canFlush := response.(http.Flusher)
+
+		// Event streams are sent to clients that ask for them, and everything
+		// else gets newline-delimited JSON
+		format := GetFirstParamValue(queryParams, "format", "ndjson")
+
+		if strings.Contains(request.Header.Get("Accept"), "text/event-stream") && queryParams.Get("format") == "" {
+			format = "sse"
+		}
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": err.Error()}, http.StatusBadRequest)
+
+		} else if sinceErr != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": sinceErr.Error()}, http.StatusBadRequest)
+
+		} else if timeoutErr != nil || timeout < 0 {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "The timeout parameter must be a duration such as 30s or 5m"}, http.StatusBadRequest)
+
+		} else if format != "ndjson" && format != "sse" {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "The format parameter must be one of ndjson or sse"}, http.StatusBadRequest)
+
+		} else if canFlush == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Changes cannot be streamed"}, http.StatusInternalServerError)
+
+		} else if changes, latest, notifier, changesErr := store.ChangesSince(since); changesErr != nil {
+
+			goneResponse := getChangesGoneResponse(changesErr)
+			goneResponse["success"] = false
+
+			jsonserver.WriteResponse(response, &goneResponse, http.StatusGone)
+
+			// Stream the changes since the given sequence number, then each new
+			// change as it happens, until the client goes away or the timeout
+			// is reached
+		} else {
+
+			if format == "sse" {
+				response.Header().Set("Content-Type", "text/event-stream")
+			} else {
+				response.Header().Set("Content-Type", "application/x-ndjson")
+			}
+
+			response.Header().Set("Cache-Control", "no-cache")
+			response.WriteHeader(http.StatusOK)
+
+			// A heartbeat tells the client where the feed has got up to even
+			// when no changes match
+			writeChangesEvent(response, format, since, jsonserver.JSON{"type": "heartbeat"})
+
+			heartbeat := time.NewTicker(changesHeartbeatInterval)
+			defer heartbeat.Stop()
+
+			var expired <-chan time.Time
+
+			if timeout > 0 {
+				expired = time.After(timeout)
+			}
+
+			for {
+
+				for _, change := range changes {
+
+					if store.ChangeMatchesCriteria(change, collection, criteria) {
+						writeChangesEvent(response, format, change.Sequence, getChangeResponse(change, fields, exclude))
+					}
+
+				}
+
+				flusher.Flush()
+
+				select {
+
+				case <-notifier:
+
+				case <-heartbeat.C:
+					writeChangesEvent(response, format, latest, jsonserver.JSON{"type": "heartbeat"})
+
+				case <-expired:
+					return
+
+				case <-request.Context().Done():
+					return
+
+				}
+
+				changes, latest, notifier, changesErr = store.ChangesSince(latest)
+
+				// Clients that fall too far behind have to resynchronise before
+				// following the feed again
+				if changesErr != nil {
+
+					errorEvent := getChangesGoneResponse(changesErr)
+					errorEvent["type"] = "error"
+
+					writeChangesEvent(response, format, latest, errorEvent)
+
+					return
+
+				}
+
+			}
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET|POST", "/_changes", readMiddleware, changesAction)
+	jsonserver.RegisterRoute("GET|POST", "/{collection}/_changes", readMiddleware, changesAction)
+
+	// Get several documents by their IDs
+	multiGetAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+
+		var multiGetBody map[string][]string
+
+		err := json.Unmarshal(*body, &multiGetBody)
+		ids, hasIds := multiGetBody["ids"]
+
+		if store.CollectionExists(collection) == false && collection != data.DefaultCollection {
+
+			writeMissingCollectionResponse(response, collection)
+
+		} else if err != nil || hasIds == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "message": "Request must contain an array of document IDs"}, http.StatusBadRequest)
+
+		} else {
+
+			documents := store.GetDocuments(collection, ids)
+
+			projectHits(documents, queryParams)
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"documents": documents}, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET|POST", "/_mget", readMiddleware, multiGetAction)
+	jsonserver.RegisterRoute("GET|POST", "/{collection}/_mget", readMiddleware, multiGetAction)
+
+	// Get a document
+	getDocumentAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+		id := routeParams["id"]
+		rawDocument, version, etag, err := store.GetRawDocumentWithVersion(collection, id)
+
+		var document jsonserver.JSON
+
+		if err == nil {
+			err = json.Unmarshal(rawDocument, &document)
+		}
+
+		if err != nil {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document does not exist"}, http.StatusNotFound)
+
+		} else {
+
+			// Only return the requested parts of the document
+			fields, exclude := getProjection(queryParams)
+
+			if len(fields) > 0 || len(exclude) > 0 {
+				document = utils.ProjectDocument(document, fields, exclude)
+			}
+
+			writeVersionHeaders(response, version, etag)
+			jsonserver.WriteResponse(response, &document, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("GET", "/{id}", readMiddleware, getDocumentAction)
+	jsonserver.RegisterRoute("GET", "/{collection}/{id}", readMiddleware, getDocumentAction)
+
+	// Check whether a document exists
+	documentExistsAction := func(request *http.Request, response http.ResponseWriter, body *[]byte, queryParams url.Values, routeParams jsonserver.RouteParams) {
+
+		collection := getRouteCollection(routeParams)
+		id := routeParams["id"]
+
+		if store.DocumentExists(collection, id) == false {
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document does not exist"}, http.StatusNotFound)
+
+		} else {
+
+			if version, etag, err := store.GetDocumentVersion(collection, id); err == nil {
+				writeVersionHeaders(response, version, etag)
+			}
+
+			jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "id": id, "message": "Document exists"}, http.StatusOK)
+
+		}
+
+	}
+
+	jsonserver.RegisterRoute("HEAD", "/{id}", readMiddleware, documentExistsAction)
+	jsonserver.RegisterRoute("HEAD", "/{collection}/{id}", readMiddleware, documentExistsAction)
+
+}
+
+// getRouteCollection gets the collection a request is about, which is the
+// default collection unless the route names one
+func getRouteCollection(routeParams jsonserver.RouteParams) string {
+
+	if collection, ok := routeParams["collection"]; ok {
+		return collection
+	}
+
+	return data.DefaultCollection
+
+}
+
+// writeMissingCollectionResponse responds to a request about a collection
+// that has never been written to
+func writeMissingCollectionResponse(response http.ResponseWriter, collection string) {
+
+	jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "collection": collection, "message": "Collection does not exist"}, http.StatusNotFound)
+
+}
+
+// GetFirstParamValue extracts the first value for a key from a route's URL parameters
+func GetFirstParamValue(params url.Values, key string, fallback string) string {
+
+	if _, ok := params[key]; ok {
+
+		values := params[key]
+
+		if len(values) >= 1 {
+			return values[0]
+		}
+
+	}
+
+	return fallback
+
+}
+
+// getProjection gets the dot-notation fields to include in and exclude from
+// returned documents, each of which can be given as a comma-separated list or
+// by repeating the parameter
+func getProjection(queryParams url.Values) ([]string, []string) {
+
+	lists := [][]string{{}, {}}
+
+	for i, key := range []string{"fields", "exclude"} {
+
+		for _, value := range queryParams[key] {
+
+			for _, field := range strings.Split(value, ",") {
+
+				if field = strings.TrimSpace(field); field != "" {
+					lists[i] = append(lists[i], field)
+				}
+
+			}
+
+		}
+
+	}
+
+	return lists[0], lists[1]
+
+}
+
+// projectHits replaces the document in each search hit with just the parts
+// selected by the fields and exclude URL parameters, if either is given
+func projectHits(hits []jsonserver.JSON, queryParams url.Values) {
+
+	fields, exclude := getProjection(queryParams)
+
+	if len(fields) == 0 && len(exclude) == 0 {
+		return
+	}
+
+	for _, hit := range hits {
+
+		if document, ok := hit["document"].(jsonserver.JSON); ok {
+			hit["document"] = jsonserver.JSON(utils.ProjectDocument(document, fields, exclude))
+		}
+
+	}
+
+}
+
+// isValidWaitFor checks whether a write can wait for a given stage (an empty
+// stage means the write does not wait at all)
+func isValidWaitFor(waitFor string) bool {
+
+	return waitFor == "" || utils.StringInSlice(waitFor, messaging.WriteStages)
+
+}
+
+// getWriteConditions gets the version a write expects a document to be at
+// from the if_version parameter, and the entity tags it expects the document
+// to have from the If-Match header
+func getWriteConditions(request *http.Request, queryParams url.Values) (int64, string, error) {
+
+	expectedVersion := int64(0)
+
+	if versionParam := GetFirstParamValue(queryParams, "if_version", ""); versionParam != "" {
+
+		version, err := strconv.ParseInt(versionParam, 10, 64)
+
+		if err != nil || version < 1 {
+			return 0, "", errors.New("The if_version parameter must be a positive integer")
+		}
+
+		expectedVersion = version
+
+	}
+
+	return expectedVersion, request.Header.Get("If-Match"), nil
+
+}
+
+// writeVersionHeaders adds the version and entity tag of a document to a
+// response
+func writeVersionHeaders(response http.ResponseWriter, version int64, etag string) {
+
+	if version > 0 {
+		response.Header().Set("X-Document-Version", strconv.FormatInt(version, 10))
+	}
+
+	if etag != "" {
+		response.Header().Set("ETag", etag)
+	}
+
+}
+
+// parseUserAccess gets the roles and permissions to grant a user from a user
+// management request body -- either is nil if it was not given
+func parseUserAccess(account map[string]interface{}) ([]string, []string, error) {
+
+	var roles []string
+	var permissions []string
+
+	for key, target := range map[string]*[]string{"roles": &roles, "permissions": &permissions} {
+
+		value, ok := account[key]
+
+		if ok == false {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+
+		if ok == false {
+			return nil, nil, errors.New("The " + key + " must be an array of strings")
+		}
+
+		*target = []string{}
+
+		for _, item := range values {
+
+			itemString, ok := item.(string)
+
+			if ok == false {
+				return nil, nil, errors.New("The " + key + " must be an array of strings")
+			}
+
+			*target = append(*target, itemString)
+
+		}
+
+	}
+
+	return roles, permissions, auth.ValidateAccess(roles, permissions)
+
+}
+
+// getTaskOptions gets the options for a task that changes the documents
+// matched by a query from a request's URL parameters -- the stage each change
+// is waited for (persisted unless stated otherwise), the most documents to
+// change (or 0 for no limit), whether to only count the documents that would
+// be changed and whether to wait for the task to complete before responding
+func getTaskOptions(queryParams url.Values) (string, int, bool, bool, error) {
+
+	waitFor := GetFirstParamValue(queryParams, "wait_for", "persisted")
+	maxDocs, maxDocsErr := strconv.Atoi(GetFirstParamValue(queryParams, "max_docs", "0"))
+	dryRun, dryRunErr := strconv.ParseBool(GetFirstParamValue(queryParams, "dry_run", "false"))
+	waitForCompletion, waitForCompletionErr := strconv.ParseBool(GetFirstParamValue(queryParams, "wait_for_completion", "true"))
+
+	if isValidWaitFor(waitFor) == false || waitFor == "" {
+		return "", 0, false, false, errors.New("The wait_for parameter must be one of indexed, persisted or replicated")
+	}
+
+	if maxDocsErr != nil || maxDocs < 0 {
+		return "", 0, false, false, errors.New("The max_docs parameter must be a whole number of at least 0")
+	}
+
+	if dryRunErr != nil || waitForCompletionErr != nil {
+		return "", 0, false, false, errors.New("The dry_run and wait_for_completion parameters must be true or false")
+	}
+
+	return waitFor, maxDocs, dryRun, waitForCompletion, nil
+
+}
+
+// taskSuccessKeys name the count of documents a task has changed successfully
+// for each kind of task
+var taskSuccessKeys = map[string]string{"delete_by_query": "deleted", "update_by_query": "updated"}
+
+// getTaskResponse describes the progress of a task
+func getTaskResponse(task types.Task) jsonserver.JSON {
+
+	failures := []jsonserver.JSON{}
+
+	for _, failure := range task.Failures {
+		failures = append(failures, jsonserver.JSON{"id": failure.ID, "errors": failure.Errors})
+	}
+
+	taskResponse := jsonserver.JSON{
+		"id":         task.ID,
+		"action":     task.Action,
+		"collection": task.Collection,
+		"status":     task.Status,
+		"dry_run":    task.DryRun,
+		"total":      task.Total,
+		"processed":  task.Processed,
+		"failed":     len(task.Failures),
+		"failures":   failures,
+		"started_at": task.StartedAt.UTC().Format(time.RFC3339Nano)}
+
+	taskResponse[taskSuccessKeys[task.Action]] = task.Succeeded
+
+	if task.Status == "completed" {
+		taskResponse["completed_at"] = task.CompletedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	return taskResponse
+
+}
+
+// getPercolatorQueryResponse describes a percolator query
+func getPercolatorQueryResponse(query types.PercolatorQuery) jsonserver.JSON {
+
+	queryResponse := jsonserver.JSON{"name": query.Name, "collection": query.Collection, "criteria": query.Criteria}
+
+	if query.Webhook != "" {
+		queryResponse["webhook"] = query.Webhook
+	}
+
+	return queryResponse
+
+}
+
+// How often a change feed sends a heartbeat when no changes are happening
+const changesHeartbeatInterval = 15 * time.Second
+
+// getChangesSince gets the sequence number a change feed should start after
+// from the since URL parameter or, when an event stream reconnects, its
+// Last-Event-ID header -- if neither is given, the feed starts from now
+func getChangesSince(request *http.Request, queryParams url.Values) (int64, error) {
+
+	since := GetFirstParamValue(queryParams, "since", request.Header.Get("Last-Event-ID"))
+
+	if since == "" || since == "now" {
+		return store.LatestChangeSequence(), nil
+	}
+
+	sequence, err := strconv.ParseInt(since, 10, 64)
+
+	if err != nil || sequence < 0 {
+		return 0, errors.New("The since parameter must be a sequence number from the change feed")
+	}
+
+	return sequence, nil
+
+}
+
+// getChangeResponse describes a change in a change feed, with only the
+// selected parts of any document
+func getChangeResponse(change types.Change, fields []string, exclude []string) jsonserver.JSON {
+
+	changeResponse := jsonserver.JSON{
+		"type":       "change",
+		"collection": change.Collection,
+		"action":     change.Action}
+
+	if change.Action != "truncate" {
+		changeResponse["id"] = change.ID
+		changeResponse["version"] = change.Version
+	}
+
+	var document jsonserver.JSON
+
+	if change.Document != nil && json.Unmarshal(change.Document, &document) == nil {
+
+		if len(fields) > 0 || len(exclude) > 0 {
+			document = utils.ProjectDocument(document, fields, exclude)
+		}
+
+		changeResponse["document"] = document
+
+	}
+
+	return changeResponse
+
+}
+
+// getChangesGoneResponse describes the changes a feed can no longer resume
+// from, telling the client to search for the documents it needs and then
+// follow the feed again from the sequence number given, which is taken
+// before the search so that nothing is missed in between
+func getChangesGoneResponse(err error) jsonserver.JSON {
+
+	resyncFrom := strconv.FormatInt(store.LatestChangeSequence(), 10)
+
+	return jsonserver.JSON{
+		"message":     err.Error() + "; search for the documents you need, then follow the feed again with since=" + resyncFrom,
+		"resync":      true,
+		"resync_from": resyncFrom,
+	}
+
+}
+
+// writeChangesEvent writes an event to a change feed, either as a line of JSON
+// or as a server-sent event identified by its sequence number -- sequence
+// numbers are too large for some JSON parsers to hold exactly, so they are
+// sent as strings
+func writeChangesEvent(response http.ResponseWriter, format string, sequence int64, event jsonserver.JSON) {
+
+	event["sequence"] = strconv.FormatInt(sequence, 10)
+	encodedEvent, _ := json.Marshal(event)
+
+	if format == "sse" {
+		response.Write([]byte("id: " + strconv.FormatInt(sequence, 10) + "\nevent: " + event["type"].(string) + "\ndata: " + string(encodedEvent) + "\n\n"))
+	} else {
+		response.Write(append(encodedEvent, '\n'))
+	}
+
+}
+
+// writeWaitedResponse responds to a write that waited for a stage, reporting
+// any failures that prevented it reaching that stage
+func writeWaitedResponse(response http.ResponseWriter, id string, waitFor string, result types.WriteResult, successMessage string) {
+
+	if result.Conflict {
+
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": result.Errors[0]}, http.StatusConflict)
+
+	} else if result.Rejected {
+
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": result.Errors[0]}, http.StatusBadRequest)
+
+	} else if messaging.ReachedWriteStage(result, waitFor) {
+
+		writeVersionHeaders(response, result.Version, result.ETag)
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"success": true, "id": id, "message": successMessage, "wait_for": waitFor, "version": result.Version}, http.StatusOK)
+
+	} else {
+
+		jsonserver.WriteResponse(response, &jsonserver.JSON{"success": false, "id": id, "message": "Document was not " + waitFor, "wait_for": waitFor, "errors": result.Errors}, http.StatusInternalServerError)
+
+	}
+
+}
+
+// getPatchType works out whether a patch is a JSON patch (json_patch) or a
+// JSON merge patch (merge_patch) from its content type, falling back to
+// treating arrays of operations as JSON patches
+func getPatchType(request *http.Request, body *[]byte) (string, error) {
+
+	var patch interface{}
+
+	err := json.Unmarshal(*body, &patch)
+
+	if err != nil {
+		return "", err
+	}
+
+	contentType := request.Header.Get("Content-Type")
+
+	if strings.HasPrefix(contentType, "application/json-patch+json") {
+		return "json_patch", nil
+	}
+
+	if strings.HasPrefix(contentType, "application/merge-patch+json") {
+		return "merge_patch", nil
+	}
+
+	if _, ok := patch.([]interface{}); ok {
+		return "json_patch", nil
+	}
+
+	return "merge_patch", nil
+
+}
+
+// bulkItemMessages describe the outcome of each successful bulk action
+var bulkItemMessages = map[string]string{"index": "Document has been stored", "update": "Document has been updated", "delete": "Document has been removed"}
+
+// parseBulkBody parses the newline-delimited JSON body of a bulk request into
+// its items -- each action is a line such as {"index": {"id": "123"}}, and
+// index and update actions are followed by a line holding the document or the
+// update to apply
+func parseBulkBody(body *[]byte) ([]types.BulkItem, error) {
+
+	lines := strings.Split(string((*body)[:]), "\n")
+	items := []types.BulkItem{}
+
+	for i := 0; i < len(lines); i++ {
+
+		line := strings.TrimSpace(lines[i])
+
+		if line == "" {
+			continue
+		}
+
+		lineNumber := strconv.Itoa(i + 1)
+
+		var actionLine map[string]map[string]interface{}
+
+		if err := json.Unmarshal([]byte(line), &actionLine); err != nil || len(actionLine) != 1 {
+			return nil, errors.New("Line " + lineNumber + " is not a valid bulk action")
+		}
+
+		item := types.BulkItem{}
+
+		for action, options := range actionLine {
+
+			item.Action = action
+			item.ID, _ = options["id"].(string)
+
+			if version, ok := options["if_version"].(float64); ok {
+				item.ExpectedVersion = int64(version)
+			}
+
+		}
+
+		if _, ok := bulkItemMessages[item.Action]; ok == false {
+			return nil, errors.New("Line " + lineNumber + " has an unknown action '" + item.Action + "'")
+		}
+
+		// Only new documents can be given a random ID
+		if item.ID == "" && item.Action != "index" {
+			return nil, errors.New("Line " + lineNumber + " must have a document ID")
+		}
+
+		if item.ID == "" {
+
+			item.ID, _ = crypt.GenerateUUID()
+
+			if item.ID == "" {
+				return nil, errors.New("An error occurred whilst generating a document ID")
+			}
+
+		}
+
+		// Index and update actions are followed by their document
+		if item.Action != "delete" {
+
+			i++
+
+			if i >= len(lines) || strings.TrimSpace(lines[i]) == "" {
+				return nil, errors.New("Line " + lineNumber + " must be followed by a document")
+			}
+
+			item.Document = []byte(strings.TrimSpace(lines[i]))
+
+		}
+
+		items = append(items, item)
+
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("Bulk request must contain at least one action")
+	}
+
+	return items, nil
+
+}
+
+// searchOptionKeys are the keys of a search request body that configure the
+// search rather than form part of its criteria
+var searchOptionKeys = []string{"sort", "aggregations", "highlight"}
+
+// parseSearchBody splits a search request body into its criteria and the
+// values of any of the given option keys, checking that the criteria can be
+// evaluated -- the error describes what is wrong with the body
+func parseSearchBody(body *[]byte, optionKeys []string) (map[string][]interface{}, map[string]interface{}, error) {
+
+	invalidJSONErr := errors.New("Search criteria is not valid JSON")
+
+	var searchBody map[string]interface{}
+
+	err := json.Unmarshal(*body, &searchBody)
+
+	if err != nil {
+		return nil, nil, invalidJSONErr
+	}
+
+	options := map[string]interface{}{}
+
+	for _, optionKey := range optionKeys {
+
+		if optionValue, ok := searchBody[optionKey]; ok {
+			options[optionKey] = optionValue
+			delete(searchBody, optionKey)
+		}
+
+	}
+
+	// Round-trip the remaining body so that the criteria are validated in the
+	// same way as before any options were introduced
+	remainingBody, err := json.Marshal(searchBody)
+
+	if err != nil {
+		return nil, nil, invalidJSONErr
+	}
+
+	var criteria map[string][]interface{}
+
+	err = json.Unmarshal(remainingBody, &criteria)
+
+	if err != nil {
+		return nil, nil, invalidJSONErr
+	}
+
+	if err = store.ValidateCriteria(criteria); err != nil {
+		return nil, nil, err
+	}
+
+	return criteria, options, nil
 
 }
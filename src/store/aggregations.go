@@ -0,0 +1,362 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+)
+
+// calendarIntervals are the intervals by which dates can be bucketed
+var calendarIntervals = []string{"minute", "hour", "day", "week", "month", "quarter", "year"}
+
+// aggregationBucketSort is a custom sorting algorithm for aggregation buckets
+// -- sort by document count (highest first), then key
+type aggregationBucketSort []map[string]interface{}
+
+func (buckets aggregationBucketSort) Len() int {
+
+	return len(buckets)
+
+}
+
+func (buckets aggregationBucketSort) Swap(i, j int) {
+
+	buckets[i], buckets[j] = buckets[j], buckets[i]
+
+}
+
+func (buckets aggregationBucketSort) Less(i, j int) bool {
+
+	if buckets[i]["doc_count"].(int) != buckets[j]["doc_count"].(int) {
+		return buckets[i]["doc_count"].(int) > buckets[j]["doc_count"].(int)
+	}
+
+	return compareSortValues(toSortValue(buckets[i]["key"]), toSortValue(buckets[j]["key"]), false) < 0
+
+}
+
+// ParseAggregations converts the aggregations clause of a search request into
+// a list of aggregations to compute, each of which is an object keyed by its
+// name and holding a single aggregation type
+func ParseAggregations(clause interface{}) ([]types.Aggregation, error) {
+
+	result := []types.Aggregation{}
+
+	if clause == nil {
+		return result, nil
+	}
+
+	namedAggregations, ok := clause.(map[string]interface{})
+
+	if ok == false {
+		return nil, errors.New("Aggregations must be an object")
+	}
+
+	for name, namedAggregation := range namedAggregations {
+
+		definition, ok := namedAggregation.(map[string]interface{})
+
+		if ok == false || len(definition) != 1 {
+			return nil, errors.New("Aggregation '" + name + "' must have exactly one type")
+		}
+
+		for aggregationType, aggregationOptions := range definition {
+
+			options, ok := aggregationOptions.(map[string]interface{})
+
+			if ok == false {
+				return nil, errors.New("Aggregation '" + name + "' must have options")
+			}
+
+			field, ok := options["field"].(string)
+
+			if ok == false || field == "" {
+				return nil, errors.New("Aggregation '" + name + "' must have a field name")
+			}
+
+			aggregation := types.Aggregation{Name: name, Type: aggregationType, Field: field}
+
+			switch aggregationType {
+
+			case "terms":
+
+				aggregation.Size = 10
+
+				if size, ok := options["size"].(float64); ok && size > 0 {
+					aggregation.Size = int(size)
+				}
+
+			case "histogram":
+
+				interval, ok := options["interval"].(float64)
+
+				if ok == false || interval <= 0 {
+					return nil, errors.New("Aggregation '" + name + "' must have a positive interval")
+				}
+
+				aggregation.Interval = interval
+
+			case "date_histogram":
+
+				interval, ok := options["interval"].(string)
+
+				if ok == false || utils.StringInSlice(interval, calendarIntervals) == false {
+					return nil, errors.New("Aggregation '" + name + "' must have an interval of minute, hour, day, week, month, quarter or year")
+				}
+
+				aggregation.CalendarInterval = interval
+
+			case "stats":
+
+			default:
+				return nil, errors.New("Aggregation '" + name + "' has an unknown type")
+
+			}
+
+			result = append(result, aggregation)
+
+		}
+
+	}
+
+	return result, nil
+
+}
+
+// Aggregate computes a set of aggregations over a slice of documents
+func Aggregate(targetedDocuments *[]jsonserver.JSON, aggregations []types.Aggregation) jsonserver.JSON {
+
+	result := jsonserver.JSON{}
+	flattenedDocuments := []map[string]interface{}{}
+
+	for _, document := range *targetedDocuments {
+
+		if parsedDocument, ok := document["document"].(jsonserver.JSON); ok {
+			flattenedDocuments = append(flattenedDocuments, utils.FlattenDocumentToDotNotation(parsedDocument))
+		}
+
+	}
+
+	for _, aggregation := range aggregations {
+
+		switch aggregation.Type {
+
+		case "terms":
+			result[aggregation.Name] = aggregateTerms(flattenedDocuments, aggregation)
+
+		case "histogram", "date_histogram":
+			result[aggregation.Name] = aggregateHistogram(flattenedDocuments, aggregation)
+
+		case "stats":
+			result[aggregation.Name] = aggregateStats(flattenedDocuments, aggregation)
+
+		}
+
+	}
+
+	return result
+
+}
+
+// Count the documents holding each distinct value of a field, returning the
+// most common values
+func aggregateTerms(flattenedDocuments []map[string]interface{}, aggregation types.Aggregation) jsonserver.JSON {
+
+	keys := map[string]interface{}{}
+	counts := map[string]int{}
+
+	for _, flattenedDocument := range flattenedDocuments {
+
+		// Each distinct value is only counted once per document
+		seenKeys := map[string]bool{}
+
+		for _, value := range utils.GetFlattenedFieldValues(flattenedDocument, aggregation.Field) {
+
+			if value == nil {
+				continue
+			}
+
+			encodedKey, err := json.Marshal(value)
+
+			if err != nil || seenKeys[string(encodedKey)] {
+				continue
+			}
+
+			seenKeys[string(encodedKey)] = true
+			keys[string(encodedKey)] = value
+			counts[string(encodedKey)]++
+
+		}
+
+	}
+
+	buckets := []map[string]interface{}{}
+
+	for encodedKey, key := range keys {
+		buckets = append(buckets, map[string]interface{}{"key": key, "doc_count": counts[encodedKey]})
+	}
+
+	sort.Sort(aggregationBucketSort(buckets))
+
+	// Anything that doesn't fit in the requested number of buckets is counted
+	// separately
+	otherDocumentCount := 0
+
+	if len(buckets) > aggregation.Size {
+
+		for _, bucket := range buckets[aggregation.Size:] {
+			otherDocumentCount += bucket["doc_count"].(int)
+		}
+
+		buckets = buckets[:aggregation.Size]
+
+	}
+
+	return jsonserver.JSON{"buckets": buckets, "sum_other_doc_count": otherDocumentCount}
+
+}
+
+// Count the documents whose values for a field fall into each interval, in
+// order of the intervals -- intervals with no documents are omitted
+func aggregateHistogram(flattenedDocuments []map[string]interface{}, aggregation types.Aggregation) jsonserver.JSON {
+
+	keys := map[float64]interface{}{}
+	counts := map[float64]int{}
+
+	for _, flattenedDocument := range flattenedDocuments {
+
+		// Each interval is only counted once per document
+		seenKeys := map[float64]bool{}
+
+		for _, value := range utils.GetFlattenedFieldValues(flattenedDocument, aggregation.Field) {
+
+			orderableKey, key, ok := getHistogramKey(value, aggregation)
+
+			if ok == false || seenKeys[orderableKey] {
+				continue
+			}
+
+			seenKeys[orderableKey] = true
+			keys[orderableKey] = key
+			counts[orderableKey]++
+
+		}
+
+	}
+
+	orderableKeys := []float64{}
+
+	for orderableKey := range keys {
+		orderableKeys = append(orderableKeys, orderableKey)
+	}
+
+	sort.Float64s(orderableKeys)
+
+	buckets := []map[string]interface{}{}
+
+	for _, orderableKey := range orderableKeys {
+		buckets = append(buckets, map[string]interface{}{"key": keys[orderableKey], "doc_count": counts[orderableKey]})
+	}
+
+	return jsonserver.JSON{"buckets": buckets}
+
+}
+
+// Get the key of the histogram interval a value falls into, both as a number
+// by which intervals can be ordered and as it should be displayed
+func getHistogramKey(value interface{}, aggregation types.Aggregation) (float64, interface{}, bool) {
+
+	if aggregation.Type == "histogram" {
+
+		number, ok := value.(float64)
+
+		if ok == false {
+			return 0, nil, false
+		}
+
+		key := math.Floor(number/aggregation.Interval) * aggregation.Interval
+
+		return key, key, true
+
+	}
+
+	dateString, ok := value.(string)
+
+	if ok == false {
+		return 0, nil, false
+	}
+
+	date, ok := parseDate(dateString)
+
+	if ok == false {
+		return 0, nil, false
+	}
+
+	date = date.UTC()
+
+	switch aggregation.CalendarInterval {
+
+	case "minute":
+		date = date.Truncate(time.Minute)
+
+	case "hour":
+		date = date.Truncate(time.Hour)
+
+	case "day":
+		date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+
+	case "week":
+		date = time.Date(date.Year(), date.Month(), date.Day()-((int(date.Weekday())+6)%7), 0, 0, 0, 0, time.UTC)
+
+	case "month":
+		date = time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	case "quarter":
+		date = time.Date(date.Year(), (((date.Month()-1)/3)*3)+1, 1, 0, 0, 0, 0, time.UTC)
+
+	case "year":
+		date = time.Date(date.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	}
+
+	return float64(date.Unix()), date.Format(time.RFC3339), true
+
+}
+
+// Compute the count, minimum, maximum, average and sum of a numeric field's
+// values
+func aggregateStats(flattenedDocuments []map[string]interface{}, aggregation types.Aggregation) jsonserver.JSON {
+
+	count := 0
+	sum := 0.0
+	min := math.Inf(1)
+	max := math.Inf(-1)
+
+	for _, flattenedDocument := range flattenedDocuments {
+
+		for _, value := range utils.GetFlattenedFieldValues(flattenedDocument, aggregation.Field) {
+
+			if number, ok := value.(float64); ok {
+				count++
+				sum += number
+				min = math.Min(min, number)
+				max = math.Max(max, number)
+			}
+
+		}
+
+	}
+
+	if count == 0 {
+		return jsonserver.JSON{"count": 0, "min": nil, "max": nil, "avg": nil, "sum": 0}
+	}
+
+	return jsonserver.JSON{"count": count, "min": min, "max": max, "avg": sum / float64(count), "sum": sum}
+
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/wal"
+)
+
+// The most recent changes a node keeps for change feeds to resume from
+const maxRetainedChanges = 10000
+
+// Changes applied to this node's collections since it became active, oldest
+// first -- each has a sequence number issued by this node when it was
+// applied, so they are in order even when they were made on other nodes
+var changes = []types.Change{}
+
+// Whether changes are being recorded yet
+var recordingChanges = false
+
+// Sequence number below which changes are no longer retained, so feeds cannot
+// resume from before it
+var changesRetainedFrom int64
+
+// changesNotifier is closed (and replaced) whenever a change is recorded, to
+// wake up the feeds waiting for one
+var changesNotifier = make(chan struct{})
+
+// changesLock allows locking of the changes, their retention sequence and
+// notifier during reads/writes
+var changesLock = sync.RWMutex{}
+
+// StartRecordingChanges marks the point from which changes are recorded, which
+// is the earliest point that feeds can resume from
+func StartRecordingChanges() {
+
+	changesLock.Lock()
+	defer changesLock.Unlock()
+
+	recordingChanges = true
+	changesRetainedFrom = wal.NextSequence()
+
+}
+
+// Record a change that has just been applied to a collection, along with the
+// document as it was beforehand, forgetting the oldest changes if too many
+// are being kept -- changes replayed while the node is starting up are not
+// recorded, as nothing can be following them yet
+func recordChange(collectionName string, entry types.JournalEntry, previousDocument []byte) {
+
+	change := types.Change{Collection: collectionName, Action: entry.Action, ID: entry.ID, Version: entry.Version, PreviousDocument: previousDocument}
+
+	if entry.Action == "add" {
+		change.Document = []byte(entry.Document)
+	}
+
+	changesLock.Lock()
+	defer changesLock.Unlock()
+
+	if recordingChanges == false {
+		return
+	}
+
+	change.Sequence = wal.NextSequence()
+	changes = append(changes, change)
+
+	if len(changes) > maxRetainedChanges {
+		changesRetainedFrom = changes[0].Sequence
+		changes = changes[1:]
+	}
+
+	close(changesNotifier)
+	changesNotifier = make(chan struct{})
+
+}
+
+// LatestChangeSequence gets the sequence number that a feed following only
+// changes from now on should start after
+func LatestChangeSequence() int64 {
+
+	changesLock.RLock()
+	defer changesLock.RUnlock()
+
+	if len(changes) == 0 {
+		return changesRetainedFrom
+	}
+
+	return changes[len(changes)-1].Sequence
+
+}
+
+// ChangesSince gets the changes recorded after a sequence number, along with
+// the sequence number of the latest of them (or the given one, if there are
+// none) and a channel that is closed when the next change is recorded -- an
+// error means that some of the changes after the sequence number are no
+// longer retained
+func ChangesSince(since int64) ([]types.Change, int64, <-chan struct{}, error) {
+
+	changesLock.RLock()
+	defer changesLock.RUnlock()
+
+	if since < changesRetainedFrom {
+		return nil, since, changesNotifier, errors.New("Changes since " + strconv.FormatInt(since, 10) + " are no longer available")
+	}
+
+	start := sort.Search(len(changes), func(i int) bool {
+		return changes[i].Sequence > since
+	})
+
+	result := append([]types.Change{}, changes[start:]...)
+
+	if len(result) > 0 {
+		since = result[len(result)-1].Sequence
+	}
+
+	return result, since, changesNotifier, nil
+
+}
+
+// ChangeMatchesCriteria checks whether a change should be included in a feed
+// following a collection and a set of JSON criteria -- a change matches if
+// the document matched before or after it, and truncations always match
+func ChangeMatchesCriteria(change types.Change, collectionName string, criteria map[string][]interface{}) bool {
+
+	if change.Collection != collectionName {
+		return false
+	}
+
+	if len(criteria) == 0 || change.Action == "truncate" {
+		return true
+	}
+
+	for _, document := range [][]byte{change.PreviousDocument, change.Document} {
+
+		if document != nil && DocumentMatchesCriteria(change.Collection, change.ID, document, criteria) {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+// DocumentMatchesCriteria checks whether a document would be matched by a set
+// of JSON criteria if it were in a collection
+func DocumentMatchesCriteria(collectionName string, id string, document []byte, criteria map[string][]interface{}) bool {
+
+	if len(criteria) == 0 {
+		return true
+	}
+
+	scratchCollection, ok := newScratchCollection(collectionName, id, document)
+
+	return ok && scratchCollection.matchesCriteria(id, criteria)
+
+}
+
+// Index a document on its own in a collection with the same mapping as
+// another, so that criteria can be checked against it without touching the
+// other collection's index
+func newScratchCollection(collectionName string, id string, document []byte) (*collection, bool) {
+
+	scratchCollection := newCollection()
+	scratchCollection.mapping = GetMapping(collectionName)
+
+	if scratchCollection.indexDocument(id, document, 1, 1) == false {
+		return nil, false
+	}
+
+	return scratchCollection, true
+
+}
+
+// Check whether a document in a collection is matched by a set of JSON
+// criteria (which always match if there are none)
+func (collection *collection) matchesCriteria(id string, criteria map[string][]interface{}) bool {
+
+	if len(criteria) == 0 {
+		return true
+	}
+
+	for _, matchedID := range collection.searchDocumentIds(criteria) {
+
+		if matchedID == id {
+			return true
+		}
+
+	}
+
+	return false
+
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// collection holds the documents of a single named collection along with its
+// own search indices and change history, so that collections can share a node
+// without their IDs or searches colliding
+type collection struct {
+
+	// Documents are stored in a map, for quick retrieval
+	documents map[string]types.DocumentIndex
+
+	// Lookups map a field's value against its document
+	lookups map[string][]string
+
+	// Ranges map a field (prefixed by its value kind) to a skip list of its
+	// values, kept in ascending order so that ranges can be found without
+	// scanning every value
+	ranges map[string]*skipList
+
+	// Dictionaries map a field to a skip list of the terms found in it (and,
+	// for keyword fields, its whole values), kept in alphabetical order so that
+	// terms can be found by prefix or pattern
+	dictionary map[string]*skipList
+
+	// Dictionary keys map the lookup key of each term in the dictionaries to
+	// the field and term it belongs to
+	dictionaryKeys map[string]dictionaryKey
+
+	// Field length totals map a field to the total length of its values
+	fieldLengthTotals map[string]fieldLengthTotal
+
+	// List of all document IDs
+	allIds map[string]string
+
+	// Tombstones map the IDs of removed documents to their removal, so that
+	// older changes replayed afterwards cannot resurrect them and so that the
+	// document's version keeps counting up if it is stored again
+	tombstones map[string]tombstone
+
+	// Sequence number of the latest truncation -- any change before it is void
+	truncatedAt int64
+
+	// Mapping of fields to the types they are indexed and searched as
+	mapping types.Mapping
+
+	// Sequence number of the change that set the mapping
+	mappingSequence int64
+
+	// journalLock allows locking of the tombstones and truncation sequence,
+	// and ensures that journal entries are applied one at a time
+	journalLock sync.Mutex
+
+	// documentsLock allows locking of the documents map during reads/writes
+	documentsLock sync.RWMutex
+
+	// lookupsLock allows locking of the lookups map during reads/writes
+	lookupsLock sync.RWMutex
+
+	// rangesLock allows locking of the ranges map during reads/writes
+	rangesLock sync.RWMutex
+
+	// dictionaryLock allows locking of the dictionary and dictionaryKeys maps
+	// during reads/writes
+	dictionaryLock sync.RWMutex
+
+	// fieldLengthTotalsLock allows locking of the fieldLengthTotals map
+	// during reads/writes
+	fieldLengthTotalsLock sync.RWMutex
+
+	// allIdsLock allows locking of the allIds map during reads/writes
+	allIdsLock sync.RWMutex
+
+	// mappingLock allows locking of the mapping during reads/writes
+	mappingLock sync.RWMutex
+}
+
+// Collections are stored in a map by their names
+var collections = map[string]*collection{}
+
+// collectionsLock allows locking of the collections map during reads/writes
+var collectionsLock = sync.RWMutex{}
+
+// Collection names are made up of lowercase letters, digits, hyphens and
+// underscores, and cannot start with a hyphen or underscore so that they
+// never clash with the names of endpoints
+var collectionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// newCollection creates an empty collection
+func newCollection() *collection {
+
+	return &collection{
+		documents:         map[string]types.DocumentIndex{},
+		lookups:           map[string][]string{},
+		ranges:            map[string]*skipList{},
+		dictionary:        map[string]*skipList{},
+		dictionaryKeys:    map[string]dictionaryKey{},
+		fieldLengthTotals: map[string]fieldLengthTotal{},
+		allIds:            map[string]string{},
+		tombstones:        map[string]tombstone{}}
+
+}
+
+// ValidateCollectionName checks that a collection name is allowed
+func ValidateCollectionName(name string) error {
+
+	if collectionNamePattern.MatchString(name) == false {
+		return errors.New("Collection names must be up to 64 lowercase letters, digits, hyphens and underscores, and cannot start with a hyphen or underscore")
+	}
+
+	return nil
+
+}
+
+// getCollection gets a collection by its name, creating it if it does not
+// exist yet
+func getCollection(name string) *collection {
+
+	collectionsLock.Lock()
+	defer collectionsLock.Unlock()
+
+	if existingCollection, ok := collections[name]; ok {
+		return existingCollection
+	}
+
+	collections[name] = newCollection()
+
+	return collections[name]
+
+}
+
+// lookupCollection gets a collection by its name for reading -- a collection
+// that does not exist is treated as an empty one, without creating it
+func lookupCollection(name string) *collection {
+
+	collectionsLock.RLock()
+	defer collectionsLock.RUnlock()
+
+	if existingCollection, ok := collections[name]; ok {
+		return existingCollection
+	}
+
+	return newCollection()
+
+}
+
+// CollectionExists checks whether a collection has been written to
+func CollectionExists(name string) bool {
+
+	collectionsLock.RLock()
+	defer collectionsLock.RUnlock()
+
+	_, ok := collections[name]
+
+	return ok
+
+}
+
+// GetCollectionNames gets the names of all collections, in alphabetical order
+func GetCollectionNames() []string {
+
+	collectionsLock.RLock()
+
+	names := []string{}
+
+	for name := range collections {
+		names = append(names, name)
+	}
+
+	collectionsLock.RUnlock()
+
+	sort.Strings(names)
+
+	return names
+
+}
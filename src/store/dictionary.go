@@ -0,0 +1,220 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+)
+
+// dictionaryTerm pairs a term found in a field with the key of its lookup
+type dictionaryTerm struct {
+	Term    string
+	KeyHash string
+}
+
+// dictionaryKey records which field and term a lookup key belongs to, so
+// that the term can be taken out of the dictionary when the lookup empties
+type dictionaryKey struct {
+	Field string
+	Term  string
+}
+
+// Check whether a dictionary term comes before another, ordering terms
+// alphabetically and then by their lookup keys
+func dictionaryTermLess(a interface{}, b interface{}) bool {
+
+	termA, termB := a.(dictionaryTerm), b.(dictionaryTerm)
+
+	return termA.Term < termB.Term || (termA.Term == termB.Term && termA.KeyHash < termB.KeyHash)
+
+}
+
+// Find the node of the first term in a field's dictionary that starts with a
+// prefix, if there is one -- the terms starting with the prefix follow it in
+// order
+func seekDictionary(entries *skipList, prefix string) *skipListNode {
+
+	node := entries.seek(func(item interface{}) bool {
+		return item.(dictionaryTerm).Term >= prefix
+	})
+
+	if node == nil || strings.HasPrefix(node.item.(dictionaryTerm).Term, prefix) == false {
+		return nil
+	}
+
+	return node
+
+}
+
+// Add a term to a field's dictionary, in alphabetical order, unless its
+// lookup is already there
+func (collection *collection) storeDictionaryTerm(field string, term string, keyHash string) {
+
+	collection.dictionaryLock.Lock()
+	defer collection.dictionaryLock.Unlock()
+
+	if _, ok := collection.dictionaryKeys[keyHash]; ok {
+		return
+	}
+
+	entries, ok := collection.dictionary[field]
+
+	if ok == false {
+		entries = newSkipList(dictionaryTermLess)
+		collection.dictionary[field] = entries
+	}
+
+	entries.insert(dictionaryTerm{Term: term, KeyHash: keyHash})
+	collection.dictionaryKeys[keyHash] = dictionaryKey{Field: field, Term: term}
+
+}
+
+// Take a term out of its field's dictionary once nothing holds it any more
+func (collection *collection) removeDictionaryTerm(keyHash string) {
+
+	collection.dictionaryLock.Lock()
+	defer collection.dictionaryLock.Unlock()
+
+	key, ok := collection.dictionaryKeys[keyHash]
+
+	if ok == false {
+		return
+	}
+
+	delete(collection.dictionaryKeys, keyHash)
+
+	entries, ok := collection.dictionary[key.Field]
+
+	if ok && entries.remove(dictionaryTerm{Term: key.Term, KeyHash: keyHash}) {
+
+		// Also remove the whole dictionary if it's now empty
+		if entries.length == 0 {
+			delete(collection.dictionary, key.Field)
+		}
+
+	}
+
+}
+
+// isPatternSearchType checks whether a criterion type is evaluated against
+// the term dictionaries
+func isPatternSearchType(searchType string) bool {
+
+	switch searchType {
+
+	case "prefix", "wildcard", "regexp":
+		return true
+
+	}
+
+	return false
+
+}
+
+// compilePattern converts the value of a wildcard or regexp criterion into a
+// regular expression that has to match terms in full -- in wildcards, * stands
+// for any number of characters and ? for a single character
+func compilePattern(searchType string, pattern string) (*regexp.Regexp, error) {
+
+	if searchType == "wildcard" {
+
+		expression := ""
+
+		for _, character := range pattern {
+
+			switch character {
+
+			case '*':
+				expression += ".*"
+
+			case '?':
+				expression += "."
+
+			default:
+				expression += regexp.QuoteMeta(string(character))
+
+			}
+
+		}
+
+		pattern = expression
+
+	}
+
+	return regexp.Compile("^(?:" + pattern + ")$")
+
+}
+
+// Search for document IDs with a term in a field's dictionary that starts
+// with a prefix or matches a wildcard or regular expression pattern
+func (collection *collection) searchPattern(searchType string, field string, value interface{}) []string {
+
+	result := []string{}
+	pattern, ok := value.(string)
+
+	if ok == false {
+		return result
+	}
+
+	// Keywords are kept lowercased and other terms in the form the field's
+	// analyzer gave them, so patterns are lowercased unless the analyzer
+	// keeps case
+	if collection.getFieldType(field) == "keyword" || collection.getFieldAnalyzer(field).Lowercase {
+		pattern = strings.ToLower(pattern)
+	}
+
+	prefix := pattern
+	var expression *regexp.Regexp
+
+	if searchType != "prefix" {
+
+		compiledPattern, err := compilePattern(searchType, pattern)
+
+		if err != nil {
+			return result
+		}
+
+		// Only the terms starting with the pattern's literal prefix (if it
+		// has one) need to be checked
+		expression = compiledPattern
+		prefix, _ = expression.LiteralPrefix()
+
+	}
+
+	collection.dictionaryLock.RLock()
+
+	keyHashes := []string{}
+	for node := seekDictionary(collection.dictionary[field], prefix); node != nil && strings.HasPrefix(node.item.(dictionaryTerm).Term, prefix); node = node.next[0] {
+
+		entry := node.item.(dictionaryTerm)
+
+		if expression == nil || expression.MatchString(entry.Term) {
+			keyHashes = append(keyHashes, entry.KeyHash)
+		}
+
+	}
+
+	collection.dictionaryLock.RUnlock()
+
+	// Gather up the documents holding any of the matching terms
+	collection.lookupsLock.RLock()
+
+	seenIds := map[string]bool{}
+
+	for _, keyHash := range keyHashes {
+
+		for _, id := range collection.lookups[keyHash] {
+
+			if seenIds[id] == false {
+				seenIds[id] = true
+				result = append(result, id)
+			}
+
+		}
+
+	}
+
+	collection.lookupsLock.RUnlock()
+
+	return result
+
+}
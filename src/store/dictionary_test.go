@@ -0,0 +1,63 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Get the terms in a field's dictionary starting with a prefix, in order
+func prefixedTestTerms(collection *collection, field string, prefix string) []string {
+
+	terms := []string{}
+
+	for node := seekDictionary(collection.dictionary[field], prefix); node != nil && strings.HasPrefix(node.item.(dictionaryTerm).Term, prefix); node = node.next[0] {
+		terms = append(terms, node.item.(dictionaryTerm).Term)
+	}
+
+	return terms
+
+}
+
+func TestDictionaryKeepsTermsInOrder(t *testing.T) {
+
+	collection := newCollection()
+
+	// Enough terms that inserting each into a sorted slice would be slow
+	for i := 199999; i >= 0; i-- {
+		term := "term" + strconv.Itoa(i)
+		collection.storeDictionaryTerm("body", term, "key:"+term)
+	}
+
+	// Storing a lookup again leaves the dictionary alone
+	collection.storeDictionaryTerm("body", "term5", "key:term5")
+
+	for i := 0; i < 200000; i += 2 {
+		collection.removeDictionaryTerm("key:term" + strconv.Itoa(i))
+	}
+
+	// Only the odd terms are left (12341 to 12349 and 123401 to 123499), in
+	// alphabetical rather than numerical order
+	terms := prefixedTestTerms(collection, "body", "term1234")
+
+	if len(terms) != 55 || terms[0] != "term123401" || terms[5] != "term12341" || terms[len(terms)-1] != "term123499" {
+		t.Fatalf("Expected the 55 odd terms starting with 'term1234', got %v", terms)
+	}
+
+	for i := 0; i < len(terms)-1; i++ {
+
+		if terms[i] >= terms[i+1] {
+			t.Fatalf("Expected the terms to be in order, got %v", terms)
+		}
+
+	}
+
+	for i := 1; i < 200000; i += 2 {
+		collection.removeDictionaryTerm("key:term" + strconv.Itoa(i))
+	}
+
+	if _, ok := collection.dictionary["body"]; ok {
+		t.Fatal("Expected the empty dictionary to have been removed")
+	}
+
+}
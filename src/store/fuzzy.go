@@ -0,0 +1,353 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/D-L-M/mem-db/src/analysis"
+	"github.com/D-L-M/mem-db/src/utils"
+)
+
+// The largest edit distance that fuzzy criteria can allow
+const maxFuzziness = 2
+
+// fuzzyOptions hold how closely the terms of a fuzzy criterion have to be
+// matched -- a fuzziness of -1 means it depends on the length of each term
+type fuzzyOptions struct {
+	Value        string
+	Fuzziness    int
+	PrefixLength int
+}
+
+// parseFuzzyCriterion gets the value a fuzzy criterion searches for and how
+// closely it has to be matched -- either just the value can be given, or an
+// object holding the value along with its fuzziness (a number of edits from 0
+// to 2, or "auto") and the number of leading characters that must match
+// exactly (its prefix length)
+func parseFuzzyCriterion(value interface{}) (fuzzyOptions, error) {
+
+	if valueString, ok := value.(string); ok {
+		return fuzzyOptions{Value: valueString, Fuzziness: -1}, nil
+	}
+
+	options, ok := value.(map[string]interface{})
+
+	if ok == false {
+		return fuzzyOptions{}, errors.New("The fuzzy value must be a string or an object")
+	}
+
+	parsedOptions := fuzzyOptions{Fuzziness: -1}
+	parsedOptions.Value, ok = options["value"].(string)
+
+	if ok == false {
+		return fuzzyOptions{}, errors.New("The fuzzy value must be a string")
+	}
+
+	if fuzziness, ok := options["fuzziness"]; ok && fuzziness != "auto" {
+
+		fuzzinessFloat, ok := fuzziness.(float64)
+
+		if ok == false || fuzzinessFloat < 0 || fuzzinessFloat > maxFuzziness || fuzzinessFloat != float64(int(fuzzinessFloat)) {
+			return fuzzyOptions{}, errors.New("The fuzziness must be auto or a whole number from 0 to 2")
+		}
+
+		parsedOptions.Fuzziness = int(fuzzinessFloat)
+
+	}
+
+	if prefixLength, ok := options["prefix_length"]; ok {
+
+		prefixLengthFloat, ok := prefixLength.(float64)
+
+		if ok == false || prefixLengthFloat < 0 || prefixLengthFloat != float64(int(prefixLengthFloat)) {
+			return fuzzyOptions{}, errors.New("The prefix length must be a whole number of at least 0")
+		}
+
+		parsedOptions.PrefixLength = int(prefixLengthFloat)
+
+	}
+
+	return parsedOptions, nil
+
+}
+
+// getFuzziness gets the number of edits a term can be matched within -- when
+// it depends on the term's length, short terms have to match exactly and
+// long terms can have up to two edits
+func getFuzziness(fuzziness int, term string) int {
+
+	if fuzziness >= 0 {
+		return fuzziness
+	}
+
+	length := utf8.RuneCountInString(term)
+
+	if length <= 2 {
+		return 0
+	} else if length <= 5 {
+		return 1
+	}
+
+	return maxFuzziness
+
+}
+
+// levenshteinDistance counts the insertions, deletions and substitutions of
+// characters it takes to turn one string into another, giving up (and
+// returning more than the limit) as soon as it is known to exceed a limit
+func levenshteinDistance(first string, second string, limit int) int {
+
+	firstRunes := []rune(first)
+	secondRunes := []rune(second)
+
+	if len(firstRunes)-len(secondRunes) > limit || len(secondRunes)-len(firstRunes) > limit {
+		return limit + 1
+	}
+
+	previousRow := make([]int, len(secondRunes)+1)
+	currentRow := make([]int, len(secondRunes)+1)
+
+	for j := range previousRow {
+		previousRow[j] = j
+	}
+
+	for i := 1; i <= len(firstRunes); i++ {
+
+		currentRow[0] = i
+		rowMinimum := i
+
+		for j := 1; j <= len(secondRunes); j++ {
+
+			substitutionCost := 1
+
+			if firstRunes[i-1] == secondRunes[j-1] {
+				substitutionCost = 0
+			}
+
+			currentRow[j] = previousRow[j-1] + substitutionCost
+
+			if previousRow[j]+1 < currentRow[j] {
+				currentRow[j] = previousRow[j] + 1
+			}
+
+			if currentRow[j-1]+1 < currentRow[j] {
+				currentRow[j] = currentRow[j-1] + 1
+			}
+
+			if currentRow[j] < rowMinimum {
+				rowMinimum = currentRow[j]
+			}
+
+		}
+
+		// No later row can come in under the limit if this one doesn't
+		if rowMinimum > limit {
+			return limit + 1
+		}
+
+		previousRow, currentRow = currentRow, previousRow
+
+	}
+
+	return previousRow[len(secondRunes)]
+
+}
+
+// Get the terms a fuzzy criterion searches a field for, in the form they are
+// indexed in -- keywords are matched as whole values and text is broken into
+// terms by the field's analyzer
+func (collection *collection) getFuzzyQueryTerms(field string, value string) []string {
+
+	if collection.getFieldType(field) == "keyword" {
+		return []string{strings.ToLower(value)}
+	}
+
+	_, terms := analysis.GetTerms(collection.getFieldAnalyzer(field), value)
+
+	return terms
+
+}
+
+// Find the terms in a field's dictionary within the allowed number of edits
+// of a term being searched for
+func (collection *collection) findFuzzyTerms(field string, term string, options fuzzyOptions) []dictionaryTerm {
+
+	result := []dictionaryTerm{}
+	fuzziness := getFuzziness(options.Fuzziness, term)
+	prefix := term
+
+	if options.PrefixLength < utf8.RuneCountInString(term) {
+		prefix = string([]rune(term)[:options.PrefixLength])
+	}
+
+	collection.dictionaryLock.RLock()
+	defer collection.dictionaryLock.RUnlock()
+
+	for node := seekDictionary(collection.dictionary[field], prefix); node != nil && strings.HasPrefix(node.item.(dictionaryTerm).Term, prefix); node = node.next[0] {
+
+		entry := node.item.(dictionaryTerm)
+
+		if levenshteinDistance(term, entry.Term, fuzziness) <= fuzziness {
+			result = append(result, entry)
+		}
+
+	}
+
+	return result
+
+}
+
+// Search for document IDs with a field holding terms close to every term of a
+// fuzzy criterion's value
+func (collection *collection) searchFuzzy(field string, value interface{}) []string {
+
+	result := []string{}
+	options, err := parseFuzzyCriterion(value)
+
+	if err != nil {
+		return result
+	}
+
+	queryTerms := collection.getFuzzyQueryTerms(field, options.Value)
+
+	if len(queryTerms) == 0 {
+		return result
+	}
+
+	termIds := [][]string{}
+
+	for _, queryTerm := range queryTerms {
+
+		collection.lookupsLock.RLock()
+
+		// Gather up the documents holding any term close to this one
+		seenIds := map[string]bool{}
+		ids := []string{}
+
+		for _, fuzzyTerm := range collection.findFuzzyTerms(field, queryTerm, options) {
+
+			for _, id := range collection.lookups[fuzzyTerm.KeyHash] {
+
+				if seenIds[id] == false {
+					seenIds[id] = true
+					ids = append(ids, id)
+				}
+
+			}
+
+		}
+
+		collection.lookupsLock.RUnlock()
+
+		termIds = append(termIds, ids)
+
+	}
+
+	return utils.StringSliceIntersection(termIds)
+
+}
+
+// matchedTerm is a term from a field's dictionary that a fuzzy criterion
+// matched, so that it can be reported in the hits holding it
+type matchedTerm struct {
+	Field   string
+	Term    string
+	KeyHash string
+}
+
+// Collect the terms matched by all fuzzy criteria in a set of criteria,
+// however deeply they are nested
+func (collection *collection) getFuzzyMatchedTerms(criteria map[string][]interface{}) []matchedTerm {
+
+	result := []matchedTerm{}
+
+	for _, groupCriteria := range criteria {
+
+		for _, criterion := range groupCriteria {
+
+			remappedCriterion, ok := criterion.(map[string]interface{})
+
+			if ok == false {
+				continue
+			}
+
+			for criterionType, criterionValue := range remappedCriterion {
+
+				// Nested AND/OR criteria
+				if strings.ToLower(criterionType) == "and" || strings.ToLower(criterionType) == "or" {
+
+					if nestedCriteria, ok := criterionValue.([]interface{}); ok {
+						result = append(result, collection.getFuzzyMatchedTerms(map[string][]interface{}{criterionType: nestedCriteria})...)
+					}
+
+					continue
+
+				}
+
+				if criterionType != "fuzzy" {
+					continue
+				}
+
+				if fieldValues, ok := criterionValue.(map[string]interface{}); ok {
+
+					for field, value := range fieldValues {
+
+						options, err := parseFuzzyCriterion(value)
+
+						if err != nil {
+							continue
+						}
+
+						for _, queryTerm := range collection.getFuzzyQueryTerms(field, options.Value) {
+
+							for _, fuzzyTerm := range collection.findFuzzyTerms(field, queryTerm, options) {
+								result = append(result, matchedTerm{Field: field, Term: fuzzyTerm.Term, KeyHash: fuzzyTerm.KeyHash})
+							}
+
+						}
+
+					}
+
+				}
+
+			}
+
+		}
+
+	}
+
+	return result
+
+}
+
+// Get the matched terms that a document holds, grouped by field
+func (collection *collection) getDocumentMatchedTerms(id string, terms []matchedTerm) map[string][]string {
+
+	result := map[string][]string{}
+
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
+
+	fields := collection.documents[id].Fields
+
+	for _, term := range terms {
+
+		if utils.StringInSlice(term.KeyHash, fields[term.Field].InvertedKeys) == false {
+			continue
+		}
+
+		if utils.StringInSlice(term.Term, result[term.Field]) == false {
+			result[term.Field] = append(result[term.Field], term.Term)
+		}
+
+	}
+
+	for field := range result {
+		sort.Strings(result[field])
+	}
+
+	return result
+
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/analysis"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// highlightToken is a token of a field value, located by its byte offsets in
+// the value, that is marked up if it matched
+type highlightToken struct {
+	Start   int
+	End     int
+	Matched bool
+}
+
+// ParseHighlight converts the highlight clause of a search request into the
+// settings snippets are built with, returning nil if no highlighting was
+// asked for
+func ParseHighlight(clause interface{}) (*types.Highlight, error) {
+
+	if clause == nil {
+		return nil, nil
+	}
+
+	options, ok := clause.(map[string]interface{})
+
+	if ok == false {
+		return nil, errors.New("Highlight options must be an object")
+	}
+
+	highlight := types.Highlight{Fields: []string{}, PreTag: "<em>", PostTag: "</em>", FragmentSize: 100, NumberOfFragments: 5}
+
+	if fields, ok := options["fields"]; ok {
+
+		fieldList, ok := fields.([]interface{})
+
+		if ok == false {
+			return nil, errors.New("Highlight fields must be an array of field names")
+		}
+
+		for _, field := range fieldList {
+
+			fieldString, ok := field.(string)
+
+			if ok == false || fieldString == "" {
+				return nil, errors.New("Highlight fields must be an array of field names")
+			}
+
+			highlight.Fields = append(highlight.Fields, fieldString)
+
+		}
+
+	}
+
+	for key, target := range map[string]*string{"pre_tag": &highlight.PreTag, "post_tag": &highlight.PostTag} {
+
+		if tag, ok := options[key]; ok {
+
+			tagString, ok := tag.(string)
+
+			if ok == false {
+				return nil, errors.New("The " + key + " option must be a string")
+			}
+
+			*target = tagString
+
+		}
+
+	}
+
+	for key, target := range map[string]*int{"fragment_size": &highlight.FragmentSize, "number_of_fragments": &highlight.NumberOfFragments} {
+
+		if size, ok := options[key]; ok {
+
+			sizeFloat, ok := size.(float64)
+
+			if ok == false || sizeFloat < 0 || sizeFloat != float64(int(sizeFloat)) {
+				return nil, errors.New("The " + key + " option must be a whole number of at least 0")
+			}
+
+			*target = int(sizeFloat)
+
+		}
+
+	}
+
+	return &highlight, nil
+
+}
+
+// HighlightDocuments adds snippets of the fields matched by a search to each
+// of its hits, with the matched terms wrapped in the highlight's tags
+func HighlightDocuments(collectionName string, criteria map[string][]interface{}, hits *[]jsonserver.JSON, highlight types.Highlight) {
+
+	collection := lookupCollection(collectionName)
+	fieldTerms := collection.getHighlightTerms(criteria)
+
+	for _, hit := range *hits {
+
+		document, ok := hit["document"].(jsonserver.JSON)
+
+		if ok == false {
+			continue
+		}
+
+		result := map[string][]string{}
+
+		for field, terms := range fieldTerms {
+
+			if len(highlight.Fields) > 0 && isHighlightField(field, highlight.Fields) == false {
+				continue
+			}
+
+			snippets := []string{}
+
+			for _, value := range getFieldStrings(document, strings.Split(field, ".")) {
+
+				if highlight.NumberOfFragments > 0 && len(snippets) >= highlight.NumberOfFragments {
+					break
+				}
+
+				snippets = append(snippets, collection.getHighlightSnippets(field, value, terms, highlight)...)
+
+			}
+
+			if highlight.NumberOfFragments > 0 && len(snippets) > highlight.NumberOfFragments {
+				snippets = snippets[:highlight.NumberOfFragments]
+			}
+
+			if len(snippets) > 0 {
+				result[field] = snippets
+			}
+
+		}
+
+		if len(result) > 0 {
+			hit["highlight"] = result
+		}
+
+	}
+
+}
+
+// Check whether a field was one of those asked to be highlighted
+func isHighlightField(field string, fields []string) bool {
+
+	for _, highlightField := range fields {
+
+		if highlightField == field {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+// Collect the terms each field was searched for by the contains, match_phrase
+// and fuzzy criteria in a set of criteria, however deeply they are nested
+func (collection *collection) getHighlightTerms(criteria map[string][]interface{}) map[string]map[string]bool {
+
+	result := map[string]map[string]bool{}
+
+	addTerm := func(field string, term string) {
+
+		if _, ok := result[field]; ok == false {
+			result[field] = map[string]bool{}
+		}
+
+		result[field][term] = true
+
+	}
+
+	for _, groupCriteria := range criteria {
+
+		for _, criterion := range groupCriteria {
+
+			remappedCriterion, ok := criterion.(map[string]interface{})
+
+			if ok == false {
+				continue
+			}
+
+			for criterionType, criterionValue := range remappedCriterion {
+
+				// Nested AND/OR criteria
+				if strings.ToLower(criterionType) == "and" || strings.ToLower(criterionType) == "or" {
+
+					if nestedCriteria, ok := criterionValue.([]interface{}); ok {
+
+						for field, terms := range collection.getHighlightTerms(map[string][]interface{}{criterionType: nestedCriteria}) {
+
+							for term := range terms {
+								addTerm(field, term)
+							}
+
+						}
+
+					}
+
+					continue
+
+				}
+
+				if criterionType != "contains" && criterionType != "match_phrase" {
+					continue
+				}
+
+				if fieldValues, ok := criterionValue.(map[string]interface{}); ok {
+
+					for field, value := range fieldValues {
+
+						fieldType := collection.getFieldType(field)
+						phrase, _, err := parsePhraseCriterion(criterionType, value)
+
+						// Only text is broken into terms that can be highlighted
+						if err != nil || (fieldType != "" && fieldType != "text") {
+							continue
+						}
+
+						_, terms := analysis.GetTerms(collection.getFieldAnalyzer(field), phrase)
+
+						for _, term := range terms {
+							addTerm(field, term)
+						}
+
+					}
+
+				}
+
+			}
+
+		}
+
+	}
+
+	for _, fuzzyTerm := range collection.getFuzzyMatchedTerms(criteria) {
+		addTerm(fuzzyTerm.Field, fuzzyTerm.Term)
+	}
+
+	return result
+
+}
+
+// Get the strings held in a field of a document, in the order they appear,
+// looking inside any arrays along the way
+func getFieldStrings(value interface{}, path []string) []string {
+
+	result := []string{}
+
+	switch typedValue := value.(type) {
+
+	case string:
+
+		if len(path) == 0 {
+			result = append(result, typedValue)
+		}
+
+	case []interface{}:
+
+		for _, item := range typedValue {
+			result = append(result, getFieldStrings(item, path)...)
+		}
+
+	case map[string]interface{}:
+
+		if len(path) > 0 {
+			result = append(result, getFieldStrings(typedValue[path[0]], path[1:])...)
+		}
+
+	case jsonserver.JSON:
+
+		if len(path) > 0 {
+			result = append(result, getFieldStrings(typedValue[path[0]], path[1:])...)
+		}
+
+	}
+
+	return result
+
+}
+
+// Break a field value into tokens in the same way it was indexed, noting
+// which of them are terms that were searched for
+func (collection *collection) getHighlightTokens(field string, value string, terms map[string]bool) []highlightToken {
+
+	result := []highlightToken{}
+
+	// Keywords are matched as whole values
+	if collection.getFieldType(field) == "keyword" {
+		return append(result, highlightToken{Start: 0, End: len(value), Matched: terms[strings.ToLower(value)]})
+	}
+
+	analyzer := collection.getFieldAnalyzer(field)
+	offset := 0
+
+	for _, token := range analysis.Tokenise(analyzer, value) {
+
+		// Tokens keep their original form, so each can be found in the value
+		// after the one before it
+		start := strings.Index(value[offset:], token)
+
+		if start == -1 {
+			continue
+		}
+
+		start += offset
+		offset = start + len(token)
+
+		term, ok := analysis.GetTerm(analyzer, token)
+		result = append(result, highlightToken{Start: start, End: offset, Matched: ok && terms[term]})
+
+	}
+
+	return result
+
+}
+
+// Build the snippets of a field value that hold its matched terms, each of
+// which runs up to the fragment size in characters (or the whole value, if
+// the fragment size is 0)
+func (collection *collection) getHighlightSnippets(field string, value string, terms map[string]bool, highlight types.Highlight) []string {
+
+	result := []string{}
+	tokens := collection.getHighlightTokens(field, value, terms)
+	covered := -1
+
+	// Measure the characters between the start of one token and the end of
+	// another
+	length := func(first int, last int) int {
+		return utf8.RuneCountInString(value[tokens[first].Start:tokens[last].End])
+	}
+
+	for i, token := range tokens {
+
+		if token.Matched == false || i <= covered {
+			continue
+		}
+
+		if highlight.NumberOfFragments > 0 && len(result) >= highlight.NumberOfFragments {
+			break
+		}
+
+		first := i
+		last := i
+
+		if highlight.FragmentSize == 0 {
+
+			first, last = 0, len(tokens)-1
+
+		} else {
+
+			// Give the matched term some leading context, then fill the rest
+			// of the fragment with what follows it
+			for first > covered+1 && length(first-1, i) <= highlight.FragmentSize/2 {
+				first--
+			}
+
+			for last+1 < len(tokens) && length(first, last+1) <= highlight.FragmentSize {
+				last++
+			}
+
+		}
+
+		snippet := ""
+		position := tokens[first].Start
+
+		for _, fragmentToken := range tokens[first:(last + 1)] {
+
+			snippet += value[position:fragmentToken.Start]
+
+			if fragmentToken.Matched {
+				snippet += highlight.PreTag + value[fragmentToken.Start:fragmentToken.End] + highlight.PostTag
+			} else {
+				snippet += value[fragmentToken.Start:fragmentToken.End]
+			}
+
+			position = fragmentToken.End
+
+		}
+
+		result = append(result, snippet)
+		covered = last
+
+	}
+
+	return result
+
+}
@@ -3,37 +3,16 @@ package store
 import (
 	"encoding/json"
 	"errors"
-	"log"
-	"os"
-	"path/filepath"
+	"reflect"
 	"strings"
-	"sync"
 
 	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/analysis"
 	"github.com/D-L-M/mem-db/src/crypt"
-	"github.com/D-L-M/mem-db/src/data"
 	"github.com/D-L-M/mem-db/src/types"
 	"github.com/D-L-M/mem-db/src/utils"
 )
 
-// Documents are stored in a map, for quick retrieval
-var documents = map[string]types.DocumentIndex{}
-
-// Lookups map a field's value against its document
-var lookups = map[string][]string{}
-
-// List of all document IDs
-var allIds = map[string]string{}
-
-// documentsLock allows locking of the documents map during reads/writes
-var documentsLock = sync.RWMutex{}
-
-// lookupsLock allows locking of the lookups map during reads/writes
-var lookupsLock = sync.RWMutex{}
-
-// allIdsLock allows locking of the allIds map during reads/writes
-var allIdsLock = sync.RWMutex{}
-
 // ParseDocument parses a raw JSON document into an object
 func ParseDocument(document []byte) (map[string]interface{}, error) {
 
@@ -51,9 +30,11 @@ func ParseDocument(document []byte) (map[string]interface{}, error) {
 
 }
 
-// IndexDocument parses a document (represented by a JSON string) and store it in the document
-// map by its ID
-func IndexDocument(id string, document []byte, removeFromDiskBeforehand bool) bool {
+// indexDocument parses a document (represented by a JSON string) and store it in the document
+// map by its ID, along with the sequence number and version of the change that wrote it -- if
+// an older version of the document exists, only the fields whose values have changed are
+// reindexed
+func (collection *collection) indexDocument(id string, document []byte, sequence int64, version int64) bool {
 
 	parsedDocument, err := ParseDocument(document)
 
@@ -62,61 +43,236 @@ func IndexDocument(id string, document []byte, removeFromDiskBeforehand bool) bo
 		return false
 	}
 
-	// First remove any old version that might exist
-	RemoveDocument(id, "", removeFromDiskBeforehand)
-
 	// Flatten the document using dot-notation so the inverted index can be
 	// created
-	flattenedObject := utils.FlattenDocumentToDotNotation(parsedDocument)
-	invertedKeys := []string{}
+	fieldValues := groupFlattenedValuesByField(utils.FlattenDocumentToDotNotation(parsedDocument))
+	previousFieldValues := map[string]map[string]interface{}{}
+	fields := map[string]types.FieldIndex{}
+
+	collection.documentsLock.RLock()
+	previousVersion, exists := collection.documents[id]
+	collection.documentsLock.RUnlock()
+
+	if exists {
+
+		if previousDocument, err := ParseDocument(previousVersion.Document); err == nil {
+			previousFieldValues = groupFlattenedValuesByField(utils.FlattenDocumentToDotNotation(previousDocument))
+		}
+
+		// Keep the index entries of unchanged fields and take out the rest
+		for field, fieldIndex := range previousVersion.Fields {
+
+			if values, ok := fieldValues[field]; ok && reflect.DeepEqual(values, previousFieldValues[field]) {
+				fields[field] = fieldIndex
+			} else {
+				collection.removeFieldIndex(id, fieldIndex)
+			}
+
+		}
+
+	}
+
+	for field, values := range fieldValues {
+
+		if _, unchanged := fields[field]; unchanged == false {
+			fields[field] = collection.indexField(id, field, values)
+		}
+
+	}
+
+	// Then add the new version in
+	collection.documentsLock.Lock()
+	collection.allIdsLock.Lock()
+
+	collection.documents[id] = types.DocumentIndex{Sequence: sequence, Version: version, ETag: GenerateETag(version, sequence), Document: document, Fields: fields}
+	collection.allIds[id] = id
+
+	collection.documentsLock.Unlock()
+	collection.allIdsLock.Unlock()
+
+	if exists {
+		collection.removeFieldLengths(getFieldLengths(previousVersion.Fields))
+	}
+
+	collection.addFieldLengths(getFieldLengths(fields))
+
+	return true
+
+}
+
+// Group the values of a dot-notation-flattened document by the field they
+// are indexed under, which ignores any numeric indices in their keys
+func groupFlattenedValuesByField(flattenedObject map[string]interface{}) map[string]map[string]interface{} {
+
+	fieldValues := map[string]map[string]interface{}{}
 
 	for fieldDotKey, fieldValue := range flattenedObject {
 
 		sanitisedFieldKey := utils.RemoveNumericIndicesFromFlattenedKey(fieldDotKey)
-		keyHash, err := storeKeyHash(id, sanitisedFieldKey, fieldValue, "full")
+
+		if _, ok := fieldValues[sanitisedFieldKey]; ok == false {
+			fieldValues[sanitisedFieldKey] = map[string]interface{}{}
+		}
+
+		fieldValues[sanitisedFieldKey][fieldDotKey] = fieldValue
+
+	}
+
+	return fieldValues
+
+}
+
+// The number of positions left between the values of an array field
+const positionGap = 100
+
+// Add the values of one of a document's fields to the search indices
+func (collection *collection) indexField(id string, field string, values map[string]interface{}) types.FieldIndex {
+
+	fieldIndex := types.FieldIndex{InvertedKeys: []string{}, RangeKeys: []types.RangeKey{}, TermFrequencies: map[string]int{}, Positions: map[string][]int{}}
+	fieldType := collection.getFieldType(field)
+	position := 0
+
+	if fieldType == "not_indexed" {
+		return fieldIndex
+	}
+
+	for _, rawValue := range values {
+
+		// Values are indexed as the type their field is mapped to, and
+		// skipped if they can't be converted to it
+		fieldValue, ok := coerceFieldValue(fieldType, rawValue)
+
+		if ok == false {
+			continue
+		}
+
+		keyHash, err := collection.storeKeyHash(id, field, fieldValue, "full")
 
 		if err == nil {
-			invertedKeys = append(invertedKeys, keyHash)
+			fieldIndex.InvertedKeys = append(fieldIndex.InvertedKeys, keyHash)
 		}
 
-		// Now do the same but with words within the value if it's a string
-		if valueString, ok := fieldValue.(string); ok {
+		// Keywords are only matched in full, so their whole values go in the
+		// field's dictionary
+		if valueString, ok := fieldValue.(string); ok && fieldType == "keyword" && keyHash != "" {
+			collection.storeDictionaryTerm(field, strings.ToLower(valueString), keyHash)
+		}
 
-			_, valueWords := utils.GetPhrasesFromString(valueString)
+		// Numbers and dates are also kept in an ordered index so that they
+		// can be searched by range
+		if fieldType == "" || fieldType == "number" || fieldType == "date" {
 
-			for _, valueWord := range valueWords {
+			rangeKey, err := collection.storeRangeValue(id, field, fieldValue)
 
-				wordKeyHash, err := storeKeyHash(id, sanitisedFieldKey, valueWord, "partial")
+			if err == nil {
+				fieldIndex.RangeKeys = append(fieldIndex.RangeKeys, rangeKey)
+			}
+
+		}
+
+		// Now do the same but with the terms within the value if it's a
+		// string, recording where each one occurs so that phrases can be
+		// matched
+		if valueString, ok := fieldValue.(string); ok && (fieldType == "" || fieldType == "text") {
+
+			_, terms := analysis.GetTerms(collection.getFieldAnalyzer(field), valueString)
+
+			for _, term := range terms {
+
+				termKeyHash, err := collection.storeKeyHash(id, field, term, "partial")
 
 				if err == nil {
-					invertedKeys = append(invertedKeys, wordKeyHash)
+					fieldIndex.InvertedKeys = append(fieldIndex.InvertedKeys, termKeyHash)
+				}
+
+				// Record how often each term occurs and how many terms the
+				// field holds, for relevance scoring
+				if termKeyHash != "" {
+					collection.storeDictionaryTerm(field, term, termKeyHash)
+					fieldIndex.TermFrequencies[termKeyHash]++
+					fieldIndex.Positions[termKeyHash] = append(fieldIndex.Positions[termKeyHash], position)
 				}
 
+				fieldIndex.Length++
+				position++
+
 			}
 
+			// Leave a gap between the values of array fields so that phrases
+			// don't run from one value into the next
+			position += positionGap
+
 		}
 
 	}
 
-	// Then add the new version in
-	documentsLock.Lock()
-	allIdsLock.Lock()
+	return fieldIndex
 
-	documents[id] = types.DocumentIndex{Document: document, InvertedKeys: invertedKeys}
-	allIds[id] = id
+}
 
-	documentsLock.Unlock()
-	allIdsLock.Unlock()
+// Remove the values of one of a document's fields from the search indices
+func (collection *collection) removeFieldIndex(id string, fieldIndex types.FieldIndex) {
 
-	return true
+	for _, lookupKey := range fieldIndex.InvertedKeys {
+
+		// Iterate through all document IDs for the lookup
+		collection.lookupsLock.Lock()
+
+		for i, lookupValue := range collection.lookups[lookupKey] {
+
+			// If the ID matches the document that's being removed, take
+			// that ID out of the lookup slice
+			if lookupValue == id {
+
+				collection.lookups[lookupKey] = append(collection.lookups[lookupKey][:i], collection.lookups[lookupKey][i+1:]...)
+
+				// Also remove the whole inverted index (and any term it
+				// held) if it's now empty
+				if len(collection.lookups[lookupKey]) == 0 {
+					delete(collection.lookups, lookupKey)
+					collection.removeDictionaryTerm(lookupKey)
+				}
+
+				break
+
+			}
+
+		}
+
+		collection.lookupsLock.Unlock()
+
+	}
+
+	// Remove it from any ordered indices
+	for _, rangeKey := range fieldIndex.RangeKeys {
+		collection.removeRangeValue(id, rangeKey)
+	}
+
+}
+
+// Get the number of words held in each of a document's fields
+func getFieldLengths(fields map[string]types.FieldIndex) map[string]int {
+
+	fieldLengths := map[string]int{}
+
+	for field, fieldIndex := range fields {
+
+		if fieldIndex.Length > 0 {
+			fieldLengths[field] = fieldIndex.Length
+		}
+
+	}
+
+	return fieldLengths
 
 }
 
 // Generate a key/value lookup hash
 func generateKeyHash(key string, value interface{}, entryType string) (string, error) {
 
-	// If the value is a string, lowercase it
-	if valueString, ok := value.(string); ok {
+	// If the value is a whole string, lowercase it -- partial values are
+	// already in the form their field's analyzer gave them
+	if valueString, ok := value.(string); ok && entryType == "full" {
 		value = strings.ToLower(valueString)
 	}
 
@@ -133,8 +289,9 @@ func generateKeyHash(key string, value interface{}, entryType string) (string, e
 }
 
 // If a document ID has not yet been stored against a lookup of a key/value
-// hash, insert it into the lookup map
-func storeKeyHash(id string, key string, value interface{}, entryType string) (string, error) {
+// hash, insert it into the lookup map (the hash is still returned alongside
+// the error if it had already been stored)
+func (collection *collection) storeKeyHash(id string, key string, value interface{}, entryType string) (string, error) {
 
 	keyHash, err := generateKeyHash(key, value, entryType)
 
@@ -142,25 +299,27 @@ func storeKeyHash(id string, key string, value interface{}, entryType string) (s
 		return "", err
 	}
 
-	if isDocumentInLookup(keyHash, id) == true {
-		return "", errors.New("The key hash has already been stored")
+	if collection.isDocumentInLookup(keyHash, id) == true {
+		return keyHash, errors.New("The key hash has already been stored")
 	}
 
-	lookupsLock.Lock()
-	lookups[keyHash] = append(lookups[keyHash], id)
-	lookupsLock.Unlock()
+	collection.lookupsLock.Lock()
+	collection.lookups[keyHash] = append(collection.lookups[keyHash], id)
+	collection.lookupsLock.Unlock()
 
 	return keyHash, nil
 
 }
 
-// GetRawDocument gets a raw document by its ID
-func GetRawDocument(id string) ([]byte, error) {
+// GetRawDocument gets a raw document from a collection by its ID
+func GetRawDocument(collectionName string, id string) ([]byte, error) {
+
+	collection := lookupCollection(collectionName)
 
-	documentsLock.RLock()
-	defer documentsLock.RUnlock()
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
 
-	if document, ok := documents[id]; ok {
+	if document, ok := collection.documents[id]; ok {
 		return document.Document, nil
 	}
 
@@ -168,10 +327,60 @@ func GetRawDocument(id string) ([]byte, error) {
 
 }
 
-// GetDocument gets a document by its ID
-func GetDocument(id string) (jsonserver.JSON, error) {
+// GetRawDocumentWithVersion gets a raw document from a collection by its ID
+// along with its version and entity tag, all from the same read so that they
+// always belong together
+func GetRawDocumentWithVersion(collectionName string, id string) ([]byte, int64, string, error) {
+
+	collection := lookupCollection(collectionName)
+
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
+
+	if document, ok := collection.documents[id]; ok {
+		return document.Document, document.Version, document.ETag, nil
+	}
+
+	return nil, 0, "", errors.New("Document does not exist")
+
+}
+
+// DocumentExists checks whether a collection holds a document, without
+// reading it
+func DocumentExists(collectionName string, id string) bool {
+
+	collection := lookupCollection(collectionName)
+
+	collection.allIdsLock.RLock()
+	defer collection.allIdsLock.RUnlock()
+
+	_, ok := collection.allIds[id]
+
+	return ok
+
+}
+
+// GetDocumentVersion gets the version and entity tag of a document in a
+// collection by its ID
+func GetDocumentVersion(collectionName string, id string) (int64, string, error) {
+
+	collection := lookupCollection(collectionName)
 
-	document, err := GetRawDocument(id)
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
+
+	if document, ok := collection.documents[id]; ok {
+		return document.Version, document.ETag, nil
+	}
+
+	return 0, "", errors.New("Document does not exist")
+
+}
+
+// GetDocument gets a document from a collection by its ID
+func GetDocument(collectionName string, id string) (jsonserver.JSON, error) {
+
+	document, err := GetRawDocument(collectionName, id)
 
 	if err == nil {
 
@@ -191,103 +400,107 @@ func GetDocument(id string) (jsonserver.JSON, error) {
 
 }
 
-// RemoveAllDocuments removes all documents
-func RemoveAllDocuments(removeFromDisk bool) {
+// GetDocuments gets several documents from a collection by their IDs, as a
+// consistent snapshot, returning an entry for each ID in order that says
+// whether it was found and, if so, holds the document and its version
+func GetDocuments(collectionName string, ids []string) []jsonserver.JSON {
 
-	data.SetState("truncating")
+	collection := lookupCollection(collectionName)
+	documents := make([]types.DocumentIndex, len(ids))
+	found := make([]bool, len(ids))
 
-	documentsLock.Lock()
-	lookupsLock.Lock()
-	allIdsLock.Lock()
+	collection.documentsLock.RLock()
 
-	documents = map[string]types.DocumentIndex{}
-	lookups = map[string][]string{}
-	allIds = map[string]string{}
+	for i, id := range ids {
+		documents[i], found[i] = collection.documents[id]
+	}
 
-	documentsLock.Unlock()
-	lookupsLock.Unlock()
-	allIdsLock.Unlock()
+	collection.documentsLock.RUnlock()
 
-	if removeFromDisk {
+	result := []jsonserver.JSON{}
 
-		storageDirectory, err := data.GetStorageDirectory()
+	for i, id := range ids {
 
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Iterate through and delete all flushed JSON files
-		files, err := filepath.Glob(storageDirectory + "/*.json")
+		var parsedDocument jsonserver.JSON
 
-		if err != nil {
-			log.Fatal("Cannot read from storage directory")
+		if found[i] == false || json.Unmarshal(documents[i].Document, &parsedDocument) != nil {
+			result = append(result, jsonserver.JSON{"id": id, "found": false})
+			continue
 		}
 
-		for _, filename := range files {
-			os.Remove(filename)
-		}
+		result = append(result, jsonserver.JSON{"id": id, "found": true, "version": documents[i].Version, "etag": documents[i].ETag, "document": parsedDocument})
 
 	}
 
-	data.SetState("active")
+	return result
 
 }
 
-// RemoveDocument removes a document by its ID
-func RemoveDocument(id string, filepath string, removeFromDisk bool) {
+// removeAllDocuments removes all documents in the collection from memory --
+// the collection's indices stay locked until it is empty, so nothing else
+// needs to stop writing while it is truncated
+func (collection *collection) removeAllDocuments() {
+
+	collection.documentsLock.Lock()
+	collection.lookupsLock.Lock()
+	collection.rangesLock.Lock()
+	collection.dictionaryLock.Lock()
+	collection.fieldLengthTotalsLock.Lock()
+	collection.allIdsLock.Lock()
+
+	collection.documents = map[string]types.DocumentIndex{}
+	collection.lookups = map[string][]string{}
+	collection.ranges = map[string]*skipList{}
+	collection.dictionary = map[string]*skipList{}
+	collection.dictionaryKeys = map[string]dictionaryKey{}
+	collection.fieldLengthTotals = map[string]fieldLengthTotal{}
+	collection.allIds = map[string]string{}
+
+	collection.documentsLock.Unlock()
+	collection.lookupsLock.Unlock()
+	collection.rangesLock.Unlock()
+	collection.dictionaryLock.Unlock()
+	collection.fieldLengthTotalsLock.Unlock()
+	collection.allIdsLock.Unlock()
 
-	// Remove it from any inverted indices using its own inverted lookup
-	documentsLock.Lock()
-
-	for _, lookupKey := range documents[id].InvertedKeys {
-
-		// Iterate through all document IDs for the lookup
-		lookupsLock.Lock()
-
-		for i, lookupValue := range lookups[lookupKey] {
-
-			// If the ID matches the document that's being removed, take
-			// that ID out of the lookup slice
-			if lookupValue == id {
-
-				lookups[lookupKey] = append(lookups[lookupKey][:i], lookups[lookupKey][i+1:]...)
+}
 
-				// Also remove the whole inverted index if it's now empty
-				if len(lookups[lookupKey]) == 0 {
-					delete(lookups, lookupKey)
-				}
+// removeDocument removes a document in the collection from memory by its ID
+func (collection *collection) removeDocument(id string) {
 
-			}
+	// Remove it from any inverted and ordered indices using its own inverted
+	// lookup
+	collection.documentsLock.Lock()
 
-		}
+	document, exists := collection.documents[id]
 
-		lookupsLock.Unlock()
+	for _, fieldIndex := range document.Fields {
+		collection.removeFieldIndex(id, fieldIndex)
+	}
 
+	// Take its field lengths out of the running totals
+	if exists {
+		collection.removeFieldLengths(getFieldLengths(document.Fields))
 	}
 
 	// Remove the document itself
-	allIdsLock.Lock()
+	collection.allIdsLock.Lock()
 
-	delete(documents, id)
-	delete(allIds, id)
+	delete(collection.documents, id)
+	delete(collection.allIds, id)
 
-	allIdsLock.Unlock()
-	documentsLock.Unlock()
-
-	// Optionally also remove the flushed file from disk
-	if removeFromDisk && filepath != "" {
-		os.Remove(filepath)
-	}
+	collection.allIdsLock.Unlock()
+	collection.documentsLock.Unlock()
 
 }
 
 // Check whether a document ID exists within a given key hash lookup
-func isDocumentInLookup(keyHash string, documentID string) bool {
+func (collection *collection) isDocumentInLookup(keyHash string, documentID string) bool {
 
-	lookupsLock.RLock()
-	defer lookupsLock.RUnlock()
+	collection.lookupsLock.RLock()
+	defer collection.lookupsLock.RUnlock()
 
-	for _, lookupValue := range lookups[keyHash] {
+	for _, lookupValue := range collection.lookups[keyHash] {
 
 		if lookupValue == documentID {
 			return true
@@ -299,29 +512,33 @@ func isDocumentInLookup(keyHash string, documentID string) bool {
 
 }
 
-// GetLookups gets the lookup map
-func GetLookups() map[string][]string {
+// GetLookups gets the lookup map of a collection
+func GetLookups(collectionName string) map[string][]string {
 
-	lookupsLock.RLock()
-	defer lookupsLock.RUnlock()
+	collection := lookupCollection(collectionName)
 
-	return lookups
+	collection.lookupsLock.RLock()
+	defer collection.lookupsLock.RUnlock()
+
+	return collection.lookups
 
 }
 
-// GetStats gets stats about the index
-func GetStats() jsonserver.JSON {
+// GetStats gets stats about the index of a collection
+func GetStats(collectionName string) jsonserver.JSON {
+
+	collection := lookupCollection(collectionName)
 
-	documentsLock.RLock()
-	lookupsLock.RLock()
+	collection.documentsLock.RLock()
+	collection.lookupsLock.RLock()
 
 	stats := jsonserver.JSON{
 		"totals": map[string]int{
-			"documents":        len(documents),
-			"inverted_indices": len(lookups)}}
+			"documents":        len(collection.documents),
+			"inverted_indices": len(collection.lookups)}}
 
-	documentsLock.RUnlock()
-	lookupsLock.RUnlock()
+	collection.documentsLock.RUnlock()
+	collection.lookupsLock.RUnlock()
 
 	return stats
 
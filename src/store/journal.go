@@ -0,0 +1,245 @@
+package store
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/wal"
+)
+
+// tombstone records the removal of a document
+type tombstone struct {
+	Sequence int64
+	Version  int64
+}
+
+// isNewerChange checks whether one change to a document supersedes another --
+// changes with higher versions win, and the sequence breaks ties between
+// changes made to the same version on different nodes
+func isNewerChange(version int64, sequence int64, otherVersion int64, otherSequence int64) bool {
+
+	return version > otherVersion || (version == otherVersion && sequence > otherSequence)
+
+}
+
+// GenerateETag generates the entity tag of a version of a document, which is
+// unique even when the same version is written on different nodes
+func GenerateETag(version int64, sequence int64) string {
+
+	return "\"" + strconv.FormatInt(version, 10) + "-" + strconv.FormatInt(sequence, 36) + "\""
+
+}
+
+// GetLatestVersion gets the version of the latest change to a document in a
+// collection, including its removal (0 if it has never been written)
+func GetLatestVersion(collectionName string, id string) int64 {
+
+	collection := lookupCollection(collectionName)
+
+	collection.journalLock.Lock()
+	defer collection.journalLock.Unlock()
+
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
+
+	if document, ok := collection.documents[id]; ok {
+		return document.Version
+	}
+
+	return collection.tombstones[id].Version
+
+}
+
+// ApplyJournalEntry applies a change recorded in a collection's write-ahead
+// log to its index if it is newer than anything already applied to the same
+// document, returning whether it was applied
+func ApplyJournalEntry(collectionName string, entry types.JournalEntry) bool {
+
+	collection := getCollection(collectionName)
+
+	collection.journalLock.Lock()
+	defer collection.journalLock.Unlock()
+
+	wal.ObserveSequence(entry.Sequence)
+
+	// Changes written before documents had versions count as the first
+	if entry.Version < 1 {
+		entry.Version = 1
+	}
+
+	// Find out whether the change is newer than the latest one already
+	// applied to the document
+	isNewer := entry.Sequence > collection.truncatedAt
+
+	if removal, ok := collection.tombstones[entry.ID]; ok && isNewerChange(entry.Version, entry.Sequence, removal.Version, removal.Sequence) == false {
+		isNewer = false
+	}
+
+	// The document as it was beforehand is kept for change feeds
+	var previousDocument []byte
+
+	collection.documentsLock.RLock()
+
+	if document, ok := collection.documents[entry.ID]; ok {
+
+		previousDocument = document.Document
+
+		if isNewerChange(entry.Version, entry.Sequence, document.Version, document.Sequence) == false {
+			isNewer = false
+		}
+
+	}
+
+	collection.documentsLock.RUnlock()
+
+	switch entry.Action {
+
+	case "add":
+
+		if isNewer == false {
+			return false
+		}
+
+		delete(collection.tombstones, entry.ID)
+
+		if collection.indexDocument(entry.ID, []byte(entry.Document), entry.Sequence, entry.Version) == false {
+			return false
+		}
+
+		recordChange(collectionName, entry, previousDocument)
+
+		return true
+
+	case "remove":
+
+		if isNewer == false {
+			return false
+		}
+
+		collection.removeDocument(entry.ID)
+		collection.tombstones[entry.ID] = tombstone{Sequence: entry.Sequence, Version: entry.Version}
+
+		recordChange(collectionName, entry, previousDocument)
+
+		return true
+
+	case "mapping":
+
+		return collection.applyMapping(entry)
+
+	case "truncate":
+
+		if entry.Sequence <= collection.truncatedAt {
+			return false
+		}
+
+		collection.truncatedAt = entry.Sequence
+		collection.tombstones = map[string]tombstone{}
+
+		// Documents written after the truncation (which can only be seen when
+		// replaying logs out of order) survive it
+		survivingIds := []string{}
+		removedIds := []string{}
+
+		collection.documentsLock.RLock()
+
+		for id, document := range collection.documents {
+
+			if document.Sequence > entry.Sequence {
+				survivingIds = append(survivingIds, id)
+			} else {
+				removedIds = append(removedIds, id)
+			}
+
+		}
+
+		collection.documentsLock.RUnlock()
+
+		if len(survivingIds) == 0 {
+
+			collection.removeAllDocuments()
+
+		} else {
+
+			for _, id := range removedIds {
+				collection.removeDocument(id)
+			}
+
+		}
+
+		recordChange(collectionName, entry, nil)
+
+		return true
+
+	}
+
+	return false
+
+}
+
+// ForEachJournalEntry emits the entries needed to rebuild the current index of
+// a collection from scratch, for use when compacting its write-ahead log into
+// a snapshot
+func ForEachJournalEntry(collectionName string, emit func(types.JournalEntry) error) error {
+
+	collection := lookupCollection(collectionName)
+
+	collection.journalLock.Lock()
+	defer collection.journalLock.Unlock()
+
+	// The mapping comes first so that documents are indexed under it
+	if collection.mappingSequence > 0 {
+
+		collection.mappingLock.RLock()
+		mapping, err := json.Marshal(EncodeMapping(collection.mapping))
+		collection.mappingLock.RUnlock()
+
+		if err != nil {
+			return err
+		}
+
+		err = emit(types.JournalEntry{Sequence: collection.mappingSequence, Action: "mapping", ID: "_mapping", Document: string(mapping)})
+
+		if err != nil {
+			return err
+		}
+
+	}
+
+	if collection.truncatedAt > 0 {
+
+		err := emit(types.JournalEntry{Sequence: collection.truncatedAt, Action: "truncate", ID: "_all"})
+
+		if err != nil {
+			return err
+		}
+
+	}
+
+	for id, removal := range collection.tombstones {
+
+		err := emit(types.JournalEntry{Sequence: removal.Sequence, Version: removal.Version, Action: "remove", ID: id})
+
+		if err != nil {
+			return err
+		}
+
+	}
+
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
+
+	for id, document := range collection.documents {
+
+		err := emit(types.JournalEntry{Sequence: document.Sequence, Version: document.Version, Action: "add", ID: id, Document: string(document.Document)})
+
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
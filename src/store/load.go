@@ -2,18 +2,24 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"strconv"
 
 	"github.com/D-L-M/jsonserver"
-	"github.com/D-L-M/mem-db/src/crypt"
 	"github.com/D-L-M/mem-db/src/data"
 	"github.com/D-L-M/mem-db/src/output"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/wal"
 )
 
-// IndexFromFile reindexes a single document previously flushed to disk
+// IndexFromFile reindexes a single document flushed to disk in the
+// one-file-per-document layout used before the write-ahead log into the
+// default collection, treating the file's modification time as the sequence
+// number of the change
 func IndexFromFile(filename string) {
 
 	// Read in and parse the JSON
@@ -24,14 +30,15 @@ func IndexFromFile(filename string) {
 		var parsedDocument jsonserver.JSON
 
 		err := json.Unmarshal(fileContents, &parsedDocument)
+		fileInfo, statErr := os.Stat(filename)
 
-		if err == nil {
+		if err == nil && statErr == nil {
 
 			// Check for required fields and index the document
 			if id, ok := parsedDocument["id"].(string); ok {
 
 				if document, ok := parsedDocument["document"].(string); ok {
-					IndexDocument(id, []byte(document), false)
+					ApplyJournalEntry(data.DefaultCollection, types.JournalEntry{Sequence: fileInfo.ModTime().UnixNano(), Version: 1, Action: "add", ID: id, Document: document})
 				}
 
 			}
@@ -42,34 +49,80 @@ func IndexFromFile(filename string) {
 
 }
 
-// GetDocumentFilePath gets a document's file path by its ID
-func GetDocumentFilePath(documentID string) (string, error) {
+// IndexDocumentFromDisk reapplies a change written to another node's
+// write-ahead log in a collection, given the position it was written at -- if
+// the log has since been compacted, the node's snapshot and log are searched
+// for the latest change to the document instead (a change that has already
+// been superseded is not an error)
+func IndexDocumentFromDisk(collectionName string, documentID string, hostname string, position int64) error {
 
-	storageDirectory, err := data.GetStorageDirectory()
+	entry, err := wal.ReadAt(collectionName, hostname, position)
+
+	if err != nil || entry.ID != documentID {
+
+		entry, err = wal.Find(collectionName, hostname, documentID)
+
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return "", err
 	}
 
-	documentFilename := storageDirectory + "/" + crypt.Sha512([]byte(documentID)) + ".json"
+	ApplyJournalEntry(collectionName, entry)
 
-	return documentFilename, nil
+	return nil
 
 }
 
-// IndexDocumentFromDisk reindexes a single document previously flushed to disk
-// by its ID
-func IndexDocumentFromDisk(documentID string) {
+// IndexDocumentsFromDisk reapplies a batch of changes written consecutively
+// to another node's write-ahead log in a collection, given the position of
+// the first of them -- any that can no longer be found at their expected
+// positions are searched for in the node's snapshot and log instead
+func IndexDocumentsFromDisk(collectionName string, documentIDs []string, hostname string, position int64) error {
 
-	documentFilename, err := GetDocumentFilePath(documentID)
+	entries, _ := wal.ReadFrom(collectionName, hostname, position, len(documentIDs))
+	missingIds := []string{}
+
+	for i, documentID := range documentIDs {
+
+		if i < len(entries) && entries[i].ID == documentID {
+			ApplyJournalEntry(collectionName, entries[i])
+		} else {
+			missingIds = append(missingIds, documentID)
+		}
 
-	if err == nil {
-		IndexFromFile(documentFilename)
 	}
 
+	if len(missingIds) == 0 {
+		return nil
+	}
+
+	latestEntries, err := wal.FindAll(collectionName, hostname, missingIds)
+
+	if err != nil {
+		return err
+	}
+
+	for _, documentID := range missingIds {
+
+		entry, ok := latestEntries[documentID]
+
+		if ok == false {
+			err = errors.New("Entry for '" + documentID + "' does not exist")
+		} else {
+			ApplyJournalEntry(collectionName, entry)
+		}
+
+	}
+
+	return err
+
 }
 
-// IndexAllFromDisk reindexes all documents previously flushed to disk
+// IndexAllFromDisk reindexes all documents previously flushed to disk, by
+// replaying the write-ahead logs of all nodes in every collection and
+// migrating any documents stored in the older one-file-per-document layout
+// into the default collection
 func IndexAllFromDisk() {
 
 	storageDirectory, err := data.GetStorageDirectory()
@@ -88,10 +141,59 @@ func IndexAllFromDisk() {
 	data.SetState("recovering")
 
 	for i, filename := range files {
-		output.Log("Restoring index from disk: " + strconv.Itoa(i+1) + " / " + strconv.Itoa(len(files)))
+		output.Log("Migrating document from disk: " + strconv.Itoa(i+1) + " / " + strconv.Itoa(len(files)))
 		IndexFromFile(filename)
 	}
 
+	// Replay the write-ahead logs of every collection
+	collectionNames, err := wal.Collections()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replayedEntries := 0
+
+	for _, collectionName := range collectionNames {
+
+		err = wal.Replay(collectionName, func(entry types.JournalEntry) {
+
+			ApplyJournalEntry(collectionName, entry)
+
+			replayedEntries++
+
+			if replayedEntries%10000 == 0 {
+				output.Log("Replaying write-ahead log: " + strconv.Itoa(replayedEntries) + " entries")
+			}
+
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	}
+
+	output.Log("Replayed " + strconv.Itoa(replayedEntries) + " write-ahead log entries")
+
+	// Migrated documents are snapshotted before their files are removed
+	if len(files) > 0 {
+
+		err = wal.Compact(data.DefaultCollection, func(emit func(types.JournalEntry) error) error {
+			return ForEachJournalEntry(data.DefaultCollection, emit)
+		})
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, filename := range files {
+			os.Remove(filename)
+		}
+
+	}
+
+	StartRecordingChanges()
 	data.SetState("active")
 
 }
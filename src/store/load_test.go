@@ -0,0 +1,170 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/D-L-M/mem-db/src/crypt"
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/wal"
+)
+
+// TestMain points the base directory at a temporary one for the duration of
+// the tests
+func TestMain(m *testing.M) {
+
+	baseDirectory, err := ioutil.TempDir("", "memdb-store")
+
+	if err != nil {
+		panic(err)
+	}
+
+	os.Args = append(os.Args, "--base-directory="+baseDirectory, "--log-mode=silent")
+	data.GetOptions()
+
+	code := m.Run()
+
+	os.RemoveAll(baseDirectory)
+	os.Exit(code)
+
+}
+
+// Write entries to a log file, framed in the same way as the write-ahead log
+// frames them on disk
+func writeTestLog(t *testing.T, filename string, entries ...types.JournalEntry) {
+
+	records := []byte{}
+
+	for _, entry := range entries {
+
+		payload, _ := json.Marshal(entry)
+		header := make([]byte, 8)
+
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+
+		records = append(records, header...)
+		records = append(records, payload...)
+
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filename, records, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+// Check that a document in a collection has a particular name, or doesn't
+// exist if the name is empty
+func expectTestDocument(t *testing.T, collectionName string, id string, name string) {
+
+	document, err := GetRawDocument(collectionName, id)
+
+	if name == "" {
+
+		if err == nil {
+			t.Fatalf("Expected '%s' not to exist in '%s', got %s", id, collectionName, document)
+		}
+
+		return
+
+	}
+
+	var parsedDocument map[string]interface{}
+
+	if err != nil || json.Unmarshal(document, &parsedDocument) != nil || parsedDocument["name"] != name {
+		t.Fatalf("Expected '%s' in '%s' to be named %s, got %s (error %v)", id, collectionName, name, document, err)
+	}
+
+}
+
+func TestIndexAllFromDiskMigratesLegacyLayout(t *testing.T) {
+
+	baseDirectory, _ := data.GetBaseDirectory()
+	storageDirectory, _ := data.GetStorageDirectory()
+	peerDirectory := crypt.Sha512([]byte("http://127.0.0.1:9998"))
+
+	// A document flushed to its own file before the write-ahead log existed
+	legacyFile, _ := json.Marshal(map[string]string{"id": "file", "document": `{"name": "Joe"}`})
+
+	if err := ioutil.WriteFile(storageDirectory+"/file.json", legacyFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer's log written before documents were split into collections
+	writeTestLog(t, baseDirectory+"/wal/"+peerDirectory+"/log", types.JournalEntry{Sequence: 1, Version: 1, Action: "add", ID: "logged", Document: `{"name": "Jane"}`})
+
+	if err := wal.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	IndexAllFromDisk()
+
+	expectTestDocument(t, data.DefaultCollection, "file", "Joe")
+	expectTestDocument(t, data.DefaultCollection, "logged", "Jane")
+
+	if data.GetState() != "active" {
+		t.Fatalf("Expected the node to be active, got %s", data.GetState())
+	}
+
+	// The old files are gone, and the migrated document is in the snapshot
+	if _, err := os.Stat(storageDirectory + "/file.json"); os.IsNotExist(err) == false {
+		t.Fatal("Expected the legacy document file to have been removed")
+	}
+
+	if _, err := os.Stat(baseDirectory + "/wal"); os.IsNotExist(err) == false {
+		t.Fatal("Expected the legacy WAL directory to have been removed")
+	}
+
+	if _, err := os.Stat(storageDirectory + "/" + data.DefaultCollection + "/" + peerDirectory + "/log"); err != nil {
+		t.Fatal("Expected the peer's log to have been moved into the default collection")
+	}
+
+	entry, err := wal.Find(data.DefaultCollection, "http://127.0.0.1:9999", "file")
+
+	if err != nil || entry.Action != "add" {
+		t.Fatalf("Expected the migrated document to have been snapshotted, got %v (error %v)", entry, err)
+	}
+
+}
+
+func TestIndexAllFromDiskOrdersChangesAcrossNodes(t *testing.T) {
+
+	storageDirectory, _ := data.GetStorageDirectory()
+
+	// Nodes' logs are replayed one after the other, so both orders are tried
+	for collectionName, hostnames := range map[string][]string{"ordered-one": {"http://node-a", "http://node-b"}, "ordered-two": {"http://node-b", "http://node-a"}} {
+
+		writeTestLog(t, storageDirectory+"/"+collectionName+"/"+crypt.Sha512([]byte(hostnames[0]))+"/log",
+			types.JournalEntry{Sequence: 10, Version: 1, Action: "add", ID: "before", Document: `{"name": "Before"}`},
+			types.JournalEntry{Sequence: 40, Version: 2, Action: "add", ID: "updated", Document: `{"name": "New"}`},
+			types.JournalEntry{Sequence: 50, Version: 1, Action: "add", ID: "removed", Document: `{"name": "Removed"}`})
+
+		writeTestLog(t, storageDirectory+"/"+collectionName+"/"+crypt.Sha512([]byte(hostnames[1]))+"/log",
+			types.JournalEntry{Sequence: 15, Version: 1, Action: "add", ID: "truncated", Document: `{"name": "Truncated"}`},
+			types.JournalEntry{Sequence: 20, Action: "truncate", ID: "_all"},
+			types.JournalEntry{Sequence: 30, Version: 1, Action: "add", ID: "updated", Document: `{"name": "Old"}`},
+			types.JournalEntry{Sequence: 60, Version: 2, Action: "remove", ID: "removed"})
+
+	}
+
+	IndexAllFromDisk()
+
+	for _, collectionName := range []string{"ordered-one", "ordered-two"} {
+		expectTestDocument(t, collectionName, "before", "")
+		expectTestDocument(t, collectionName, "truncated", "")
+		expectTestDocument(t, collectionName, "updated", "New")
+		expectTestDocument(t, collectionName, "removed", "")
+	}
+
+}
@@ -0,0 +1,514 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/analysis"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+)
+
+// FieldTypes are the types that a field can be mapped to
+var FieldTypes = []string{"keyword", "text", "number", "date", "boolean", "not_indexed"}
+
+// Descriptions of the values each field type holds, for use in error messages
+var fieldTypeDescriptions = map[string]string{
+	"keyword": "a string",
+	"text":    "a string",
+	"number":  "a number",
+	"date":    "an RFC 3339 or YYYY-MM-DD date",
+	"boolean": "a boolean",
+}
+
+// ParseMapping parses a mapping declaration, which is an object holding the
+// type of each mapped field and whether documents that don't conform to it
+// are rejected
+func ParseMapping(declaration []byte) (types.Mapping, error) {
+
+	var parsedDeclaration map[string]interface{}
+
+	err := json.Unmarshal(declaration, &parsedDeclaration)
+
+	if err != nil {
+		return types.Mapping{}, errors.New("Mapping is not valid JSON")
+	}
+
+	mapping := types.Mapping{Analyzers: map[string]types.Analyzer{}, Fields: map[string]types.FieldMapping{}}
+
+	if strict, ok := parsedDeclaration["strict"]; ok {
+
+		strictBool, ok := strict.(bool)
+
+		if ok == false {
+			return types.Mapping{}, errors.New("The strict option must be a boolean")
+		}
+
+		mapping.Strict = strictBool
+
+	}
+
+	if analyzers, ok := parsedDeclaration["analyzers"]; ok {
+
+		analyzersMap, ok := analyzers.(map[string]interface{})
+
+		if ok == false {
+			return types.Mapping{}, errors.New("The analyzers option must be an object")
+		}
+
+		for name, settings := range analyzersMap {
+
+			if _, builtIn := analysis.BuiltInAnalyzers[name]; builtIn {
+				return types.Mapping{}, errors.New("Analyzer '" + name + "' is built in and cannot be redefined")
+			}
+
+			analyzer, err := analysis.ParseAnalyzer(settings)
+
+			if err != nil {
+				return types.Mapping{}, errors.New("Analyzer '" + name + "' is not valid: " + err.Error())
+			}
+
+			mapping.Analyzers[name] = analyzer
+
+		}
+
+	}
+
+	if analyzer, ok := parsedDeclaration["analyzer"]; ok {
+
+		analyzerString, _ := analyzer.(string)
+
+		if isKnownAnalyzer(mapping, analyzerString) == false {
+			return types.Mapping{}, errors.New("Analyzer '" + analyzerString + "' does not exist")
+		}
+
+		mapping.Analyzer = analyzerString
+
+	}
+
+	fields, ok := parsedDeclaration["fields"].(map[string]interface{})
+
+	if ok == false {
+		return types.Mapping{}, errors.New("Mapping must have a fields object")
+	}
+
+	for field, definition := range fields {
+
+		options, _ := definition.(map[string]interface{})
+		fieldType, _ := options["type"].(string)
+
+		if utils.StringInSlice(fieldType, FieldTypes) == false {
+			return types.Mapping{}, errors.New("Field '" + field + "' must have a type of " + strings.Join(FieldTypes[:len(FieldTypes)-1], ", ") + " or " + FieldTypes[len(FieldTypes)-1])
+		}
+
+		fieldMapping := types.FieldMapping{Type: fieldType}
+
+		// Only text is broken into terms, so only text fields have analyzers
+		if analyzer, ok := options["analyzer"]; ok {
+
+			analyzerString, _ := analyzer.(string)
+
+			if fieldType != "text" {
+				return types.Mapping{}, errors.New("Field '" + field + "' must be a text field to have an analyzer")
+			}
+
+			if isKnownAnalyzer(mapping, analyzerString) == false {
+				return types.Mapping{}, errors.New("Analyzer '" + analyzerString + "' does not exist")
+			}
+
+			fieldMapping.Analyzer = analyzerString
+
+		}
+
+		mapping.Fields[field] = fieldMapping
+
+	}
+
+	return mapping, nil
+
+}
+
+// EncodeMapping converts a mapping back into the form it is declared in
+func EncodeMapping(mapping types.Mapping) jsonserver.JSON {
+
+	fields := jsonserver.JSON{}
+
+	for field, fieldMapping := range mapping.Fields {
+
+		encodedField := jsonserver.JSON{"type": fieldMapping.Type}
+
+		if fieldMapping.Analyzer != "" {
+			encodedField["analyzer"] = fieldMapping.Analyzer
+		}
+
+		fields[field] = encodedField
+
+	}
+
+	encodedMapping := jsonserver.JSON{"strict": mapping.Strict, "fields": fields}
+
+	// Analyzers are only included when they have been set, so that mappings
+	// without them come back exactly as they were declared
+	if mapping.Analyzer != "" {
+		encodedMapping["analyzer"] = mapping.Analyzer
+	}
+
+	if len(mapping.Analyzers) > 0 {
+
+		analyzers := jsonserver.JSON{}
+
+		for name, analyzer := range mapping.Analyzers {
+			analyzers[name] = analysis.EncodeAnalyzer(analyzer)
+		}
+
+		encodedMapping["analyzers"] = analyzers
+
+	}
+
+	return encodedMapping
+
+}
+
+// GetMapping gets the mapping of a collection
+func GetMapping(collectionName string) types.Mapping {
+
+	collection := lookupCollection(collectionName)
+
+	collection.mappingLock.RLock()
+	defer collection.mappingLock.RUnlock()
+
+	return collection.mapping
+
+}
+
+// ValidateDocument checks that a raw document conforms to the mapping of a
+// collection, if the mapping is strict
+func ValidateDocument(collectionName string, document []byte) error {
+
+	collection := lookupCollection(collectionName)
+
+	collection.mappingLock.RLock()
+	strict := collection.mapping.Strict
+	collection.mappingLock.RUnlock()
+
+	if strict == false {
+		return nil
+	}
+
+	parsedDocument, err := ParseDocument(document)
+
+	if err != nil {
+		return err
+	}
+
+	fieldValues := groupFlattenedValuesByField(utils.FlattenDocumentToDotNotation(parsedDocument))
+	fields := []string{}
+
+	for field := range fieldValues {
+		fields = append(fields, field)
+	}
+
+	// Check fields in a consistent order so the same error is always reported
+	sort.Strings(fields)
+
+	for _, field := range fields {
+
+		fieldType := collection.getFieldType(field)
+
+		for _, value := range fieldValues[field] {
+
+			if value != nil && isValidFieldValue(fieldType, value) == false {
+				return errors.New("Field '" + field + "' must hold " + fieldTypeDescriptions[fieldType])
+			}
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// getFieldType gets the type a field is mapped to (or an empty string if it
+// isn't mapped) -- fields nested within one that is not indexed aren't
+// indexed either
+func (collection *collection) getFieldType(field string) string {
+
+	collection.mappingLock.RLock()
+	defer collection.mappingLock.RUnlock()
+
+	if fieldMapping, ok := collection.mapping.Fields[field]; ok {
+		return fieldMapping.Type
+	}
+
+	for parent := field; strings.Contains(parent, "."); {
+
+		parent = parent[:strings.LastIndex(parent, ".")]
+
+		if collection.mapping.Fields[parent].Type == "not_indexed" {
+			return "not_indexed"
+		}
+
+	}
+
+	return ""
+
+}
+
+// getFieldAnalyzer gets the analyzer that a field's text is broken into terms
+// with, which is the one named by the field's mapping, then the one named by
+// the collection's mapping and finally the default analyzer
+func (collection *collection) getFieldAnalyzer(field string) types.Analyzer {
+
+	collection.mappingLock.RLock()
+	defer collection.mappingLock.RUnlock()
+
+	name := collection.mapping.Fields[field].Analyzer
+
+	if name == "" {
+		name = collection.mapping.Analyzer
+	}
+
+	if analyzer, ok := collection.mapping.Analyzers[name]; ok {
+		return analyzer
+	}
+
+	if analyzer, ok := analysis.BuiltInAnalyzers[name]; ok {
+		return analyzer
+	}
+
+	return analysis.BuiltInAnalyzers[analysis.DefaultAnalyzer]
+
+}
+
+// isKnownAnalyzer checks whether an analyzer is either built in or defined by
+// a mapping
+func isKnownAnalyzer(mapping types.Mapping, name string) bool {
+
+	_, builtIn := analysis.BuiltInAnalyzers[name]
+	_, defined := mapping.Analyzers[name]
+
+	return builtIn || defined
+
+}
+
+// applyMapping replaces the mapping of the collection with the one held in a
+// journal entry if it is newer, and reindexes every document under it --
+// journalLock must be held by the caller
+func (collection *collection) applyMapping(entry types.JournalEntry) bool {
+
+	if entry.Sequence <= collection.mappingSequence {
+		return false
+	}
+
+	mapping, err := ParseMapping([]byte(entry.Document))
+
+	if err != nil {
+		return false
+	}
+
+	collection.mappingLock.Lock()
+	collection.mapping = mapping
+	collection.mappingSequence = entry.Sequence
+	collection.mappingLock.Unlock()
+
+	collection.documentsLock.RLock()
+
+	existingDocuments := map[string]types.DocumentIndex{}
+
+	for id, document := range collection.documents {
+		existingDocuments[id] = document
+	}
+
+	collection.documentsLock.RUnlock()
+
+	for id, document := range existingDocuments {
+		collection.removeDocument(id)
+		collection.indexDocument(id, document.Document, document.Sequence, document.Version)
+	}
+
+	return true
+
+}
+
+// isValidFieldValue checks whether a value is of the type a field is mapped
+// to, without any conversion
+func isValidFieldValue(fieldType string, value interface{}) bool {
+
+	switch fieldType {
+
+	case "keyword", "text":
+		_, ok := value.(string)
+		return ok
+
+	case "number":
+		_, ok := value.(float64)
+		return ok
+
+	case "date":
+		valueString, ok := value.(string)
+		_, isDate := parseDate(valueString)
+		return ok && isDate
+
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+
+	}
+
+	return true
+
+}
+
+// coerceFieldValue converts a value into the form in which it is indexed and
+// searched for as the type its field is mapped to, returning false if it
+// cannot be -- values of unmapped fields are left as they are
+func coerceFieldValue(fieldType string, value interface{}) (interface{}, bool) {
+
+	switch fieldType {
+
+	case "":
+		return value, true
+
+	case "keyword", "text":
+
+		switch typedValue := value.(type) {
+
+		case string:
+			return typedValue, true
+
+		case float64:
+			return strconv.FormatFloat(typedValue, 'f', -1, 64), true
+
+		case bool:
+			return strconv.FormatBool(typedValue), true
+
+		}
+
+	case "number":
+
+		switch typedValue := value.(type) {
+
+		case float64:
+			return typedValue, true
+
+		case string:
+			number, err := strconv.ParseFloat(strings.TrimSpace(typedValue), 64)
+			return number, err == nil
+
+		}
+
+	case "date":
+
+		// Dates are normalised so that the same moment matches however it
+		// was written
+		if valueString, ok := value.(string); ok {
+
+			if parsedTime, ok := parseDate(valueString); ok {
+				return parsedTime.UTC().Format(time.RFC3339Nano), true
+			}
+
+		}
+
+	case "boolean":
+
+		switch typedValue := value.(type) {
+
+		case bool:
+			return typedValue, true
+
+		case string:
+			boolean, err := strconv.ParseBool(strings.TrimSpace(typedValue))
+			return boolean, err == nil
+
+		}
+
+	}
+
+	return nil, false
+
+}
+
+// mapCriterion adapts a search criterion to the type its field is mapped to,
+// returning false if the criterion can never match any value
+func mapCriterion(fieldType string, searchType string, searchValue interface{}) (string, interface{}, bool) {
+
+	if fieldType == "" {
+		return searchType, searchValue, true
+	}
+
+	if fieldType == "not_indexed" {
+		return searchType, searchValue, false
+	}
+
+	// Only text fields are broken into phrases, so the values of other fields
+	// can only be matched in full
+	if fieldType != "text" && searchType == "contains" {
+		searchType = "equals"
+	}
+
+	if fieldType != "text" && searchType == "not_contains" {
+		searchType = "not_equals"
+	}
+
+	if fieldType != "text" && searchType == "match_phrase" {
+
+		phrase, _, err := parsePhraseCriterion(searchType, searchValue)
+
+		if err != nil {
+			return searchType, searchValue, false
+		}
+
+		searchType, searchValue = "equals", phrase
+
+	}
+
+	// Only strings are kept in the term dictionaries
+	if (isPatternSearchType(searchType) || searchType == "fuzzy") && fieldType != "keyword" && fieldType != "text" {
+		return searchType, searchValue, false
+	}
+
+	if isRangeSearchType(searchType) {
+
+		if fieldType != "number" && fieldType != "date" {
+			return searchType, searchValue, false
+		}
+
+		if bounds, ok := searchValue.([]interface{}); ok && searchType == "between" {
+
+			mappedBounds := []interface{}{}
+
+			for _, bound := range bounds {
+
+				mappedBound, ok := coerceFieldValue(fieldType, bound)
+
+				if ok == false {
+					return searchType, searchValue, false
+				}
+
+				mappedBounds = append(mappedBounds, mappedBound)
+
+			}
+
+			return searchType, mappedBounds, true
+
+		}
+
+	}
+
+	// Options given alongside a value (such as a phrase's slop) are left as
+	// they are
+	if _, ok := searchValue.(map[string]interface{}); ok {
+		return searchType, searchValue, true
+	}
+
+	mappedValue, ok := coerceFieldValue(fieldType, searchValue)
+
+	return searchType, mappedValue, ok
+
+}
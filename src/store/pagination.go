@@ -0,0 +1,235 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/crypt"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// The most scrolls that can be open at once on a node
+const maxOpenScrolls = 1000
+
+// The longest a scroll can be kept open between pages
+const maxScrollTTL = 24 * time.Hour
+
+// searchCursor points to a document in a sorted list of search results by the
+// values it was sorted by and its ID, so that the next page of results can
+// start after it
+type searchCursor struct {
+	Values []sortValue
+	ID     string
+}
+
+// scrollContext holds a snapshot of the documents matched by a search, in
+// order, so that they can be paged through while the index changes
+type scrollContext struct {
+	Collection string
+	Criteria   map[string][]interface{}
+	IDs        []string
+	Scores     map[string]float64
+	FuzzyTerms []matchedTerm
+	Highlight  *types.Highlight
+	Size       int
+	Position   int
+	ExpiresAt  time.Time
+}
+
+// Open scrolls, keyed by their IDs
+var scrolls = map[string]*scrollContext{}
+
+// scrollsLock allows locking of the scrolls map during reads/writes
+var scrollsLock = sync.Mutex{}
+
+// Encode a cursor pointing to a document as an opaque string
+func encodeSearchCursor(values []sortValue, id string) string {
+
+	encodedCursor, _ := json.Marshal(searchCursor{Values: values, ID: id})
+
+	return base64.RawURLEncoding.EncodeToString(encodedCursor)
+
+}
+
+// Decode a cursor handed out by a search, checking that it was made for a
+// search with the same number of sort fields
+func decodeSearchCursor(encodedCursor string, sortFieldCount int) (searchCursor, error) {
+
+	cursor := searchCursor{}
+	decodedCursor, err := base64.RawURLEncoding.DecodeString(encodedCursor)
+
+	if err == nil {
+		err = json.Unmarshal(decodedCursor, &cursor)
+	}
+
+	if err != nil || cursor.ID == "" {
+		return searchCursor{}, errors.New("The search_after cursor is not valid")
+	}
+
+	if len(cursor.Values) != sortFieldCount {
+		return searchCursor{}, errors.New("The search_after cursor was made for a different sort")
+	}
+
+	return cursor, nil
+
+}
+
+// ParseScrollTTL parses how long a scroll should be kept open for until its
+// next page is requested, given as a duration such as "30s" or "5m"
+func ParseScrollTTL(value string) (time.Duration, error) {
+
+	ttl, err := time.ParseDuration(value)
+
+	if err != nil || ttl <= 0 || ttl > maxScrollTTL {
+		return 0, errors.New("The scroll duration must be a positive duration of up to 24h, such as 30s or 5m")
+	}
+
+	return ttl, nil
+
+}
+
+// StartScroll searches a collection and keeps a snapshot of the matching
+// document IDs for a while, returning the scroll's ID, the total number of
+// matches and the first page of them
+func StartScroll(collectionName string, criteria map[string][]interface{}, size int, sortFields []types.SortField, highlight *types.Highlight, ttl time.Duration) (string, int, []jsonserver.JSON, error) {
+
+	collection := lookupCollection(collectionName)
+	ids, scores, _, _ := collection.findSortedIds(collectionName, criteria, sortFields)
+	scrollID, err := crypt.GenerateUUID()
+
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	context := &scrollContext{
+		Collection: collectionName,
+		Criteria:   criteria,
+		IDs:        ids,
+		Scores:     scores,
+		FuzzyTerms: collection.getFuzzyMatchedTerms(criteria),
+		Highlight:  highlight,
+		Size:       size,
+		ExpiresAt:  time.Now().Add(ttl)}
+
+	scrollsLock.Lock()
+
+	removeExpiredScrolls()
+
+	if len(scrolls) >= maxOpenScrolls {
+		scrollsLock.Unlock()
+		return "", 0, nil, errors.New("Too many scrolls are open")
+	}
+
+	scrolls[scrollID] = context
+	pageIds := context.nextPage()
+
+	scrollsLock.Unlock()
+
+	return scrollID, len(ids), context.getHits(pageIds), nil
+
+}
+
+// ContinueScroll gets the next page of a scroll's documents, keeping the
+// scroll open for a while longer
+func ContinueScroll(scrollID string, ttl time.Duration) (string, int, []jsonserver.JSON, error) {
+
+	scrollsLock.Lock()
+
+	removeExpiredScrolls()
+
+	context, ok := scrolls[scrollID]
+
+	if ok == false {
+		scrollsLock.Unlock()
+		return "", 0, nil, errors.New("Scroll does not exist or has expired")
+	}
+
+	context.ExpiresAt = time.Now().Add(ttl)
+	pageIds := context.nextPage()
+
+	scrollsLock.Unlock()
+
+	return context.Collection, len(context.IDs), context.getHits(pageIds), nil
+
+}
+
+// ClearScroll closes a scroll before it expires, returning false if it was
+// not open
+func ClearScroll(scrollID string) bool {
+
+	scrollsLock.Lock()
+	defer scrollsLock.Unlock()
+
+	_, ok := scrolls[scrollID]
+
+	delete(scrolls, scrollID)
+
+	return ok
+
+}
+
+// Remove the scrolls that have not been continued in time -- the scrolls map
+// must already be locked
+func removeExpiredScrolls() {
+
+	now := time.Now()
+
+	for scrollID, context := range scrolls {
+
+		if context.ExpiresAt.Before(now) {
+			delete(scrolls, scrollID)
+		}
+
+	}
+
+}
+
+// Take the IDs of the next page of a scroll's documents -- the scrolls map
+// must already be locked
+func (context *scrollContext) nextPage() []string {
+
+	start := context.Position
+	end := start + context.Size
+
+	if end > len(context.IDs) {
+		end = len(context.IDs)
+	}
+
+	if start > end {
+		start = end
+	}
+
+	context.Position = end
+
+	return context.IDs[start:end]
+
+}
+
+// Build the hits for a page of a scroll's documents, leaving out any that
+// have been removed since the scroll started
+func (context *scrollContext) getHits(ids []string) []jsonserver.JSON {
+
+	collection := lookupCollection(context.Collection)
+	result := []jsonserver.JSON{}
+
+	for _, id := range ids {
+
+		hit, err := collection.getHit(context.Collection, id, nil, context.Scores, context.FuzzyTerms)
+
+		if err == nil {
+			result = append(result, hit)
+		}
+
+	}
+
+	if context.Highlight != nil {
+		HighlightDocuments(context.Collection, context.Criteria, &result, *context.Highlight)
+	}
+
+	return result
+
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// Percolator queries are stored by collection, then by name
+var percolatorQueries = map[string]map[string]types.PercolatorQuery{}
+
+// percolatorQueriesLock allows locking of the percolator queries map during
+// reads/writes
+var percolatorQueriesLock = sync.RWMutex{}
+
+// getPercolatorFilePath gets the path to the file percolator queries are
+// saved in
+func getPercolatorFilePath() (string, error) {
+
+	baseDirectory, err := data.GetBaseDirectory()
+
+	if err != nil {
+		return "", err
+	}
+
+	return baseDirectory + "/.percolator", nil
+
+}
+
+// LoadPercolatorQueries loads the saved percolator queries into memory,
+// replacing any already loaded
+func LoadPercolatorQueries() error {
+
+	queries, err := readPercolatorFile()
+
+	if err != nil {
+		return err
+	}
+
+	percolatorQueriesLock.Lock()
+	percolatorQueries = queries
+	percolatorQueriesLock.Unlock()
+
+	return nil
+
+}
+
+// readPercolatorFile reads the saved percolator queries from disk -- there are
+// none if the file doesn't exist yet
+func readPercolatorFile() (map[string]map[string]types.PercolatorQuery, error) {
+
+	queries := map[string]map[string]types.PercolatorQuery{}
+	percolatorFilename, err := getPercolatorFilePath()
+
+	if err != nil {
+		return queries, err
+	}
+
+	percolatorFile, err := ioutil.ReadFile(percolatorFilename)
+
+	if os.IsNotExist(err) {
+		return queries, nil
+	}
+
+	if err != nil {
+		return queries, err
+	}
+
+	if err = json.Unmarshal(percolatorFile, &queries); err != nil {
+		return queries, errors.New("Percolator queries could not be read: " + err.Error())
+	}
+
+	return queries, nil
+
+}
+
+// writePercolatorFile saves percolator queries to disk, writing them to a
+// temporary file that is renamed into place so that nodes reading the file
+// never see it half written
+func writePercolatorFile(queries map[string]map[string]types.PercolatorQuery) error {
+
+	percolatorFilename, err := getPercolatorFilePath()
+
+	if err != nil {
+		return err
+	}
+
+	percolatorFile, err := json.Marshal(queries)
+
+	if err != nil {
+		return err
+	}
+
+	temporaryFilename := percolatorFilename + ".tmp"
+	temporaryFile, err := os.OpenFile(temporaryFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0600))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = temporaryFile.Write(percolatorFile)
+
+	if err == nil {
+		err = temporaryFile.Sync()
+	}
+
+	temporaryFile.Close()
+
+	if err == nil {
+		err = os.Rename(temporaryFilename, percolatorFilename)
+	}
+
+	if err != nil {
+		os.Remove(temporaryFilename)
+	}
+
+	return err
+
+}
+
+// updatePercolatorFile makes a change to the saved percolator queries and
+// loads the result into memory -- the file is locked against every node
+// sharing the base directory and re-read before the change is made, so that
+// changes made by other nodes in the meantime are kept, and it is only
+// rewritten if the change reports that it changed anything
+func updatePercolatorFile(change func(queries map[string]map[string]types.PercolatorQuery) bool) (bool, error) {
+
+	percolatorFilename, err := getPercolatorFilePath()
+
+	if err != nil {
+		return false, err
+	}
+
+	lockFile, err := os.OpenFile(percolatorFilename+".lock", os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+
+	if err != nil {
+		return false, err
+	}
+
+	defer lockFile.Close()
+
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return false, err
+	}
+
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	percolatorQueriesLock.Lock()
+	defer percolatorQueriesLock.Unlock()
+
+	queries, err := readPercolatorFile()
+
+	if err != nil {
+		return false, err
+	}
+
+	changed := change(queries)
+
+	if changed {
+
+		if err = writePercolatorFile(queries); err != nil {
+			return false, err
+		}
+
+	}
+
+	percolatorQueries = queries
+
+	return changed, nil
+
+}
+
+// ValidatePercolatorQuery checks that a percolator query can be evaluated and
+// that any webhook it has is an HTTP(S) URL
+func ValidatePercolatorQuery(query types.PercolatorQuery) error {
+
+	if err := ValidateCriteria(query.Criteria); err != nil {
+		return err
+	}
+
+	if query.Webhook != "" {
+
+		webhookURL, err := url.Parse(query.Webhook)
+
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+			return errors.New("The webhook must be an HTTP or HTTPS URL")
+		}
+
+	}
+
+	return nil
+
+}
+
+// SavePercolatorQuery registers a percolator query, replacing any with the
+// same name in the same collection, and saves it to disk
+func SavePercolatorQuery(query types.PercolatorQuery) error {
+
+	if err := ValidatePercolatorQuery(query); err != nil {
+		return err
+	}
+
+	_, err := updatePercolatorFile(func(queries map[string]map[string]types.PercolatorQuery) bool {
+
+		if _, ok := queries[query.Collection]; ok == false {
+			queries[query.Collection] = map[string]types.PercolatorQuery{}
+		}
+
+		queries[query.Collection][query.Name] = query
+
+		return true
+
+	})
+
+	return err
+
+}
+
+// DeletePercolatorQuery removes a percolator query, returning false if it did
+// not exist
+func DeletePercolatorQuery(collectionName string, name string) (bool, error) {
+
+	return updatePercolatorFile(func(queries map[string]map[string]types.PercolatorQuery) bool {
+
+		if _, ok := queries[collectionName][name]; ok == false {
+			return false
+		}
+
+		delete(queries[collectionName], name)
+
+		if len(queries[collectionName]) == 0 {
+			delete(queries, collectionName)
+		}
+
+		return true
+
+	})
+
+}
+
+// GetPercolatorQuery gets a percolator query by its name
+func GetPercolatorQuery(collectionName string, name string) (types.PercolatorQuery, bool) {
+
+	percolatorQueriesLock.RLock()
+	defer percolatorQueriesLock.RUnlock()
+
+	query, ok := percolatorQueries[collectionName][name]
+
+	return query, ok
+
+}
+
+// GetPercolatorQueries gets every percolator query registered against a
+// collection, in order of their names
+func GetPercolatorQueries(collectionName string) []types.PercolatorQuery {
+
+	percolatorQueriesLock.RLock()
+
+	result := []types.PercolatorQuery{}
+
+	for _, query := range percolatorQueries[collectionName] {
+		result = append(result, query)
+	}
+
+	percolatorQueriesLock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+
+}
+
+// PercolateDocument gets the percolator queries registered against a
+// collection that a document matches, in order of their names
+func PercolateDocument(collectionName string, id string, document []byte) []types.PercolatorQuery {
+
+	result := []types.PercolatorQuery{}
+	queries := GetPercolatorQueries(collectionName)
+
+	if len(queries) == 0 {
+		return result
+	}
+
+	// The document is only indexed once, however many queries there are
+	scratchCollection, ok := newScratchCollection(collectionName, id, document)
+
+	if ok == false {
+		return result
+	}
+
+	for _, query := range queries {
+
+		if scratchCollection.matchesCriteria(id, query.Criteria) {
+			result = append(result, query)
+		}
+
+	}
+
+	return result
+
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// Build a percolator query matching documents with a name
+func testPercolatorQuery(name string) types.PercolatorQuery {
+
+	return types.PercolatorQuery{Name: name, Collection: "percolated", Criteria: map[string][]interface{}{"and": {map[string]interface{}{"equals": map[string]interface{}{"name": name}}}}}
+
+}
+
+func TestSavePercolatorQueryKeepsQueriesSavedByOtherNodes(t *testing.T) {
+
+	if err := SavePercolatorQuery(testPercolatorQuery("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node sharing the base directory saves a query of its own
+	otherQueries, err := readPercolatorFile()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherQueries["percolated"]["other"] = testPercolatorQuery("other")
+
+	if err := writePercolatorFile(otherQueries); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SavePercolatorQuery(testPercolatorQuery("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	savedQueries, err := readPercolatorFile()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"first", "other", "second"} {
+
+		if _, ok := savedQueries["percolated"][name]; ok == false {
+			t.Fatalf("Expected '%s' to have been saved, got %v", name, savedQueries)
+		}
+
+		if _, ok := GetPercolatorQuery("percolated", name); ok == false {
+			t.Fatalf("Expected '%s' to have been loaded", name)
+		}
+
+	}
+
+	if deleted, err := DeletePercolatorQuery("percolated", "other"); err != nil || deleted == false {
+		t.Fatalf("Expected 'other' to have been deleted (error %v)", err)
+	}
+
+	if deleted, err := DeletePercolatorQuery("percolated", "other"); err != nil || deleted {
+		t.Fatalf("Expected 'other' to have already been deleted (error %v)", err)
+	}
+
+}
+
+func TestLoadPercolatorQueriesKeepsQueriesWhenFileIsUnreadable(t *testing.T) {
+
+	if err := SavePercolatorQuery(testPercolatorQuery("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	percolatorFilename, _ := getPercolatorFilePath()
+
+	if err := ioutil.WriteFile(percolatorFilename, []byte(`{"percolated": {"kept": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadPercolatorQueries(); err == nil {
+		t.Fatal("Expected the truncated file to fail to load")
+	}
+
+	if _, ok := GetPercolatorQuery("percolated", "kept"); ok == false {
+		t.Fatal("Expected the loaded queries to have been kept")
+	}
+
+	if err := SavePercolatorQuery(testPercolatorQuery("refused")); err == nil {
+		t.Fatal("Expected saving over the unreadable file to fail")
+	}
+
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/D-L-M/mem-db/src/analysis"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+)
+
+// isPhraseSearchType checks whether a criterion type is evaluated against the
+// positions of terms within fields
+func isPhraseSearchType(searchType string) bool {
+
+	switch searchType {
+
+	case "contains", "not_contains", "match_phrase":
+		return true
+
+	}
+
+	return false
+
+}
+
+// parsePhraseCriterion gets the phrase a criterion searches for and its slop,
+// which is how far its terms can be moved from where the phrase puts them --
+// match_phrase criteria can give either a phrase or an object holding the
+// phrase as its query and the slop, and any other criteria match exactly
+func parsePhraseCriterion(searchType string, value interface{}) (string, int, error) {
+
+	if phrase, ok := value.(string); ok {
+		return phrase, 0, nil
+	}
+
+	options, ok := value.(map[string]interface{})
+
+	if searchType != "match_phrase" || ok == false {
+		return "", 0, errors.New("The phrase must be a string")
+	}
+
+	phrase, ok := options["query"].(string)
+
+	if ok == false {
+		return "", 0, errors.New("The phrase must be given as a string query")
+	}
+
+	slop := 0
+
+	if slopValue, ok := options["slop"]; ok {
+
+		slopFloat, ok := slopValue.(float64)
+
+		if ok == false || slopFloat < 0 || slopFloat != float64(int(slopFloat)) {
+			return "", 0, errors.New("The slop must be a whole number of at least 0")
+		}
+
+		slop = int(slopFloat)
+
+	}
+
+	return phrase, slop, nil
+
+}
+
+// getPhraseKeyHashes breaks a phrase into terms with an analyzer and gets the
+// lookup key hash of each of them within a field
+func getPhraseKeyHashes(analyzer types.Analyzer, field string, phrase string) []string {
+
+	keyHashes := []string{}
+	_, terms := analysis.GetTerms(analyzer, phrase)
+
+	for _, term := range terms {
+
+		keyHash, err := generateKeyHash(field, term, "partial")
+
+		if err == nil {
+			keyHashes = append(keyHashes, keyHash)
+		}
+
+	}
+
+	return keyHashes
+
+}
+
+// Search for document IDs with a field holding a phrase -- the documents
+// holding every term of the phrase are found from the lookups, and then
+// narrowed down to those holding the terms in the right positions
+func (collection *collection) searchPhrase(searchType string, field string, value interface{}) []string {
+
+	result := []string{}
+	phrase, slop, err := parsePhraseCriterion(searchType, value)
+
+	if err != nil {
+		return result
+	}
+
+	keyHashes := getPhraseKeyHashes(collection.getFieldAnalyzer(field), field, phrase)
+
+	if len(keyHashes) == 0 {
+		return result
+	}
+
+	collection.lookupsLock.RLock()
+
+	termIds := [][]string{}
+
+	for _, keyHash := range keyHashes {
+		termIds = append(termIds, collection.lookups[keyHash])
+	}
+
+	candidateIds := utils.StringSliceIntersection(termIds)
+
+	collection.lookupsLock.RUnlock()
+
+	collection.documentsLock.RLock()
+
+	for _, id := range candidateIds {
+
+		positions := collection.documents[id].Fields[field].Positions
+		termPositions := [][]int{}
+
+		for _, keyHash := range keyHashes {
+			termPositions = append(termPositions, positions[keyHash])
+		}
+
+		if matchesPhrase(termPositions, slop) {
+			result = append(result, id)
+		}
+
+	}
+
+	collection.documentsLock.RUnlock()
+
+	// If the match is exclusive, build up a list of IDs without the phrase
+	if searchType == "not_contains" {
+
+		exclusiveIds := []string{}
+
+		collection.allIdsLock.RLock()
+
+		for _, singleID := range collection.allIds {
+
+			if utils.StringInSlice(singleID, result) == false {
+				exclusiveIds = append(exclusiveIds, singleID)
+			}
+
+		}
+
+		collection.allIdsLock.RUnlock()
+
+		return exclusiveIds
+
+	}
+
+	return result
+
+}
+
+// matchesPhrase checks whether the terms of a phrase, given the positions at
+// which each of them occurs in a field, can be found close enough together --
+// each occurrence is offset by the term's place in the phrase so that an exact
+// phrase lines up on a single offset, and the spread of the closest offsets
+// that can be chosen for every term must then be within the slop
+func matchesPhrase(termPositions [][]int, slop int) bool {
+
+	pointers := make([]int, len(termPositions))
+
+	for _, positions := range termPositions {
+
+		if len(positions) == 0 {
+			return false
+		}
+
+	}
+
+	// Repeatedly move on from whichever term has the smallest offset, which
+	// finds the smallest spread of offsets covering every term
+	for {
+
+		lowestTerm, lowestOffset, highestOffset := 0, 0, 0
+
+		for i, positions := range termPositions {
+
+			offset := positions[pointers[i]] - i
+
+			if i == 0 || offset < lowestOffset {
+				lowestTerm, lowestOffset = i, offset
+			}
+
+			if i == 0 || offset > highestOffset {
+				highestOffset = offset
+			}
+
+		}
+
+		if highestOffset-lowestOffset <= slop {
+			return true
+		}
+
+		pointers[lowestTerm]++
+
+		if pointers[lowestTerm] == len(termPositions[lowestTerm]) {
+			return false
+		}
+
+	}
+
+}
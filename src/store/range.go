@@ -0,0 +1,210 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// rangeEntry pairs an orderable value with the ID of the document it was
+// found in
+type rangeEntry struct {
+	Value float64
+	ID    string
+}
+
+// Check whether a range entry comes before another, ordering entries by their
+// values and then by their document IDs
+func rangeEntryLess(a interface{}, b interface{}) bool {
+
+	entryA, entryB := a.(rangeEntry), b.(rangeEntry)
+
+	return entryA.Value < entryB.Value || (entryA.Value == entryB.Value && entryA.ID < entryB.ID)
+
+}
+
+// getOrderableValue converts a number or an RFC 3339 date string into a float
+// that can be stored in an ordered index, along with the kind of value it was
+func getOrderableValue(value interface{}) (float64, string, bool) {
+
+	switch typedValue := value.(type) {
+
+	case float64:
+		return typedValue, "number", true
+
+	case string:
+
+		if parsedTime, ok := parseDate(typedValue); ok {
+			return float64(parsedTime.Unix()) + (float64(parsedTime.Nanosecond()) / float64(time.Second)), "date", true
+		}
+
+	}
+
+	return 0, "", false
+
+}
+
+// parseDate parses an RFC 3339 date string or a plain YYYY-MM-DD date
+func parseDate(value string) (time.Time, bool) {
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+
+		parsedTime, err := time.Parse(layout, value)
+
+		if err == nil {
+			return parsedTime, true
+		}
+
+	}
+
+	return time.Time{}, false
+
+}
+
+// Get the key under which a field's ordered values are stored
+func getRangeKey(key string, kind string) string {
+
+	return kind + ":" + key
+
+}
+
+// If a value for a field is orderable, insert it into the field's ordered
+// index against a document ID
+func (collection *collection) storeRangeValue(id string, key string, value interface{}) (types.RangeKey, error) {
+
+	orderableValue, kind, ok := getOrderableValue(value)
+
+	if ok == false {
+		return types.RangeKey{}, errors.New("The value is not orderable")
+	}
+
+	rangeKey := getRangeKey(key, kind)
+
+	collection.rangesLock.Lock()
+	defer collection.rangesLock.Unlock()
+
+	entries, ok := collection.ranges[rangeKey]
+
+	if ok == false {
+		entries = newSkipList(rangeEntryLess)
+		collection.ranges[rangeKey] = entries
+	}
+
+	if entries.insert(rangeEntry{Value: orderableValue, ID: id}) == false {
+		return types.RangeKey{}, errors.New("The range value has already been stored")
+	}
+
+	return types.RangeKey{Key: rangeKey, Value: orderableValue}, nil
+
+}
+
+// Remove a document's value from a field's ordered index
+func (collection *collection) removeRangeValue(id string, rangeKey types.RangeKey) {
+
+	collection.rangesLock.Lock()
+	defer collection.rangesLock.Unlock()
+
+	entries, ok := collection.ranges[rangeKey.Key]
+
+	if ok && entries.remove(rangeEntry{Value: rangeKey.Value, ID: id}) {
+
+		// Also remove the whole ordered index if it's now empty
+		if entries.length == 0 {
+			delete(collection.ranges, rangeKey.Key)
+		}
+
+	}
+
+}
+
+// isRangeSearchType checks whether a criterion type is evaluated against the
+// ordered indices
+func isRangeSearchType(searchType string) bool {
+
+	switch searchType {
+
+	case "gt", "gte", "lt", "lte", "between":
+		return true
+
+	}
+
+	return false
+
+}
+
+// Search for document IDs whose value for a field falls within a range
+func (collection *collection) searchRange(searchType string, key string, value interface{}) []string {
+
+	result := []string{}
+	lowerValue, upperValue := value, value
+
+	// Between criteria take an inclusive [lower, upper] pair
+	if searchType == "between" {
+
+		bounds, ok := value.([]interface{})
+
+		if ok == false || len(bounds) != 2 {
+			return result
+		}
+
+		lowerValue, upperValue = bounds[0], bounds[1]
+
+	}
+
+	lower, lowerKind, lowerOk := getOrderableValue(lowerValue)
+	upper, upperKind, upperOk := getOrderableValue(upperValue)
+
+	if lowerOk == false || upperOk == false || lowerKind != upperKind {
+		return result
+	}
+
+	// Entries are read from the first one after the lower bound until the
+	// first one after the upper bound
+	isAfterLower := func(entry rangeEntry) bool { return true }
+	isBeforeUpper := func(entry rangeEntry) bool { return true }
+
+	switch searchType {
+
+	case "gt":
+		isAfterLower = func(entry rangeEntry) bool { return entry.Value > lower }
+
+	case "gte":
+		isAfterLower = func(entry rangeEntry) bool { return entry.Value >= lower }
+
+	case "lt":
+		isBeforeUpper = func(entry rangeEntry) bool { return entry.Value < upper }
+
+	case "lte":
+		isBeforeUpper = func(entry rangeEntry) bool { return entry.Value <= upper }
+
+	case "between":
+		isAfterLower = func(entry rangeEntry) bool { return entry.Value >= lower }
+		isBeforeUpper = func(entry rangeEntry) bool { return entry.Value <= upper }
+
+	}
+
+	collection.rangesLock.RLock()
+	defer collection.rangesLock.RUnlock()
+
+	entries := collection.ranges[getRangeKey(key, lowerKind)]
+	start := entries.seek(func(item interface{}) bool { return isAfterLower(item.(rangeEntry)) })
+
+	// Array fields can hold several matching values for the same document, so
+	// deduplicate the IDs
+	seenIds := map[string]bool{}
+
+	for node := start; node != nil && isBeforeUpper(node.item.(rangeEntry)); node = node.next[0] {
+
+		entry := node.item.(rangeEntry)
+
+		if seenIds[entry.ID] == false {
+			seenIds[entry.ID] = true
+			result = append(result, entry.ID)
+		}
+
+	}
+
+	return result
+
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// Sort a list of IDs so that search results can be compared
+func sortedTestIds(ids []string) []string {
+
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+
+	return sorted
+
+}
+
+func TestSearchRangeMatchesEveryValueInRange(t *testing.T) {
+
+	collection := newCollection()
+	values := map[string]float64{}
+
+	// Enough values that inserting each into a sorted slice would be slow
+	for i := 0; i < 200000; i++ {
+
+		id := strconv.Itoa(i)
+		values[id] = float64(rand.Intn(1000000))
+
+		if _, err := collection.storeRangeValue(id, "size", values[id]); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	// Take every other document back out
+	for i := 0; i < 200000; i += 2 {
+
+		id := strconv.Itoa(i)
+		rangeKey, _ := collection.storeRangeValue(id, "size", values[id])
+
+		if rangeKey.Key != "" {
+			t.Fatalf("Expected the value of '%s' to have already been stored", id)
+		}
+
+		collection.removeRangeValue(id, types.RangeKey{Key: getRangeKey("size", "number"), Value: values[id]})
+		delete(values, id)
+
+	}
+
+	for _, criterion := range []struct {
+		searchType string
+		value      interface{}
+		matches    func(value float64) bool
+	}{
+		{"gt", float64(500000), func(value float64) bool { return value > 500000 }},
+		{"gte", float64(500000), func(value float64) bool { return value >= 500000 }},
+		{"lt", float64(1000), func(value float64) bool { return value < 1000 }},
+		{"lte", float64(1000), func(value float64) bool { return value <= 1000 }},
+		{"between", []interface{}{float64(250000), float64(250500)}, func(value float64) bool { return value >= 250000 && value <= 250500 }},
+	} {
+
+		expected := []string{}
+
+		for id, value := range values {
+
+			if criterion.matches(value) {
+				expected = append(expected, id)
+			}
+
+		}
+
+		actual := sortedTestIds(collection.searchRange(criterion.searchType, "size", criterion.value))
+		expected = sortedTestIds(expected)
+
+		if len(actual) != len(expected) {
+			t.Fatalf("Expected %d matches for %s, got %d", len(expected), criterion.searchType, len(actual))
+		}
+
+		for i := range expected {
+
+			if actual[i] != expected[i] {
+				t.Fatalf("Expected %s to match %v, got %v", criterion.searchType, expected, actual)
+			}
+
+		}
+
+	}
+
+}
+
+func TestSearchRangeOrdersDates(t *testing.T) {
+
+	collection := newCollection()
+
+	for id, value := range map[string]string{"new": "2020-01-02", "old": "2019-12-31T23:59:59Z", "same": "2020-01-01T01:00:00+01:00"} {
+		collection.storeRangeValue(id, "joined", value)
+	}
+
+	actual := sortedTestIds(collection.searchRange("lte", "joined", "2020-01-01"))
+
+	if len(actual) != 2 || actual[0] != "old" || actual[1] != "same" {
+		t.Fatalf("Expected 'old' and 'same' to be on or before 2020-01-01, got %v", actual)
+	}
+
+	if len(collection.searchRange("gt", "missing", float64(1))) != 0 {
+		t.Fatal("Expected a field without values to match nothing")
+	}
+
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"math"
+	"strings"
+)
+
+// BM25 tuning parameters -- k1 controls how quickly repeated terms stop adding
+// to a score and b controls how much longer fields are penalised
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// fieldLengthTotal keeps a running total of the words held in a field across
+// every document that has it
+type fieldLengthTotal struct {
+	Words     int
+	Documents int
+}
+
+// scoringTerm is a term from a contains or match_phrase criterion that
+// contributes to the relevance score of matching documents
+type scoringTerm struct {
+	Field   string
+	KeyHash string
+}
+
+// Add a document's field lengths to the running totals
+func (collection *collection) addFieldLengths(fieldLengths map[string]int) {
+
+	collection.fieldLengthTotalsLock.Lock()
+	defer collection.fieldLengthTotalsLock.Unlock()
+
+	for field, length := range fieldLengths {
+
+		total := collection.fieldLengthTotals[field]
+		total.Words += length
+		total.Documents++
+		collection.fieldLengthTotals[field] = total
+
+	}
+
+}
+
+// Remove a document's field lengths from the running totals
+func (collection *collection) removeFieldLengths(fieldLengths map[string]int) {
+
+	collection.fieldLengthTotalsLock.Lock()
+	defer collection.fieldLengthTotalsLock.Unlock()
+
+	for field, length := range fieldLengths {
+
+		total := collection.fieldLengthTotals[field]
+		total.Words -= length
+		total.Documents--
+
+		if total.Documents <= 0 {
+			delete(collection.fieldLengthTotals, field)
+		} else {
+			collection.fieldLengthTotals[field] = total
+		}
+
+	}
+
+}
+
+// Collect the terms of all contains and match_phrase criteria in a set of
+// criteria, however deeply they are nested
+func (collection *collection) getScoringTerms(criteria map[string][]interface{}) []scoringTerm {
+
+	result := []scoringTerm{}
+
+	for _, groupCriteria := range criteria {
+
+		for _, criterion := range groupCriteria {
+
+			remappedCriterion, ok := criterion.(map[string]interface{})
+
+			if ok == false {
+				continue
+			}
+
+			for criterionType, criterionValue := range remappedCriterion {
+
+				// Nested AND/OR criteria
+				if strings.ToLower(criterionType) == "and" || strings.ToLower(criterionType) == "or" {
+
+					if nestedCriteria, ok := criterionValue.([]interface{}); ok {
+						result = append(result, collection.getScoringTerms(map[string][]interface{}{criterionType: nestedCriteria})...)
+					}
+
+					continue
+
+				}
+
+				if criterionType != "contains" && criterionType != "match_phrase" {
+					continue
+				}
+
+				if fieldValues, ok := criterionValue.(map[string]interface{}); ok {
+
+					for field, value := range fieldValues {
+
+						phrase, _, err := parsePhraseCriterion(criterionType, value)
+
+						if err != nil {
+							continue
+						}
+
+						// Each term of a phrase adds to the score separately
+						for _, keyHash := range getPhraseKeyHashes(collection.getFieldAnalyzer(field), field, phrase) {
+							result = append(result, scoringTerm{Field: field, KeyHash: keyHash})
+						}
+
+					}
+
+				}
+
+			}
+
+		}
+
+	}
+
+	return result
+
+}
+
+// Score a set of documents against the phrase criteria of a search using
+// BM25, returning nil if the criteria have nothing to score on
+func (collection *collection) scoreDocuments(criteria map[string][]interface{}, ids []string) map[string]float64 {
+
+	terms := collection.getScoringTerms(criteria)
+
+	if len(terms) == 0 {
+		return nil
+	}
+
+	collection.documentsLock.RLock()
+	collection.lookupsLock.RLock()
+	collection.fieldLengthTotalsLock.RLock()
+
+	defer collection.documentsLock.RUnlock()
+	defer collection.lookupsLock.RUnlock()
+	defer collection.fieldLengthTotalsLock.RUnlock()
+
+	scores := map[string]float64{}
+	documentCount := float64(len(collection.documents))
+
+	for _, id := range ids {
+
+		document := collection.documents[id]
+		score := 0.0
+
+		for _, term := range terms {
+
+			termFrequency := float64(document.Fields[term.Field].TermFrequencies[term.KeyHash])
+
+			if termFrequency == 0 {
+				continue
+			}
+
+			// Rarer terms are worth more
+			documentFrequency := float64(len(collection.lookups[term.KeyHash]))
+			inverseDocumentFrequency := math.Log(1 + ((documentCount - documentFrequency + 0.5) / (documentFrequency + 0.5)))
+
+			// Matches in shorter-than-average fields are worth more
+			fieldLength := float64(document.Fields[term.Field].Length)
+			averageFieldLength := 1.0
+
+			if total := collection.fieldLengthTotals[term.Field]; total.Documents > 0 {
+				averageFieldLength = float64(total.Words) / float64(total.Documents)
+			}
+
+			normalisation := 1 - bm25B + (bm25B * (fieldLength / averageFieldLength))
+			score += inverseDocumentFrequency * ((termFrequency * (bm25K1 + 1)) / (termFrequency + (bm25K1 * normalisation)))
+
+		}
+
+		scores[id] = score
+
+	}
+
+	return scores
+
+}
@@ -1,14 +1,16 @@
 package store
 
 import (
+	"errors"
 	"reflect"
 	"sort"
 	"strings"
 
 	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/analysis"
 	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/types"
 	"github.com/D-L-M/mem-db/src/utils"
-	"github.com/kljensen/snowball"
 )
 
 // significantTermsSort is a custom sorting algorithm for significant terms --
@@ -41,10 +43,16 @@ func (significantTerms significantTermsSort) Less(i, j int) bool {
 
 }
 
+// The most words that a significant term can be made up of
+const significantTermWordLimit = 3
+
 // DiscoverSignificantTerms returns a slice of significant terms discovered in
 // a specific field of a slice of documents, compared to the rest of the index
-func DiscoverSignificantTerms(targetedDocuments *[]jsonserver.JSON, field string, percentageThreshold int, minimumOccurrences float64) []map[string]interface{} {
+// of the collection they came from
+func DiscoverSignificantTerms(collectionName string, targetedDocuments *[]jsonserver.JSON, field string, percentageThreshold int, minimumOccurrences float64) []map[string]interface{} {
 
+	collection := lookupCollection(collectionName)
+	analyzer := collection.getFieldAnalyzer(field)
 	collectedFragmentHashes := map[string]string{}
 	fragmentHashCounts := map[string]int{}
 	result := []map[string]interface{}{}
@@ -52,7 +60,7 @@ func DiscoverSignificantTerms(targetedDocuments *[]jsonserver.JSON, field string
 	// Get counts from the documents provided
 	for _, document := range *targetedDocuments {
 
-		termFragments, err := getTermFragmentHashesForDocumentField(document["document"].(jsonserver.JSON), field, true, false)
+		termFragments, err := getTermFragmentHashesForDocumentField(document["document"].(jsonserver.JSON), field, analyzer, true, false)
 
 		if err != nil {
 			continue
@@ -65,10 +73,14 @@ func DiscoverSignificantTerms(targetedDocuments *[]jsonserver.JSON, field string
 
 	}
 
+	collection.documentsLock.RLock()
+	collectionDocumentCount := len(collection.documents)
+	collection.documentsLock.RUnlock()
+
 	// Compare against the rest of the index
 	for hashedTerm, hashTermCount := range fragmentHashCounts {
 
-		if utils.StringInSlice(collectedFragmentHashes[hashedTerm], data.StopWords) {
+		if isSignificantTermStopWord(analyzer, collectedFragmentHashes[hashedTerm]) {
 			continue
 		}
 
@@ -80,8 +92,18 @@ func DiscoverSignificantTerms(targetedDocuments *[]jsonserver.JSON, field string
 			continue
 		}
 
+		// Only single terms have lookups of their own, so the documents
+		// holding phrases have to be searched for
+		collection.lookupsLock.RLock()
+		comparisonDocumentCount := len(collection.lookups[hashedTerm])
+		collection.lookupsLock.RUnlock()
+
+		if strings.Contains(collectedFragmentHashes[hashedTerm], " ") {
+			comparisonDocumentCount = len(collection.searchPhrase("contains", field, collectedFragmentHashes[hashedTerm]))
+		}
+
 		targetedFrequencyPerDocument := (float64(hashTermCount) / float64(len(*targetedDocuments)))
-		comparisonFrequencyPerDocument := (float64(len(lookups[hashedTerm])) / float64(len(documents)))
+		comparisonFrequencyPerDocument := (float64(comparisonDocumentCount) / float64(collectionDocumentCount))
 
 		if ((targetedFrequencyPerDocument / comparisonFrequencyPerDocument) * 100) >= float64(percentageThreshold) {
 			result = append(result, map[string]interface{}{"term": collectedFragmentHashes[hashedTerm], "doc_count": hashTermCount})
@@ -95,9 +117,47 @@ func DiscoverSignificantTerms(targetedDocuments *[]jsonserver.JSON, field string
 
 }
 
+// Check whether a term is too common to be significant, which is when it is
+// a stop word of the analyzer it was found with (or of English, if the
+// analyzer doesn't remove stop words)
+func isSignificantTermStopWord(analyzer types.Analyzer, term string) bool {
+
+	if analyzer.StopWords == "" {
+		return utils.StringInSlice(term, data.StopWords)
+	}
+
+	return analysis.IsStopWord(analyzer, term)
+
+}
+
+// Break text into the phrases of up to a few consecutive terms that can be
+// significant, both as they were written and as terms
+func getSignificantTermPhrases(analyzer types.Analyzer, text string) ([]string, []string) {
+
+	plainTokens, terms := analysis.GetTerms(analyzer, text)
+	plainResult := []string{}
+	termResult := []string{}
+
+	// Build up a list of phrases, starting at one word each and building to
+	// the phrase word limit
+	for i := 1; i <= significantTermWordLimit; i++ {
+
+		for j := 0; j <= (len(terms) - i); j++ {
+
+			plainResult = append(plainResult, strings.Join(plainTokens[j:(j+i)], " "))
+			termResult = append(termResult, strings.Join(terms[j:(j+i)], " "))
+
+		}
+
+	}
+
+	return plainResult, termResult
+
+}
+
 // Get the hashes and plain forms of all terms for a specific field in a
-// document
-func getTermFragmentHashesForDocumentField(document jsonserver.JSON, field string, stemHash bool, stemValue bool) (map[string]string, error) {
+// document, as broken up by an analyzer
+func getTermFragmentHashesForDocumentField(document jsonserver.JSON, field string, analyzer types.Analyzer, stemHash bool, stemValue bool) (map[string]string, error) {
 
 	result := map[string]string{}
 	flattenedObject := utils.FlattenDocumentToDotNotation(document)
@@ -110,7 +170,7 @@ func getTermFragmentHashesForDocumentField(document jsonserver.JSON, field strin
 
 			if valueString, ok := fieldValue.(string); ok {
 
-				valueWords, stemmedValueWords := utils.GetPhrasesFromString(valueString)
+				valueWords, stemmedValueWords := getSignificantTermPhrases(analyzer, valueString)
 
 				for i, valueWord := range valueWords {
 
@@ -146,8 +206,16 @@ func getTermFragmentHashesForDocumentField(document jsonserver.JSON, field strin
 
 }
 
+// Generate the lookup key hash that a single criterion's key and whole value
+// would have been indexed under
+func getCriterionKeyHash(searchKey string, searchValue interface{}) (string, error) {
+
+	return generateKeyHash(searchKey, searchValue, "full")
+
+}
+
 // Search for documents matching a single criterion
-func searchCriterion(criterion map[string]interface{}) []string {
+func (collection *collection) searchCriterion(criterion map[string]interface{}) []string {
 
 	result := []string{}
 
@@ -157,59 +225,63 @@ func searchCriterion(criterion map[string]interface{}) []string {
 
 			for searchKey, searchValue := range remappedSearchCriterion {
 
-				// Figure out what kind of search to do
-				searchTypeName := "full"
+				// Adapt the criterion to the type the field is mapped to, so
+				// that it is searched for the same way it was indexed
+				searchType, searchValue, ok := mapCriterion(collection.getFieldType(searchKey), searchType, searchValue)
 
-				if searchType == "contains" || searchType == "not_contains" {
-					searchTypeName = "partial"
+				// A criterion that can never match a value matches every
+				// document when it is negated
+				if ok == false && (searchType == "not_equals" || searchType == "not_contains") {
+					return collection.getAllIds()
 				}
 
-				// If the value is a string, lowercase it
-				if valueString, ok := searchValue.(string); ok {
-					searchValue = strings.ToLower(valueString)
+				if ok == false {
+					return result
 				}
 
-				// Stem words for partial matches
-				if searchType == "contains" || searchType == "not_contains" {
-
-					partialWords := strings.Split(utils.PadPunctuationWithSpaces(searchValue.(string)), " ")
-					stemmedPhrase := []string{}
-
-					for _, partialWord := range partialWords {
-
-						stemmedWord, err := snowball.Stem(partialWord, "english", true)
-
-						if err == nil && stemmedWord != "" {
-							stemmedPhrase = append(stemmedPhrase, stemmedWord)
-						}
+				// Ranges are resolved from the ordered indices rather than
+				// the lookups
+				if isRangeSearchType(searchType) {
+					return collection.searchRange(searchType, searchKey, searchValue)
+				}
 
-					}
+				// Phrases are resolved from the positions of their terms
+				if isPhraseSearchType(searchType) {
+					return collection.searchPhrase(searchType, searchKey, searchValue)
+				}
 
-					searchValue = strings.Join(stemmedPhrase, " ")
+				// Prefixes and patterns are resolved from the term
+				// dictionaries
+				if isPatternSearchType(searchType) {
+					return collection.searchPattern(searchType, searchKey, searchValue)
+				}
 
+				// Fuzzy terms are resolved from the term dictionaries too
+				if searchType == "fuzzy" {
+					return collection.searchFuzzy(searchKey, searchValue)
 				}
 
 				// Generate a key hash for the criterion and return any document
 				// IDs that have been stored against it
-				keyHash, err := generateKeyHash(searchKey, searchValue, searchTypeName)
+				keyHash, err := getCriterionKeyHash(searchKey, searchValue)
 
 				if err == nil {
 
-					lookupsLock.RLock()
+					collection.lookupsLock.RLock()
 
-					if documentIds, ok := lookups[keyHash]; ok {
+					if documentIds, ok := collection.lookups[keyHash]; ok {
 
-						lookupsLock.RUnlock()
+						collection.lookupsLock.RUnlock()
 
 						// If the match is exclusive, build up a list of IDs not
 						// found by the lookup
-						if searchType == "not_equals" || searchType == "not_contains" {
+						if searchType == "not_equals" {
 
 							exclusiveIds := []string{}
 
-							allIdsLock.RLock()
+							collection.allIdsLock.RLock()
 
-							for _, singleID := range allIds {
+							for _, singleID := range collection.allIds {
 
 								if utils.StringInSlice(singleID, documentIds) == false {
 									exclusiveIds = append(exclusiveIds, singleID)
@@ -217,7 +289,7 @@ func searchCriterion(criterion map[string]interface{}) []string {
 
 							}
 
-							allIdsLock.RUnlock()
+							collection.allIdsLock.RUnlock()
 
 							return exclusiveIds
 
@@ -229,7 +301,7 @@ func searchCriterion(criterion map[string]interface{}) []string {
 
 					}
 
-					lookupsLock.RUnlock()
+					collection.lookupsLock.RUnlock()
 
 				}
 
@@ -243,8 +315,122 @@ func searchCriterion(criterion map[string]interface{}) []string {
 
 }
 
-// SearchDocumentIds searches for document IDs by evaluating a set of JSON criteria
-func SearchDocumentIds(criteria map[string][]interface{}) []string {
+// Get the IDs of every document in the collection
+func (collection *collection) getAllIds() []string {
+
+	collection.allIdsLock.RLock()
+	defer collection.allIdsLock.RUnlock()
+
+	ids := []string{}
+
+	for _, id := range collection.allIds {
+		ids = append(ids, id)
+	}
+
+	return ids
+
+}
+
+// ValidateCriteria checks that a set of JSON criteria is shaped so that it can
+// be evaluated -- each group holds criteria objects, and nested AND/OR
+// criteria hold arrays of them
+func ValidateCriteria(criteria map[string][]interface{}) error {
+
+	for _, groupCriteria := range criteria {
+
+		for _, criterion := range groupCriteria {
+
+			remappedCriterion, ok := criterion.(map[string]interface{})
+
+			if ok == false {
+				return errors.New("Each criterion must be an object")
+			}
+
+			for criterionType, criterionValue := range remappedCriterion {
+
+				if strings.ToLower(criterionType) != "and" && strings.ToLower(criterionType) != "or" {
+					continue
+				}
+
+				nestedCriteria, ok := criterionValue.([]interface{})
+
+				if ok == false {
+					return errors.New("Nested " + strings.ToUpper(criterionType) + " criteria must be an array")
+				}
+
+				if err := ValidateCriteria(map[string][]interface{}{criterionType: nestedCriteria}); err != nil {
+					return err
+				}
+
+			}
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// SearchDocumentIds searches for document IDs in a collection by evaluating a
+// set of JSON criteria
+func SearchDocumentIds(collectionName string, criteria map[string][]interface{}) []string {
+
+	return lookupCollection(collectionName).searchDocumentIds(criteria)
+
+}
+
+// SearchDocumentVersions searches for documents in a collection by evaluating
+// a set of JSON criteria, getting the version of each that matched -- no
+// changes are applied to the collection during the search, so each version is
+// the one that matched
+func SearchDocumentVersions(collectionName string, criteria map[string][]interface{}) map[string]int64 {
+
+	collection := lookupCollection(collectionName)
+
+	collection.journalLock.Lock()
+	defer collection.journalLock.Unlock()
+
+	ids := collection.searchDocumentIds(criteria)
+	versions := map[string]int64{}
+
+	collection.documentsLock.RLock()
+	defer collection.documentsLock.RUnlock()
+
+	for _, id := range ids {
+
+		if document, ok := collection.documents[id]; ok {
+			versions[id] = document.Version
+		}
+
+	}
+
+	return versions
+
+}
+
+// CountDocuments counts the documents in a collection matching a set of JSON
+// criteria, without reading any of them
+func CountDocuments(collectionName string, criteria map[string][]interface{}) int {
+
+	collection := lookupCollection(collectionName)
+
+	// If no criteria, count everything
+	if len(criteria) == 0 {
+
+		collection.allIdsLock.RLock()
+		defer collection.allIdsLock.RUnlock()
+
+		return len(collection.allIds)
+
+	}
+
+	return len(collection.searchDocumentIds(criteria))
+
+}
+
+// Search for document IDs by evaluating a set of JSON criteria
+func (collection *collection) searchDocumentIds(criteria map[string][]interface{}) []string {
 
 	result := []string{}
 	ids := [][]string{}
@@ -274,7 +460,7 @@ func SearchDocumentIds(criteria map[string][]interface{}) []string {
 							remappedAndOrCriteria[nestedKey] = append(remappedAndOrCriteria[nestedKey], criteriaSlice)
 						}
 
-						ids = append(ids, SearchDocumentIds(remappedAndOrCriteria))
+						ids = append(ids, collection.searchDocumentIds(remappedAndOrCriteria))
 
 					}
 
@@ -287,7 +473,7 @@ func SearchDocumentIds(criteria map[string][]interface{}) []string {
 			// Regular criterion
 			if isNested == false {
 				regularCriterion := criterion.(map[string]interface{})
-				ids = append(ids, searchCriterion(regularCriterion))
+				ids = append(ids, collection.searchCriterion(regularCriterion))
 			}
 
 		}
@@ -318,29 +504,40 @@ func SearchDocumentIds(criteria map[string][]interface{}) []string {
 
 }
 
-// SearchDocuments searches for documents by evaluating a set of JSON criteria
-func SearchDocuments(criteria map[string][]interface{}, from int, size int, alsoReturnAll bool) (int, []jsonserver.JSON, []jsonserver.JSON) {
+// SearchDocuments searches for documents in a collection by evaluating a set
+// of JSON criteria, returning a page of them starting either from an offset
+// or after the document a search_after cursor points to, along with a cursor
+// pointing to the last document in the page if there are more to follow
+func SearchDocuments(collectionName string, criteria map[string][]interface{}, from int, size int, sortFields []types.SortField, searchAfter string, alsoReturnAll bool) (int, []jsonserver.JSON, []jsonserver.JSON, string, error) {
 
-	ids := []string{}
+	collection := lookupCollection(collectionName)
+	ids, scores, parsedDocuments, sortValues := collection.findSortedIds(collectionName, criteria, sortFields)
 
-	// If no criteria, retrieve everything
-	if len(criteria) == 0 {
+	// Start the page just after the document a cursor points to, so that
+	// pages stay consistent as documents are added and removed
+	if searchAfter != "" {
 
-		allIdsLock.RLock()
+		cursor, err := decodeSearchCursor(searchAfter, len(sortFields))
 
-		for _, id := range allIds {
-			ids = append(ids, id)
+		if err != nil {
+			return 0, nil, nil, "", err
 		}
 
-		allIdsLock.RUnlock()
+		from = sort.Search(len(ids), func(i int) bool {
+			return compareSortKeys(sortValues[ids[i]], ids[i], cursor.Values, cursor.ID, sortFields) > 0
+		})
 
-		// Otherwise filter by the actual criteria
-	} else {
-		ids = SearchDocumentIds(criteria)
 	}
 
-	// Sort IDs (later we will allow sorting by custom fields)
-	sort.Strings(ids)
+	// Work out which terms any fuzzy criteria matched so that each hit can
+	// report the ones it holds
+	fuzzyTerms := collection.getFuzzyMatchedTerms(criteria)
+
+	getHit := func(id string) (jsonserver.JSON, error) {
+
+		return collection.getHit(collectionName, id, parsedDocuments[id], scores, fuzzyTerms)
+
+	}
 
 	// Convert document IDs to actual documents
 	filtered := []jsonserver.JSON{}
@@ -351,34 +548,102 @@ func SearchDocuments(criteria map[string][]interface{}, from int, size int, also
 		// Use only the required IDs (pagination)
 		if sliceKey >= from && sliceKey < from+size {
 
-			document, err := GetDocument(id)
+			hit, err := getHit(id)
 
 			if err == nil {
 
-				filtered = append(filtered, map[string]interface{}{"id": id, "document": document})
+				filtered = append(filtered, hit)
 
 				if alsoReturnAll {
-					all = append(all, map[string]interface{}{"id": id, "document": document})
+					all = append(all, hit)
 				}
 
 			}
 
 		} else if alsoReturnAll {
 
-			document, err := GetDocument(id)
+			hit, err := getHit(id)
 
 			if err == nil {
-				all = append(all, map[string]interface{}{"id": id, "document": document})
+				all = append(all, hit)
 			}
 
 		}
 
 	}
 
+	// Point a cursor at the last document in the page if more follow it
+	nextCursor := ""
+
+	if from >= 0 && size > 0 && from+size < len(ids) {
+
+		lastID := ids[from+size-1]
+		nextCursor = encodeSearchCursor(sortValues[lastID], lastID)
+
+	}
+
 	if alsoReturnAll {
-		return len(ids), filtered, all
+		return len(ids), filtered, all, nextCursor, nil
+	}
+
+	return len(ids), filtered, nil, nextCursor, nil
+
+}
+
+// Find the IDs of the documents matching a set of criteria, sorted by a list
+// of fields, along with their relevance scores, the documents that had to be
+// parsed along the way and the values they were sorted by
+func (collection *collection) findSortedIds(collectionName string, criteria map[string][]interface{}, sortFields []types.SortField) ([]string, map[string]float64, map[string]jsonserver.JSON, map[string][]sortValue) {
+
+	ids := []string{}
+
+	// If no criteria, retrieve everything
+	if len(criteria) == 0 {
+
+		ids = collection.getAllIds()
+
+		// Otherwise filter by the actual criteria
+	} else {
+		ids = collection.searchDocumentIds(criteria)
+	}
+
+	// Score documents by relevance if there is anything to score on
+	scores := collection.scoreDocuments(criteria, ids)
+
+	// Sort IDs by any requested fields (falling back to the IDs themselves),
+	// reusing any documents parsed along the way
+	parsedDocuments, sortValues := sortDocumentIds(collectionName, ids, sortFields, scores)
+
+	return ids, scores, parsedDocuments, sortValues
+
+}
+
+// Build a search hit for a document, reading it unless it has already been
+// parsed
+func (collection *collection) getHit(collectionName string, id string, document jsonserver.JSON, scores map[string]float64, fuzzyTerms []matchedTerm) (jsonserver.JSON, error) {
+
+	if document == nil {
+
+		var err error
+
+		document, err = GetDocument(collectionName, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	hit := jsonserver.JSON{"id": id, "document": document}
+
+	if scores != nil {
+		hit["_score"] = scores[id]
+	}
+
+	if len(fuzzyTerms) > 0 {
+		hit["matched_terms"] = collection.getDocumentMatchedTerms(id, fuzzyTerms)
 	}
 
-	return len(ids), filtered, nil
+	return hit, nil
 
 }
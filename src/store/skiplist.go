@@ -0,0 +1,136 @@
+package store
+
+import (
+	"math/rand"
+)
+
+// The most levels a skip list node can be linked into, which is enough for
+// far more items than fit in memory
+const maxSkipListLevel = 32
+
+// skipList keeps items in order so that they can be inserted, removed and
+// found in logarithmic time, however many there are -- each node is linked
+// into a random number of levels, with each level skipping over roughly half
+// of the nodes in the level below it
+type skipList struct {
+	head   *skipListNode
+	less   func(a interface{}, b interface{}) bool
+	levels int
+	length int
+}
+
+// skipListNode holds an item of a skip list along with the next node at each
+// level it is linked into
+type skipListNode struct {
+	item interface{}
+	next []*skipListNode
+}
+
+// newSkipList creates an empty skip list, ordered by a function reporting
+// whether one item comes before another
+func newSkipList(less func(a interface{}, b interface{}) bool) *skipList {
+
+	return &skipList{head: &skipListNode{next: make([]*skipListNode, maxSkipListLevel)}, less: less, levels: 1}
+
+}
+
+// Find the last node at each level whose item comes before an item
+func (list *skipList) findPredecessors(item interface{}) []*skipListNode {
+
+	predecessors := make([]*skipListNode, maxSkipListLevel)
+	node := list.head
+
+	for level := list.levels - 1; level >= 0; level-- {
+
+		for node.next[level] != nil && list.less(node.next[level].item, item) {
+			node = node.next[level]
+		}
+
+		predecessors[level] = node
+
+	}
+
+	return predecessors
+
+}
+
+// insert adds an item to the list in order, returning false (and leaving the
+// list alone) if an equal item is already in it
+func (list *skipList) insert(item interface{}) bool {
+
+	predecessors := list.findPredecessors(item)
+
+	if next := predecessors[0].next[0]; next != nil && list.less(item, next.item) == false {
+		return false
+	}
+
+	levels := 1
+
+	for levels < maxSkipListLevel && rand.Int63()&1 == 1 {
+		levels++
+	}
+
+	for ; list.levels < levels; list.levels++ {
+		predecessors[list.levels] = list.head
+	}
+
+	node := &skipListNode{item: item, next: make([]*skipListNode, levels)}
+
+	for level := 0; level < levels; level++ {
+		node.next[level] = predecessors[level].next[level]
+		predecessors[level].next[level] = node
+	}
+
+	list.length++
+
+	return true
+
+}
+
+// remove takes the item equal to a given one out of the list, returning false
+// if there wasn't one
+func (list *skipList) remove(item interface{}) bool {
+
+	predecessors := list.findPredecessors(item)
+	node := predecessors[0].next[0]
+
+	if node == nil || list.less(item, node.item) {
+		return false
+	}
+
+	for level := range node.next {
+		predecessors[level].next[level] = node.next[level]
+	}
+
+	for list.levels > 1 && list.head.next[list.levels-1] == nil {
+		list.levels--
+	}
+
+	list.length--
+
+	return true
+
+}
+
+// seek gets the node of the first item passing a check, given that every item
+// failing it comes before every item passing it -- nil is returned if no item
+// passes
+func (list *skipList) seek(check func(item interface{}) bool) *skipListNode {
+
+	if list == nil {
+		return nil
+	}
+
+	node := list.head
+
+	for level := list.levels - 1; level >= 0; level-- {
+
+		for node.next[level] != nil && check(node.next[level].item) == false {
+			node = node.next[level]
+		}
+
+	}
+
+	return node.next[0]
+
+}
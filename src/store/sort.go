@@ -0,0 +1,282 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/D-L-M/jsonserver"
+	"github.com/D-L-M/mem-db/src/types"
+	"github.com/D-L-M/mem-db/src/utils"
+)
+
+// Ranks by which values of different types are ordered against each other
+const (
+	sortRankNumber = iota
+	sortRankDate
+	sortRankString
+	sortRankBoolean
+	sortRankMissing
+)
+
+// sortValue is a single document's comparable value for a sort field
+type sortValue struct {
+	Rank   int
+	Number float64
+	Text   string
+}
+
+// documentSort is a custom sorting algorithm for search results -- sort by
+// each requested field in turn, then by document ID
+type documentSort struct {
+	IDs        []string
+	Values     map[string][]sortValue
+	SortFields []types.SortField
+}
+
+func (documents documentSort) Len() int {
+
+	return len(documents.IDs)
+
+}
+
+func (documents documentSort) Swap(i, j int) {
+
+	documents.IDs[i], documents.IDs[j] = documents.IDs[j], documents.IDs[i]
+
+}
+
+func (documents documentSort) Less(i, j int) bool {
+
+	iID := documents.IDs[i]
+	jID := documents.IDs[j]
+
+	return compareSortKeys(documents.Values[iID], iID, documents.Values[jID], jID, documents.SortFields) < 0
+
+}
+
+// ParseSortFields converts the sort clause of a search request into a list of
+// fields to sort by -- it can be a field name, an object with a field and an
+// order, or a list of either (the special _score field sorts by relevance)
+func ParseSortFields(clause interface{}) ([]types.SortField, error) {
+
+	result := []types.SortField{}
+
+	switch typedClause := clause.(type) {
+
+	case nil:
+		return result, nil
+
+	case string:
+		return ParseSortFields(map[string]interface{}{"field": typedClause})
+
+	case map[string]interface{}:
+
+		field, ok := typedClause["field"].(string)
+
+		if ok == false || field == "" {
+			return nil, errors.New("Sort fields must have a field name")
+		}
+
+		order, _ := typedClause["order"].(string)
+		order = strings.ToLower(order)
+
+		if order != "" && order != "asc" && order != "desc" {
+			return nil, errors.New("Sort order must be 'asc' or 'desc'")
+		}
+
+		// Relevance scores are sorted highest first unless stated otherwise
+		descending := order == "desc" || (order == "" && field == "_score")
+
+		return []types.SortField{{Field: field, Descending: descending}}, nil
+
+	case []interface{}:
+
+		for _, nestedClause := range typedClause {
+
+			if _, ok := nestedClause.([]interface{}); ok {
+				return nil, errors.New("Sort fields cannot be nested")
+			}
+
+			sortFields, err := ParseSortFields(nestedClause)
+
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, sortFields...)
+
+		}
+
+		return result, nil
+
+	}
+
+	return nil, errors.New("Sort clause is not valid")
+
+}
+
+// Get the comparable value of a single field in a flattened document -- where
+// an array holds several values, the lowest is used for ascending sorts and
+// the highest for descending sorts
+func getSortValue(flattenedDocument map[string]interface{}, sortField types.SortField) sortValue {
+
+	result := sortValue{Rank: sortRankMissing}
+
+	for _, fieldValue := range utils.GetFlattenedFieldValues(flattenedDocument, sortField.Field) {
+
+		candidate := toSortValue(fieldValue)
+
+		if result.Rank == sortRankMissing || compareSortValues(candidate, result, sortField.Descending) < 0 {
+			result = candidate
+		}
+
+	}
+
+	return result
+
+}
+
+// Convert a document value into a comparable sort value
+func toSortValue(value interface{}) sortValue {
+
+	switch typedValue := value.(type) {
+
+	case float64:
+		return sortValue{Rank: sortRankNumber, Number: typedValue}
+
+	case bool:
+
+		if typedValue {
+			return sortValue{Rank: sortRankBoolean, Number: 1}
+		}
+
+		return sortValue{Rank: sortRankBoolean, Number: 0}
+
+	case string:
+
+		if orderableValue, kind, ok := getOrderableValue(typedValue); ok && kind == "date" {
+			return sortValue{Rank: sortRankDate, Number: orderableValue}
+		}
+
+		return sortValue{Rank: sortRankString, Text: typedValue}
+
+	}
+
+	return sortValue{Rank: sortRankMissing}
+
+}
+
+// Compare two sort values, returning a negative number if the first should be
+// ordered before the second -- values of different types are ordered numbers,
+// dates, strings then booleans, and missing values always come last
+func compareSortValues(first sortValue, second sortValue, descending bool) int {
+
+	if first.Rank == sortRankMissing || second.Rank == sortRankMissing {
+		return first.Rank - second.Rank
+	}
+
+	comparison := first.Rank - second.Rank
+
+	if comparison == 0 {
+
+		if first.Rank == sortRankString {
+
+			comparison = strings.Compare(strings.ToLower(first.Text), strings.ToLower(second.Text))
+
+			if comparison == 0 {
+				comparison = strings.Compare(first.Text, second.Text)
+			}
+
+		} else if first.Number < second.Number {
+			comparison = -1
+		} else if first.Number > second.Number {
+			comparison = 1
+		}
+
+	}
+
+	if descending {
+		return -comparison
+	}
+
+	return comparison
+
+}
+
+// Compare the sort keys of two documents -- their values for each sort field
+// in turn, then their IDs -- returning a negative number if the first should
+// be ordered before the second
+func compareSortKeys(firstValues []sortValue, firstID string, secondValues []sortValue, secondID string, sortFields []types.SortField) int {
+
+	for fieldIndex, sortField := range sortFields {
+
+		comparison := compareSortValues(firstValues[fieldIndex], secondValues[fieldIndex], sortField.Descending)
+
+		if comparison != 0 {
+			return comparison
+		}
+
+	}
+
+	return strings.Compare(firstID, secondID)
+
+}
+
+// Sort the IDs of documents in a collection by a list of fields, returning the
+// parsed documents that had to be read so that they can be reused, along with
+// the values each document was sorted by
+func sortDocumentIds(collectionName string, ids []string, sortFields []types.SortField, scores map[string]float64) (map[string]jsonserver.JSON, map[string][]sortValue) {
+
+	parsedDocuments := map[string]jsonserver.JSON{}
+
+	if len(sortFields) == 0 {
+		sort.Strings(ids)
+		return parsedDocuments, map[string][]sortValue{}
+	}
+
+	values := map[string][]sortValue{}
+
+	sortsByDocumentFields := false
+
+	for _, sortField := range sortFields {
+
+		if sortField.Field != "_score" {
+			sortsByDocumentFields = true
+		}
+
+	}
+
+	for _, id := range ids {
+
+		flattenedDocument := map[string]interface{}{}
+
+		// Documents only need to be read if they are sorted by their fields
+		if sortsByDocumentFields {
+
+			document, err := GetDocument(collectionName, id)
+
+			if err == nil {
+				parsedDocuments[id] = document
+				flattenedDocument = utils.FlattenDocumentToDotNotation(document)
+			}
+
+		}
+
+		for _, sortField := range sortFields {
+
+			if sortField.Field == "_score" {
+				values[id] = append(values[id], sortValue{Rank: sortRankNumber, Number: scores[id]})
+			} else {
+				values[id] = append(values[id], getSortValue(flattenedDocument, sortField))
+			}
+
+		}
+
+	}
+
+	sort.Sort(documentSort{IDs: ids, Values: values, SortFields: sortFields})
+
+	return parsedDocuments, values
+
+}
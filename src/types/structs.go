@@ -1,37 +1,135 @@
 package types
 
+import (
+	"time"
+)
+
 // DocumentIndex structs need to store both the document JSON byte array and an
 // inverted index of the keys where its entries in the inverted search index
-// can be found
+// can be found, grouped by field
 type DocumentIndex struct {
-	Document     []byte
-	InvertedKeys []string
+	Sequence int64
+	Version  int64
+	ETag     string
+	Document []byte
+	Fields   map[string]FieldIndex
+}
+
+// FieldIndex structs record where the values of one of a document's fields
+// can be found in the search indices, so that the field can be reindexed
+// without touching the rest of the document -- the positions of each term
+// (by its lookup key) within the field allow phrases to be matched
+type FieldIndex struct {
+	InvertedKeys    []string
+	RangeKeys       []RangeKey
+	TermFrequencies map[string]int
+	Positions       map[string][]int
+	Length          int
+}
+
+// RangeKey structs record where a document's value can be found in the
+// ordered index of a field, so that it can later be removed
+type RangeKey struct {
+	Key   string
+	Value float64
 }
 
 // DocumentMessage structs inform a backround worker about changes to
 // individual documents so that the disk store can be kept up-to-date
 type DocumentMessage struct {
+	Collection       string
 	ID               string
 	Document         []byte
 	Action           string
 	PropagateToPeers bool
+	Source           string
+	Position         int64
+	DocumentIDs      []string
+	Items            []BulkItem
+	ExpectedVersion  int64
+	ExpectedETag     string
+	Result           chan WriteResult
+}
+
+// BulkItem structs describe a single action (index, update or delete) within
+// a bulk request
+type BulkItem struct {
+	Action          string
+	ID              string
+	Document        []byte
+	ExpectedVersion int64
+}
+
+// WriteResult structs report how far a change to a document has progressed,
+// for callers waiting on it
+type WriteResult struct {
+	Indexed    bool
+	Persisted  bool
+	Replicated bool
+	Rejected   bool
+	Conflict   bool
+	Position   int64
+	Version    int64
+	ETag       string
+	Errors     []string
+	Items      []WriteResult
+	WrittenIDs []string
+}
+
+// JournalEntry structs record a single change to the documents in a
+// write-ahead log -- the version counts the changes made to a document, and
+// the sequence orders changes across all nodes so that the latest change to a
+// document always wins
+type JournalEntry struct {
+	Sequence int64
+	Version  int64
+	Action   string
+	ID       string
+	Document string
+}
+
+// Change structs describe a change applied to a document (or a whole
+// collection, for truncations) for change feeds, along with the document as
+// it was beforehand so that feeds can filter on either version
+type Change struct {
+	Sequence         int64
+	Collection       string
+	Action           string
+	ID               string
+	Version          int64
+	Document         []byte
+	PreviousDocument []byte
 }
 
 // UserMessage structs inform a backround worker about changes to
 // user accounts
 type UserMessage struct {
-	Username string
-	Value    string
-	Action   string
+	Username    string
+	Value       string
+	Action      string
+	Roles       []string
+	Permissions []string
+}
+
+// UserAccount structs hold a user's hashed password along with the roles and
+// individual permissions they have been granted
+type UserAccount struct {
+	Password    string
+	Roles       []string
+	Permissions []string
 }
 
 // PeerMessage structs contain instructional messages for peer servers
 type PeerMessage struct {
-	From       string
-	To         string
-	KnownPeers []string
-	Action     string
-	DocumentID string
+	From        string
+	To          string
+	KnownPeers  []string
+	Action      string
+	Collection  string
+	DocumentID  string
+	DocumentIDs []string
+	Position    int64
+	Acknowledge bool
 }
 
 // PeerList structs define additions and removals from the peer list
@@ -39,3 +137,102 @@ type PeerList struct {
 	Hostname string
 	Action   string
 }
+
+// SortField structs define a document field by which to order search results
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// Mapping structs declare how the fields of a collection's documents are
+// indexed, and whether documents that don't conform are rejected -- the
+// analyzer applies to any text field that doesn't name its own, and custom
+// analyzers can be defined alongside the built-in ones
+type Mapping struct {
+	Strict    bool
+	Analyzer  string
+	Analyzers map[string]Analyzer
+	Fields    map[string]FieldMapping
+}
+
+// FieldMapping structs declare the type of a single field and, for text
+// fields, the analyzer its values are broken into terms with
+type FieldMapping struct {
+	Type     string
+	Analyzer string
+}
+
+// Analyzer structs describe how text is broken into the terms it is indexed
+// and searched by: it is split into tokens, which are optionally lowercased,
+// stripped of the stop words of a language and stemmed in a language
+type Analyzer struct {
+	Tokeniser string
+	Lowercase bool
+	StopWords string
+	Stemmer   string
+}
+
+// Aggregation structs define a summary to compute over the full set of
+// documents matched by a search
+type Aggregation struct {
+	Name             string
+	Type             string
+	Field            string
+	Size             int
+	Interval         float64
+	CalendarInterval string
+}
+
+// Highlight structs define how the words matched by a search are marked up in
+// snippets of the documents it returns
+type Highlight struct {
+	Fields            []string
+	PreTag            string
+	PostTag           string
+	FragmentSize      int
+	NumberOfFragments int
+}
+
+// Task structs track the progress of a long-running action over many
+// documents, such as removing the documents matched by a query -- documents
+// are counted as processed once an attempt has been made to change them, and
+// the reasons any changes failed are kept
+type Task struct {
+	ID          string
+	Action      string
+	Collection  string
+	Status      string
+	DryRun      bool
+	Total       int
+	Processed   int
+	Succeeded   int
+	Failures    []TaskFailure
+	StartedAt   time.Time
+	CompletedAt time.Time
+}
+
+// TaskFailure structs record why a task could not change a document
+type TaskFailure struct {
+	ID     string
+	Errors []string
+}
+
+// PercolatorQuery structs describe a named set of criteria that documents in
+// a collection are checked against as they are stored, along with where to
+// send a notification of each match
+type PercolatorQuery struct {
+	Name       string
+	Collection string
+	Criteria   map[string][]interface{}
+	Webhook    string
+}
+
+// PercolatorMatch structs record a document that matched a percolator query
+// when it was stored
+type PercolatorMatch struct {
+	Query      string
+	Collection string
+	ID         string
+	Version    int64
+	MatchedAt  time.Time
+}
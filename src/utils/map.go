@@ -2,6 +2,7 @@ package utils
 
 import (
 	"strconv"
+	"strings"
 )
 
 // FlattenDocumentToDotNotation flattens a map to a key/value map using dot
@@ -52,6 +53,25 @@ func FlattenDocumentToDotNotation(document map[string]interface{}) map[string]in
 
 }
 
+// GetFlattenedFieldValues gets all values of a field from a dot-notation-
+// flattened map, where the field name may either match a key exactly or match
+// it once numeric indices have been removed
+func GetFlattenedFieldValues(flattenedMap map[string]interface{}, field string) []interface{} {
+
+	values := []interface{}{}
+
+	for key, value := range flattenedMap {
+
+		if key == field || RemoveNumericIndicesFromFlattenedKey(key) == field {
+			values = append(values, value)
+		}
+
+	}
+
+	return values
+
+}
+
 // MapHasKey checks whether a map has a key
 func MapHasKey(inputMap *map[string]interface{}, key string) bool {
 
@@ -62,3 +82,109 @@ func MapHasKey(inputMap *map[string]interface{}, key string) bool {
 	return false
 
 }
+
+// ProjectDocument copies the parts of a document selected by lists of fields
+// to include and exclude, each given in dot notation with or without numeric
+// array indices -- every field is included if no fields are listed, and
+// exclusions always win
+func ProjectDocument(document map[string]interface{}, fields []string, exclude []string) map[string]interface{} {
+
+	projected, ok := projectValue(document, "", "", fields, exclude, len(fields) == 0)
+
+	if projectedDocument, isMap := projected.(map[string]interface{}); ok && isMap {
+		return projectedDocument
+	}
+
+	return map[string]interface{}{}
+
+}
+
+// Copy the selected parts of a value found at a path in a document, returning
+// false if none of it is selected
+func projectValue(value interface{}, path string, sanitisedPath string, fields []string, exclude []string, included bool) (interface{}, bool) {
+
+	if path != "" {
+
+		if matchesProjectionPath(path, sanitisedPath, exclude) {
+			return nil, false
+		}
+
+		if included == false && matchesProjectionPath(path, sanitisedPath, fields) {
+			included = true
+		}
+
+	}
+
+	switch child := value.(type) {
+
+	case map[string]interface{}:
+
+		result := map[string]interface{}{}
+
+		for key, subValue := range child {
+
+			if projected, ok := projectValue(subValue, joinProjectionPath(path, key), joinProjectionPath(sanitisedPath, key), fields, exclude, included); ok {
+				result[key] = projected
+			}
+
+		}
+
+		// Objects are only kept for the sake of the fields inside them if
+		// any of those fields were selected
+		if included == false && len(result) == 0 {
+			return nil, false
+		}
+
+		return result, true
+
+	case []interface{}:
+
+		result := []interface{}{}
+
+		for subKey, subValue := range child {
+
+			if projected, ok := projectValue(subValue, joinProjectionPath(path, strconv.Itoa(subKey)), sanitisedPath, fields, exclude, included); ok {
+				result = append(result, projected)
+			}
+
+		}
+
+		if included == false && len(result) == 0 {
+			return nil, false
+		}
+
+		return result, true
+
+	default:
+		return value, included
+
+	}
+
+}
+
+// Add a key to a dot-notation path
+func joinProjectionPath(path string, key string) string {
+
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+
+}
+
+// Check whether a path, with or without its numeric indices, is one of a list
+// of fields or lies inside one of them
+func matchesProjectionPath(path string, sanitisedPath string, fields []string) bool {
+
+	for _, field := range fields {
+
+		if path == field || strings.HasPrefix(path, field+".") || sanitisedPath == field || strings.HasPrefix(sanitisedPath, field+".") {
+			return true
+		}
+
+	}
+
+	return false
+
+}
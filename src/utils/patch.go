@@ -0,0 +1,433 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// MergePatch applies a JSON merge patch (RFC 7396) to a decoded JSON value,
+// returning the patched value without modifying the original
+func MergePatch(target interface{}, patch interface{}) interface{} {
+
+	patchObject, ok := patch.(map[string]interface{})
+
+	// Anything other than an object replaces the target outright
+	if ok == false {
+		return patch
+	}
+
+	result := map[string]interface{}{}
+
+	if targetObject, ok := target.(map[string]interface{}); ok {
+
+		for key, value := range targetObject {
+			result[key] = value
+		}
+
+	}
+
+	// Null values remove keys, and everything else is merged in recursively
+	for key, value := range patchObject {
+
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = MergePatch(result[key], value)
+		}
+
+	}
+
+	return result
+
+}
+
+// JSONPatch applies a JSON patch (RFC 6902) to a decoded JSON value, returning
+// the patched value without modifying the original -- the operations are
+// applied all or nothing, so an error means none of them have been
+func JSONPatch(target interface{}, patch interface{}) (interface{}, error) {
+
+	operations, ok := patch.([]interface{})
+
+	if ok == false {
+		return nil, errors.New("JSON patch must be an array of operations")
+	}
+
+	result := copyJSONValue(target)
+
+	for i, operation := range operations {
+
+		var err error
+
+		result, err = applyJSONPatchOperation(result, operation)
+
+		if err != nil {
+			return nil, errors.New("Operation " + strconv.Itoa(i) + " failed: " + err.Error())
+		}
+
+	}
+
+	return result, nil
+
+}
+
+// Apply a single JSON patch operation to a decoded JSON value
+func applyJSONPatchOperation(target interface{}, operation interface{}) (interface{}, error) {
+
+	operationObject, ok := operation.(map[string]interface{})
+
+	if ok == false {
+		return nil, errors.New("operation must be an object")
+	}
+
+	operationName, _ := operationObject["op"].(string)
+	pathString, ok := operationObject["path"].(string)
+
+	if ok == false {
+		return nil, errors.New("operation must have a path")
+	}
+
+	path, err := parseJSONPointer(pathString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, hasValue := operationObject["value"]
+
+	if hasValue == false && (operationName == "add" || operationName == "replace" || operationName == "test") {
+		return nil, errors.New("'" + operationName + "' operation must have a value")
+	}
+
+	// Moves and copies also need the location of the value to take
+	var from []string
+
+	if operationName == "move" || operationName == "copy" {
+
+		fromString, ok := operationObject["from"].(string)
+
+		if ok == false {
+			return nil, errors.New("'" + operationName + "' operation must have a from location")
+		}
+
+		from, err = parseJSONPointer(fromString)
+
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	switch operationName {
+
+	case "add":
+		return addJSONValue(target, path, copyJSONValue(value))
+
+	case "remove":
+		return removeJSONValue(target, path)
+
+	case "replace":
+
+		if len(path) == 0 {
+			return copyJSONValue(value), nil
+		}
+
+		target, err := removeJSONValue(target, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addJSONValue(target, path, copyJSONValue(value))
+
+	case "move":
+
+		// A value cannot be moved into one of its own children
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, errors.New("a value cannot be moved into itself")
+		}
+
+		movedValue, err := getJSONValue(target, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		target, err := removeJSONValue(target, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addJSONValue(target, path, movedValue)
+
+	case "copy":
+
+		copiedValue, err := getJSONValue(target, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addJSONValue(target, path, copyJSONValue(copiedValue))
+
+	case "test":
+
+		existingValue, err := getJSONValue(target, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if reflect.DeepEqual(existingValue, value) == false {
+			return nil, errors.New("value at '" + pathString + "' does not match")
+		}
+
+		return target, nil
+
+	}
+
+	return nil, errors.New("'" + operationName + "' is not a valid operation")
+
+}
+
+// Parse a JSON pointer (RFC 6901) into its unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if strings.HasPrefix(pointer, "/") == false {
+		return nil, errors.New("path '" + pointer + "' must start with a slash")
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+
+}
+
+// Parse a JSON pointer reference token as an index into an array of a given
+// length, optionally allowing the index just past its end
+func parseJSONArrayIndex(token string, length int, allowEnd bool) (int, error) {
+
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+
+	// Indices must be plain decimal numbers without leading zeros
+	if err != nil || index < 0 || strconv.Itoa(index) != token {
+		return 0, errors.New("'" + token + "' is not a valid array index")
+	}
+
+	if index > length || (index == length && allowEnd == false) {
+		return 0, errors.New("array index " + token + " is out of bounds")
+	}
+
+	return index, nil
+
+}
+
+// Get the value at a location within a decoded JSON value
+func getJSONValue(target interface{}, path []string) (interface{}, error) {
+
+	for _, token := range path {
+
+		switch container := target.(type) {
+
+		case map[string]interface{}:
+
+			value, ok := container[token]
+
+			if ok == false {
+				return nil, errors.New("'" + token + "' does not exist")
+			}
+
+			target = value
+
+		case []interface{}:
+
+			index, err := parseJSONArrayIndex(token, len(container), false)
+
+			if err != nil {
+				return nil, err
+			}
+
+			target = container[index]
+
+		default:
+			return nil, errors.New("'" + token + "' does not exist")
+
+		}
+
+	}
+
+	return target, nil
+
+}
+
+// Add a value at a location within a decoded JSON value, returning the
+// updated value -- values added to objects replace any existing value under
+// the same key, while values added to arrays are inserted
+func addJSONValue(target interface{}, path []string, value interface{}) (interface{}, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token := path[0]
+
+	switch container := target.(type) {
+
+	case map[string]interface{}:
+
+		if len(path) == 1 {
+			container[token] = value
+			return container, nil
+		}
+
+		child, ok := container[token]
+
+		if ok == false {
+			return nil, errors.New("'" + token + "' does not exist")
+		}
+
+		updatedChild, err := addJSONValue(child, path[1:], value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		container[token] = updatedChild
+
+		return container, nil
+
+	case []interface{}:
+
+		if len(path) == 1 {
+
+			index, err := parseJSONArrayIndex(token, len(container), true)
+
+			if err != nil {
+				return nil, err
+			}
+
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+
+			return container, nil
+
+		}
+
+		index, err := parseJSONArrayIndex(token, len(container), false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		updatedChild, err := addJSONValue(container[index], path[1:], value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		container[index] = updatedChild
+
+		return container, nil
+
+	}
+
+	return nil, errors.New("'" + token + "' does not exist")
+
+}
+
+// Remove the value at a location within a decoded JSON value, returning the
+// updated value
+func removeJSONValue(target interface{}, path []string) (interface{}, error) {
+
+	if len(path) == 0 {
+		return nil, errors.New("the whole document cannot be removed")
+	}
+
+	token := path[0]
+
+	switch container := target.(type) {
+
+	case map[string]interface{}:
+
+		child, ok := container[token]
+
+		if ok == false {
+			return nil, errors.New("'" + token + "' does not exist")
+		}
+
+		if len(path) == 1 {
+			delete(container, token)
+			return container, nil
+		}
+
+		updatedChild, err := removeJSONValue(child, path[1:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		container[token] = updatedChild
+
+		return container, nil
+
+	case []interface{}:
+
+		index, err := parseJSONArrayIndex(token, len(container), false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(path) == 1 {
+			return append(container[:index], container[index+1:]...), nil
+		}
+
+		updatedChild, err := removeJSONValue(container[index], path[1:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		container[index] = updatedChild
+
+		return container, nil
+
+	}
+
+	return nil, errors.New("'" + token + "' does not exist")
+
+}
+
+// Deep copy a decoded JSON value so that it can be changed without affecting
+// the original
+func copyJSONValue(value interface{}) interface{} {
+
+	encodedValue, err := json.Marshal(value)
+
+	if err != nil {
+		return value
+	}
+
+	var copiedValue interface{}
+
+	json.Unmarshal(encodedValue, &copiedValue)
+
+	return copiedValue
+
+}
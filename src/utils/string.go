@@ -3,8 +3,6 @@ package utils
 import (
 	"regexp"
 	"strings"
-
-	"github.com/kljensen/snowball"
 )
 
 // RemoveNumericIndicesFromFlattenedKey strips numeric indices from a
@@ -38,48 +36,3 @@ func PadPunctuationWithSpaces(inputString string) string {
 	return padded
 
 }
-
-// GetPhrasesFromString splits a string into a slice of individual words
-func GetPhrasesFromString(inputString string) ([]string, []string) {
-
-	phraseWordLimit := 3 // TODO: Move into config
-	words := strings.Split(PadPunctuationWithSpaces(inputString), " ")
-	validPlainWords := []string{}
-	validStemmedWords := []string{}
-	plainResult := []string{}
-	stemmedResult := []string{}
-
-	// Remove spaces
-	for _, word := range words {
-
-		if word != "" {
-
-			validPlainWords = append(validPlainWords, word)
-			stemmedWord, err := snowball.Stem(word, "english", true)
-
-			if err == nil {
-				validStemmedWords = append(validStemmedWords, stemmedWord)
-			}
-
-		}
-
-	}
-
-	// Build up a list of phrases, starting at one word each and building to
-	// the phrase word limit
-	for i := 1; i <= phraseWordLimit; i++ {
-
-		for j := 0; j <= (len(validPlainWords) - i); j++ {
-
-			plainPhrase := strings.Join(validPlainWords[j:(j+i)], " ")
-			plainResult = append(plainResult, plainPhrase)
-			stemmedPhrase := strings.Join(validStemmedWords[j:(j+i)], " ")
-			stemmedResult = append(stemmedResult, stemmedPhrase)
-
-		}
-
-	}
-
-	return plainResult, stemmedResult
-
-}
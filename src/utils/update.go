@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// ValidateUpdateOperations checks that a decoded list of update operations is
+// well formed, without applying it to anything -- each operation has an "op"
+// (set, unset, increment, append or rename) and a dot-notated "field", set and
+// append have a "value", increment has an optional numeric "value" and rename
+// has a "to" field
+func ValidateUpdateOperations(operations interface{}) error {
+
+	operationList, ok := operations.([]interface{})
+
+	if ok == false || len(operationList) == 0 {
+		return errors.New("Update operations must be a non-empty array")
+	}
+
+	for _, operation := range operationList {
+
+		operationObject, ok := operation.(map[string]interface{})
+
+		if ok == false {
+			return errors.New("Each update operation must be an object")
+		}
+
+		op, _ := operationObject["op"].(string)
+		field, _ := operationObject["field"].(string)
+		value, hasValue := operationObject["value"]
+
+		if validUpdateField(field) == false {
+			return errors.New("Each update operation must have a field")
+		}
+
+		switch op {
+
+		case "set", "append":
+
+			if hasValue == false {
+				return errors.New("The '" + op + "' operation on '" + field + "' must have a value")
+			}
+
+		case "increment":
+
+			if _, ok := value.(float64); hasValue && ok == false {
+				return errors.New("The 'increment' operation on '" + field + "' must have a numeric value")
+			}
+
+		case "rename":
+
+			to, _ := operationObject["to"].(string)
+
+			if validUpdateField(to) == false {
+				return errors.New("The 'rename' operation on '" + field + "' must have a field to rename it to")
+			}
+
+		case "unset":
+
+		default:
+			return errors.New("Update operation '" + op + "' is not supported")
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// ApplyUpdateOperations applies a decoded list of update operations to a
+// decoded JSON document in order, returning the updated document without
+// modifying the original -- the operations are applied all or nothing, so an
+// error means none of them have been
+func ApplyUpdateOperations(target interface{}, operations interface{}) (map[string]interface{}, error) {
+
+	if err := ValidateUpdateOperations(operations); err != nil {
+		return nil, err
+	}
+
+	result, ok := copyJSONValue(target).(map[string]interface{})
+
+	if ok == false {
+		return nil, errors.New("Only JSON objects can be updated")
+	}
+
+	for _, operation := range operations.([]interface{}) {
+
+		operationObject := operation.(map[string]interface{})
+		op := operationObject["op"].(string)
+		field := operationObject["field"].(string)
+		path := strings.Split(field, ".")
+		existingValue, exists := getUpdateFieldValue(result, path)
+		var err error
+
+		switch op {
+
+		case "set":
+
+			err = setUpdateFieldValue(result, path, copyJSONValue(operationObject["value"]))
+
+		case "unset":
+
+			if exists {
+				removeUpdateFieldValue(result, path)
+			}
+
+		case "increment":
+
+			amount, ok := operationObject["value"].(float64)
+
+			if ok == false {
+				amount = 1
+			}
+
+			existingNumber, ok := existingValue.(float64)
+
+			if exists && ok == false {
+				return nil, errors.New("'" + field + "' is not a number, so cannot be incremented")
+			}
+
+			err = setUpdateFieldValue(result, path, existingNumber+amount)
+
+		case "append":
+
+			existingArray, ok := existingValue.([]interface{})
+
+			if exists && ok == false {
+				return nil, errors.New("'" + field + "' is not an array, so cannot be appended to")
+			}
+
+			err = setUpdateFieldValue(result, path, append(existingArray, copyJSONValue(operationObject["value"])))
+
+		case "rename":
+
+			// Renaming a field that doesn't exist leaves the document alone
+			if exists {
+				removeUpdateFieldValue(result, path)
+				err = setUpdateFieldValue(result, strings.Split(operationObject["to"].(string), "."), existingValue)
+			}
+
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	return result, nil
+
+}
+
+// Check that a field named by an update operation is dot-notated without any
+// empty parts
+func validUpdateField(field string) bool {
+
+	for _, part := range strings.Split(field, ".") {
+
+		if part == "" {
+			return false
+		}
+
+	}
+
+	return true
+
+}
+
+// Get the value of a field of a document, following its path through nested
+// objects
+func getUpdateFieldValue(document map[string]interface{}, path []string) (interface{}, bool) {
+
+	var target interface{} = document
+
+	for _, key := range path {
+
+		container, ok := target.(map[string]interface{})
+
+		if ok == false {
+			return nil, false
+		}
+
+		if target, ok = container[key]; ok == false {
+			return nil, false
+		}
+
+	}
+
+	return target, true
+
+}
+
+// Set the value of a field of a document, creating any objects missing along
+// its path
+func setUpdateFieldValue(document map[string]interface{}, path []string, value interface{}) error {
+
+	container := document
+
+	for i, key := range path[:len(path)-1] {
+
+		if _, ok := container[key]; ok == false {
+			container[key] = map[string]interface{}{}
+		}
+
+		child, ok := container[key].(map[string]interface{})
+
+		if ok == false {
+			return errors.New("'" + strings.Join(path[:(i+1)], ".") + "' is not an object, so '" + strings.Join(path, ".") + "' cannot be set")
+		}
+
+		container = child
+
+	}
+
+	container[path[len(path)-1]] = value
+
+	return nil
+
+}
+
+// Remove a field from a document, if it exists
+func removeUpdateFieldValue(document map[string]interface{}, path []string) {
+
+	parent, ok := getUpdateFieldValue(document, path[:len(path)-1])
+
+	if container, isObject := parent.(map[string]interface{}); ok && isObject {
+		delete(container, path[len(path)-1])
+	}
+
+}
@@ -0,0 +1,725 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/D-L-M/mem-db/src/crypt"
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/output"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// Each node appends to its own log within each collection's directory, and
+// periodically compacts it into a snapshot once it has grown past either of
+// these thresholds
+const compactionRecordThreshold = 10000
+const compactionSizeThreshold = 64 << 20
+
+// Names of the files held in each node's WAL directory
+const logFilename = "log"
+const snapshotFilename = "snapshot"
+
+// collectionLog is this node's open log file for a collection
+type collectionLog struct {
+	File                   *os.File
+	Size                   int64
+	AppendsSinceCompaction int
+}
+
+// The open logs of this node, keyed by collection -- the size of each is
+// also the position of its next record, and appends are counted from when it
+// was last compacted
+var logs = map[string]*collectionLog{}
+
+// Highest sequence number issued or observed
+var lastSequence int64
+
+// logLock allows locking of the logs and their counters during reads/writes
+var logLock = sync.Mutex{}
+
+// sequenceLock allows locking of the sequence counter during reads/writes
+var sequenceLock = sync.Mutex{}
+
+// getNodeDirectory gets the WAL directory of a node within a collection by
+// the node's hostname
+func getNodeDirectory(collection string, hostname string) (string, error) {
+
+	collectionDirectory, err := data.GetCollectionDirectory(collection)
+
+	if err != nil {
+		return "", err
+	}
+
+	nodeDirectory := collectionDirectory + "/" + crypt.Sha512([]byte(hostname))
+
+	if _, err := os.Stat(nodeDirectory); os.IsNotExist(err) {
+
+		err := os.Mkdir(nodeDirectory, os.FileMode(0700))
+
+		if err != nil {
+			return "", err
+		}
+
+	}
+
+	return nodeDirectory, nil
+
+}
+
+// getOwnNodeDirectory gets the WAL directory of this node within a collection
+func getOwnNodeDirectory(collection string) (string, error) {
+
+	_, hostname, _, _, _ := data.GetOptions()
+
+	return getNodeDirectory(collection, hostname)
+
+}
+
+// Open moves any logs written before documents were split into collections
+// into the default collection, and then opens this node's log in every
+// collection for appending
+func Open() error {
+
+	err := migrateLegacyLogs()
+
+	if err != nil {
+		return err
+	}
+
+	collections, err := Collections()
+
+	if err != nil {
+		return err
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	for _, collection := range collections {
+
+		if _, err := openLog(collection); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// migrateLegacyLogs moves the WAL directories of all nodes from where they
+// were kept before documents were split into collections into the default
+// collection -- other nodes sharing the disk may be doing the same, so
+// directories that have already been moved are skipped
+func migrateLegacyLogs() error {
+
+	walDirectory, err := data.GetWALDirectory()
+
+	if err != nil {
+		return err
+	}
+
+	nodeDirectories, err := ioutil.ReadDir(walDirectory)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	collectionDirectory, err := data.GetCollectionDirectory(data.DefaultCollection)
+
+	if err != nil {
+		return err
+	}
+
+	for _, nodeDirectory := range nodeDirectories {
+
+		err := os.Rename(walDirectory+"/"+nodeDirectory.Name(), collectionDirectory+"/"+nodeDirectory.Name())
+
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+
+	}
+
+	os.Remove(walDirectory)
+
+	return nil
+
+}
+
+// Collections lists the collections that have a directory on disk
+func Collections() ([]string, error) {
+
+	collections := []string{}
+	storageDirectory, err := data.GetStorageDirectory()
+
+	if err != nil {
+		return collections, err
+	}
+
+	collectionDirectories, err := ioutil.ReadDir(storageDirectory)
+
+	if err != nil {
+		return collections, err
+	}
+
+	for _, collectionDirectory := range collectionDirectories {
+
+		if collectionDirectory.IsDir() {
+			collections = append(collections, collectionDirectory.Name())
+		}
+
+	}
+
+	return collections, nil
+
+}
+
+// openLog gets this node's log in a collection, first opening it for
+// appending if it isn't already open and discarding any incomplete record
+// left at its end by a crash mid-write -- logLock must be held by the caller
+func openLog(collection string) (*collectionLog, error) {
+
+	if log, ok := logs[collection]; ok {
+		return log, nil
+	}
+
+	nodeDirectory, err := getOwnNodeDirectory(collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(nodeDirectory+"/"+logFilename, os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the end of the last complete record
+	validLength := int64(0)
+	reader := bufio.NewReader(file)
+
+	for {
+
+		_, recordLength, readErr := readRecord(reader)
+
+		if readErr == io.EOF {
+			break
+		}
+
+		if readErr != nil {
+
+			// Only a record cut short at the end of the log can be discarded,
+			// as anything after a corrupt one has already been acknowledged
+			torn, err := isTornTail(file, validLength)
+
+			if err == nil && torn == false {
+				err = corruptFileError(file.Name(), validLength)
+			}
+
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+
+			output.Log("Discarding an incomplete record at the end of the write-ahead log of collection '" + collection + "'")
+
+			break
+
+		}
+
+		validLength += recordLength
+
+	}
+
+	err = file.Truncate(validLength)
+
+	if err == nil {
+		_, err = file.Seek(validLength, io.SeekStart)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	log := &collectionLog{File: file, Size: validLength}
+	logs[collection] = log
+
+	return log, nil
+
+}
+
+// NextSequence issues a sequence number for a new change, which is always
+// higher than any issued or observed before it
+func NextSequence() int64 {
+
+	sequenceLock.Lock()
+	defer sequenceLock.Unlock()
+
+	sequence := time.Now().UnixNano()
+
+	if sequence <= lastSequence {
+		sequence = lastSequence + 1
+	}
+
+	lastSequence = sequence
+
+	return sequence
+
+}
+
+// ObserveSequence records a sequence number issued by another node, so that
+// changes made afterwards on this node are ordered after it
+func ObserveSequence(sequence int64) {
+
+	sequenceLock.Lock()
+
+	if sequence > lastSequence {
+		lastSequence = sequence
+	}
+
+	sequenceLock.Unlock()
+
+}
+
+// Append writes an entry to the end of this node's log in a collection and
+// flushes it to disk, returning its position in the log
+func Append(collection string, entry types.JournalEntry) (int64, error) {
+
+	record, err := encodeRecord(entry)
+
+	if err != nil {
+		return 0, err
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	log, err := openLog(collection)
+
+	if err != nil {
+		return 0, err
+	}
+
+	position := log.Size
+	_, err = log.File.Write(record)
+
+	if err == nil {
+		err = log.File.Sync()
+	}
+
+	if err != nil {
+
+		// Discard anything partially written so the log stays readable
+		log.File.Truncate(position)
+		log.File.Seek(position, io.SeekStart)
+
+		return 0, err
+
+	}
+
+	log.Size += int64(len(record))
+	log.AppendsSinceCompaction++
+
+	return position, nil
+
+}
+
+// AppendBatch writes several entries to the end of this node's log in a
+// collection with a single flush to disk, returning the position of each in
+// the log -- either all of the entries are written or none of them are
+func AppendBatch(collection string, entries []types.JournalEntry) ([]int64, error) {
+
+	records := []byte{}
+	recordLengths := []int64{}
+
+	for _, entry := range entries {
+
+		record, err := encodeRecord(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record...)
+		recordLengths = append(recordLengths, int64(len(record)))
+
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	log, err := openLog(collection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	position := log.Size
+	_, err = log.File.Write(records)
+
+	if err == nil {
+		err = log.File.Sync()
+	}
+
+	if err != nil {
+
+		// Discard anything partially written so the log stays readable
+		log.File.Truncate(position)
+		log.File.Seek(position, io.SeekStart)
+
+		return nil, err
+
+	}
+
+	positions := []int64{}
+
+	for _, recordLength := range recordLengths {
+		positions = append(positions, log.Size)
+		log.Size += recordLength
+	}
+
+	log.AppendsSinceCompaction += len(entries)
+
+	return positions, nil
+
+}
+
+// ReadAt reads the entry at a position in a node's log in a collection
+func ReadAt(collection string, hostname string, position int64) (types.JournalEntry, error) {
+
+	nodeDirectory, err := getNodeDirectory(collection, hostname)
+
+	if err != nil {
+		return types.JournalEntry{}, err
+	}
+
+	file, err := os.Open(nodeDirectory + "/" + logFilename)
+
+	if err != nil {
+		return types.JournalEntry{}, err
+	}
+
+	defer file.Close()
+
+	_, err = file.Seek(position, io.SeekStart)
+
+	if err != nil {
+		return types.JournalEntry{}, err
+	}
+
+	entry, _, err := readRecord(bufio.NewReader(file))
+
+	return entry, err
+
+}
+
+// ReadFrom reads up to a number of consecutive entries from a position in a
+// node's log in a collection, returning as many as could be read
+func ReadFrom(collection string, hostname string, position int64, count int) ([]types.JournalEntry, error) {
+
+	entries := []types.JournalEntry{}
+	nodeDirectory, err := getNodeDirectory(collection, hostname)
+
+	if err != nil {
+		return entries, err
+	}
+
+	file, err := os.Open(nodeDirectory + "/" + logFilename)
+
+	if err != nil {
+		return entries, err
+	}
+
+	defer file.Close()
+
+	_, err = file.Seek(position, io.SeekStart)
+
+	if err != nil {
+		return entries, err
+	}
+
+	reader := bufio.NewReader(file)
+
+	for len(entries) < count {
+
+		entry, _, err := readRecord(reader)
+
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, entry)
+
+	}
+
+	return entries, nil
+
+}
+
+// Find finds the latest entry for a document ID in a node's snapshot and log
+// in a collection
+func Find(collection string, hostname string, id string) (types.JournalEntry, error) {
+
+	latestEntries, err := FindAll(collection, hostname, []string{id})
+
+	if err != nil {
+		return types.JournalEntry{}, err
+	}
+
+	if latestEntry, ok := latestEntries[id]; ok {
+		return latestEntry, nil
+	}
+
+	return types.JournalEntry{}, errors.New("Entry does not exist")
+
+}
+
+// FindAll finds the latest entries for several document IDs in a node's
+// snapshot and log in a collection with a single pass over them, keyed by ID
+// -- IDs with no entries are omitted
+func FindAll(collection string, hostname string, ids []string) (map[string]types.JournalEntry, error) {
+
+	latestEntries := map[string]types.JournalEntry{}
+	nodeDirectory, err := getNodeDirectory(collection, hostname)
+
+	if err != nil {
+		return latestEntries, err
+	}
+
+	wantedIds := map[string]bool{}
+
+	for _, id := range ids {
+		wantedIds[id] = true
+	}
+
+	for _, filename := range []string{snapshotFilename, logFilename} {
+
+		err := readFile(nodeDirectory+"/"+filename, func(entry types.JournalEntry) {
+
+			if wantedIds[entry.ID] == false {
+				return
+			}
+
+			if latestEntry, ok := latestEntries[entry.ID]; ok == false || entry.Sequence >= latestEntry.Sequence {
+				latestEntries[entry.ID] = entry
+			}
+
+		})
+
+		if err != nil {
+			return latestEntries, err
+		}
+
+	}
+
+	return latestEntries, nil
+
+}
+
+// Replay reads every entry from the snapshots and logs of all nodes in a
+// collection, passing each to a callback -- entries are not ordered across
+// nodes, so the callback must use their sequence numbers to decide which
+// change wins, and a file with a corrupt record followed by intact ones is an
+// error
+func Replay(collection string, callback func(types.JournalEntry)) error {
+
+	collectionDirectory, err := data.GetCollectionDirectory(collection)
+
+	if err != nil {
+		return err
+	}
+
+	nodeDirectories, err := ioutil.ReadDir(collectionDirectory)
+
+	if err != nil {
+		return err
+	}
+
+	for _, nodeDirectory := range nodeDirectories {
+
+		if nodeDirectory.IsDir() == false {
+			continue
+		}
+
+		for _, filename := range []string{snapshotFilename, logFilename} {
+
+			if err := readFile(collectionDirectory+"/"+nodeDirectory.Name()+"/"+filename, callback); err != nil {
+				return err
+			}
+
+		}
+
+	}
+
+	return nil
+
+}
+
+// readFile passes every complete entry in a snapshot or log file to a
+// callback, stopping at the first incomplete or corrupt record -- a file that
+// does not exist has no entries, but a corrupt record followed by intact ones
+// is an error
+func readFile(filename string, callback func(types.JournalEntry)) error {
+
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil
+	}
+
+	defer file.Close()
+
+	position := int64(0)
+	reader := bufio.NewReader(file)
+
+	for {
+
+		entry, recordLength, err := readRecord(reader)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+
+			torn, err := isTornTail(file, position)
+
+			if err == nil && torn == false {
+				err = corruptFileError(filename, position)
+			}
+
+			return err
+
+		}
+
+		callback(entry)
+
+		position += recordLength
+
+	}
+
+}
+
+// NeedsCompaction checks whether this node's log in a collection has grown
+// enough to be compacted
+func NeedsCompaction(collection string) bool {
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	log, ok := logs[collection]
+
+	return ok && (log.AppendsSinceCompaction >= compactionRecordThreshold || log.Size >= compactionSizeThreshold)
+
+}
+
+// Compact replaces this node's snapshot in a collection with a new one
+// holding the entries produced by a generator, and then empties its log --
+// the snapshot is written to a temporary file and renamed into place so that
+// a crash part way through leaves the previous snapshot and log intact
+func Compact(collection string, generator func(emit func(types.JournalEntry) error) error) error {
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	log, err := openLog(collection)
+
+	if err != nil {
+		return err
+	}
+
+	nodeDirectory, err := getOwnNodeDirectory(collection)
+
+	if err != nil {
+		return err
+	}
+
+	temporaryFilename := nodeDirectory + "/" + snapshotFilename + ".tmp"
+	snapshotFile, err := os.OpenFile(temporaryFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0600))
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(snapshotFile)
+
+	err = generator(func(entry types.JournalEntry) error {
+
+		record, err := encodeRecord(entry)
+
+		if err == nil {
+			_, err = writer.Write(record)
+		}
+
+		return err
+
+	})
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = snapshotFile.Sync()
+	}
+
+	snapshotFile.Close()
+
+	if err == nil {
+		err = os.Rename(temporaryFilename, nodeDirectory+"/"+snapshotFilename)
+	}
+
+	if err != nil {
+		os.Remove(temporaryFilename)
+		return err
+	}
+
+	syncDirectory(nodeDirectory)
+
+	// Everything in the log is now in the snapshot
+	err = log.File.Truncate(0)
+
+	if err == nil {
+		_, err = log.File.Seek(0, io.SeekStart)
+	}
+
+	if err == nil {
+		err = log.File.Sync()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Size = 0
+	log.AppendsSinceCompaction = 0
+
+	return nil
+
+}
+
+// syncDirectory flushes a directory's entries to disk so that renames within
+// it are durable
+func syncDirectory(directory string) {
+
+	directoryFile, err := os.Open(directory)
+
+	if err == nil {
+		directoryFile.Sync()
+		directoryFile.Close()
+	}
+
+}
@@ -0,0 +1,391 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/D-L-M/mem-db/src/data"
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// TestMain points the base directory at a temporary one for the duration of
+// the tests
+func TestMain(m *testing.M) {
+
+	baseDirectory, err := ioutil.TempDir("", "memdb-wal")
+
+	if err != nil {
+		panic(err)
+	}
+
+	os.Args = append(os.Args, "--base-directory="+baseDirectory, "--log-mode=silent")
+	data.GetOptions()
+
+	code := m.Run()
+
+	os.RemoveAll(baseDirectory)
+	os.Exit(code)
+
+}
+
+// Build an entry adding a document
+func testEntry(id string, sequence int64) types.JournalEntry {
+
+	return types.JournalEntry{Sequence: sequence, Version: 1, Action: "add", ID: id, Document: `{"id":"` + id + `"}`}
+
+}
+
+// Close this node's log in a collection, as if the node had stopped
+func closeTestLog(t *testing.T, collection string) string {
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logs[collection].File.Close()
+	delete(logs, collection)
+
+	nodeDirectory, err := getOwnNodeDirectory(collection)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return nodeDirectory + "/" + logFilename
+
+}
+
+// Reopen this node's log in a collection, as if the node had restarted
+func reopenTestLog(t *testing.T, collection string) *collectionLog {
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	log, err := openLog(collection)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return log
+
+}
+
+// Get the IDs of the entries replayed from a collection, in the order they
+// were replayed
+func replayTestIds(t *testing.T, collection string) []string {
+
+	ids := []string{}
+
+	err := Replay(collection, func(entry types.JournalEntry) {
+		ids = append(ids, entry.ID)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ids
+
+}
+
+// Check that two lists of IDs are the same
+func expectTestIds(t *testing.T, actual []string, expected ...string) {
+
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	for i := range expected {
+
+		if actual[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+
+	}
+
+}
+
+func TestReadRecordRejectsBadChecksum(t *testing.T) {
+
+	record, err := encodeRecord(testEntry("1", 1))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, length, err := readRecord(bytes.NewReader(record)); err != nil || entry.ID != "1" || length != int64(len(record)) {
+		t.Fatalf("Expected the intact record to be read, got %v (%d bytes, error %v)", entry, length, err)
+	}
+
+	corruptRecord := append([]byte{}, record...)
+	corruptRecord[len(corruptRecord)-2] ^= 0xff
+
+	if _, _, err := readRecord(bytes.NewReader(corruptRecord)); err != errCorruptRecord {
+		t.Fatalf("Expected a corrupt record error, got %v", err)
+	}
+
+	if _, _, err := readRecord(bytes.NewReader(record[:recordHeaderLength-3])); err != errCorruptRecord {
+		t.Fatalf("Expected a cut off header to be corrupt, got %v", err)
+	}
+
+	if _, _, err := readRecord(bytes.NewReader([]byte{})); err != io.EOF {
+		t.Fatalf("Expected the end of the records, got %v", err)
+	}
+
+}
+
+func TestOpenLogDiscardsIncompleteRecord(t *testing.T) {
+
+	collection := "torn"
+
+	for i := 1; i <= 2; i++ {
+
+		if _, err := Append(collection, testEntry(strconv.Itoa(i), int64(i))); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	validLength := logs[collection].Size
+	filename := closeTestLog(t, collection)
+
+	// Cut the third record off part way through, as a crash mid-write would
+	record, _ := encodeRecord(testEntry("3", 3))
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Write(record[:len(record)/2])
+	file.Close()
+
+	expectTestIds(t, replayTestIds(t, collection), "1", "2")
+
+	if log := reopenTestLog(t, collection); log.Size != validLength {
+		t.Fatalf("Expected the log to be cut back to %d bytes, got %d", validLength, log.Size)
+	}
+
+	if fileInfo, _ := os.Stat(filename); fileInfo.Size() != validLength {
+		t.Fatalf("Expected the log file to be cut back to %d bytes, got %d", validLength, fileInfo.Size())
+	}
+
+	// New records follow straight on from the last complete one
+	position, err := Append(collection, testEntry("4", 4))
+
+	if err != nil || position != validLength {
+		t.Fatalf("Expected a record to be appended at %d, got %d (error %v)", validLength, position, err)
+	}
+
+	if entry, err := ReadAt(collection, "http://127.0.0.1:9999", position); err != nil || entry.ID != "4" {
+		t.Fatalf("Expected to read back the appended record, got %v (error %v)", entry, err)
+	}
+
+	expectTestIds(t, replayTestIds(t, collection), "1", "2", "4")
+
+}
+
+// Write a batch of entries to this node's log in a collection, close it and
+// flip a byte in the middle of the payload of one of them
+func corruptTestLog(t *testing.T, collection string, corruptIndex int) (string, []int64) {
+
+	positions, err := AppendBatch(collection, []types.JournalEntry{testEntry("1", 1), testEntry("2", 2), testEntry("3", 3)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := closeTestLog(t, collection)
+	file, err := os.OpenFile(filename, os.O_RDWR, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.WriteAt([]byte{0xff}, positions[corruptIndex]+recordHeaderLength+2)
+	file.Close()
+
+	return filename, positions
+
+}
+
+func TestReplayStopsAtCorruptLastRecord(t *testing.T) {
+
+	collection := "corrupt-tail"
+	_, positions := corruptTestLog(t, collection, 2)
+
+	expectTestIds(t, replayTestIds(t, collection), "1", "2")
+
+	if log := reopenTestLog(t, collection); log.Size != positions[2] {
+		t.Fatalf("Expected the log to be cut back to %d bytes, got %d", positions[2], log.Size)
+	}
+
+}
+
+func TestOpenLogRefusesCorruptionBeforeIntactRecords(t *testing.T) {
+
+	collection := "corrupt-middle"
+	filename, _ := corruptTestLog(t, collection, 1)
+	fileInfo, _ := os.Stat(filename)
+
+	if err := Replay(collection, func(entry types.JournalEntry) {}); err == nil {
+		t.Fatal("Expected replaying the log to fail")
+	}
+
+	logLock.Lock()
+	_, err := openLog(collection)
+	logLock.Unlock()
+
+	if err == nil {
+		t.Fatal("Expected opening the log to fail")
+	}
+
+	// The intact records after the corrupt one are kept
+	if reopenedFileInfo, _ := os.Stat(filename); reopenedFileInfo.Size() != fileInfo.Size() {
+		t.Fatalf("Expected the log to be left at %d bytes, got %d", fileInfo.Size(), reopenedFileInfo.Size())
+	}
+
+}
+
+func TestCompactReplacesSnapshotAndEmptiesLog(t *testing.T) {
+
+	collection := "compacted"
+
+	for i := 1; i <= 3; i++ {
+
+		if _, err := Append(collection, testEntry(strconv.Itoa(i), int64(i))); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	err := Compact(collection, func(emit func(types.JournalEntry) error) error {
+
+		for _, id := range []string{"1", "3"} {
+
+			if err := emit(testEntry(id, 10)); err != nil {
+				return err
+			}
+
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeDirectory, _ := getOwnNodeDirectory(collection)
+
+	if _, err := os.Stat(nodeDirectory + "/" + snapshotFilename + ".tmp"); os.IsNotExist(err) == false {
+		t.Fatal("Expected the temporary snapshot to have been renamed")
+	}
+
+	if fileInfo, _ := os.Stat(nodeDirectory + "/" + logFilename); fileInfo.Size() != 0 || logs[collection].Size != 0 || logs[collection].AppendsSinceCompaction != 0 {
+		t.Fatal("Expected the log to have been emptied")
+	}
+
+	expectTestIds(t, replayTestIds(t, collection), "1", "3")
+
+	// Entries appended afterwards are replayed after the snapshot
+	if position, err := Append(collection, testEntry("4", 11)); err != nil || position != 0 {
+		t.Fatalf("Expected a record to be appended at the start of the log, got %d (error %v)", position, err)
+	}
+
+	expectTestIds(t, replayTestIds(t, collection), "1", "3", "4")
+
+}
+
+func TestCompactFailureKeepsSnapshotAndLog(t *testing.T) {
+
+	collection := "uncompacted"
+
+	if _, err := Append(collection, testEntry("1", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Compact(collection, func(emit func(types.JournalEntry) error) error {
+		emit(testEntry("2", 2))
+		return os.ErrClosed
+	})
+
+	if err != os.ErrClosed {
+		t.Fatalf("Expected the generator's error, got %v", err)
+	}
+
+	nodeDirectory, _ := getOwnNodeDirectory(collection)
+
+	for _, filename := range []string{snapshotFilename, snapshotFilename + ".tmp"} {
+
+		if _, err := os.Stat(nodeDirectory + "/" + filename); os.IsNotExist(err) == false {
+			t.Fatalf("Expected no %s to have been written", filename)
+		}
+
+	}
+
+	expectTestIds(t, replayTestIds(t, collection), "1")
+
+}
+
+func TestReplayReadsEveryNode(t *testing.T) {
+
+	collection := "shared"
+
+	if _, err := Append(collection, testEntry("own", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node's snapshot is replayed before its log
+	peerDirectory, err := getNodeDirectory(collection, "http://127.0.0.1:9998")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for filename, id := range map[string]string{snapshotFilename: "peer-snapshot", logFilename: "peer-log"} {
+
+		record, _ := encodeRecord(testEntry(id, 2))
+
+		if err := ioutil.WriteFile(peerDirectory+"/"+filename, record, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	replayed := map[string]int{}
+
+	for i, id := range replayTestIds(t, collection) {
+		replayed[id] = i
+	}
+
+	if len(replayed) != 3 {
+		t.Fatalf("Expected the entries of both nodes to be replayed, got %v", replayed)
+	}
+
+	if replayed["peer-snapshot"] > replayed["peer-log"] {
+		t.Fatal("Expected a node's snapshot to be replayed before its log")
+	}
+
+	if entry, err := Find(collection, "http://127.0.0.1:9998", "peer-log"); err != nil || entry.Sequence != 2 {
+		t.Fatalf("Expected to find the peer's entry, got %v (error %v)", entry, err)
+	}
+
+}
+
+func TestNextSequenceFollowsObservedSequences(t *testing.T) {
+
+	observed := NextSequence() + 1000000000
+
+	ObserveSequence(observed)
+
+	if sequence := NextSequence(); sequence <= observed {
+		t.Fatalf("Expected a sequence after %d, got %d", observed, sequence)
+	}
+
+}
@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/D-L-M/mem-db/src/types"
+)
+
+// Each record is framed by a header holding the length of its payload and a
+// checksum of it, so that torn or corrupted writes can be detected
+const recordHeaderLength = 8
+
+// maximumRecordLength guards against reading a corrupted length
+const maximumRecordLength = 1 << 30
+
+// checksumTable is the CRC-32 (Castagnoli) table used for record checksums
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptRecord is returned when a record is incomplete or fails its
+// checksum
+var errCorruptRecord = errors.New("Record is incomplete or corrupt")
+
+// encodeRecord frames a journal entry as a record
+func encodeRecord(entry types.JournalEntry) ([]byte, error) {
+
+	payload, err := json.Marshal(entry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, recordHeaderLength+len(payload))
+
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, checksumTable))
+	copy(record[recordHeaderLength:], payload)
+
+	return record, nil
+
+}
+
+// readRecord reads a single record, returning its entry and its length on
+// disk -- io.EOF is returned if there are no more records
+func readRecord(reader io.Reader) (types.JournalEntry, int64, error) {
+
+	var entry types.JournalEntry
+
+	header := make([]byte, recordHeaderLength)
+	_, err := io.ReadFull(reader, header)
+
+	if err == io.EOF {
+		return entry, 0, io.EOF
+	}
+
+	if err != nil {
+		return entry, 0, errCorruptRecord
+	}
+
+	payloadLength := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	if payloadLength > maximumRecordLength {
+		return entry, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, payloadLength)
+	_, err = io.ReadFull(reader, payload)
+
+	if err != nil || crc32.Checksum(payload, checksumTable) != checksum {
+		return entry, 0, errCorruptRecord
+	}
+
+	err = json.Unmarshal(payload, &entry)
+
+	if err != nil {
+		return entry, 0, errCorruptRecord
+	}
+
+	return entry, int64(recordHeaderLength) + int64(payloadLength), nil
+
+}
+
+// isTornTail checks whether the unreadable record at a position in a file is
+// the last thing in it, as it is when a crash cuts a write short -- if an
+// intact record can be found anywhere after it, the file has been corrupted
+// since it was written and records after the position would be lost by
+// discarding it
+func isTornTail(file *os.File, position int64) (bool, error) {
+
+	fileInfo, err := file.Stat()
+
+	if err != nil {
+		return false, err
+	}
+
+	remainder := make([]byte, fileInfo.Size()-position)
+
+	if _, err := file.ReadAt(remainder, position); err != nil && err != io.EOF {
+		return false, err
+	}
+
+	for offset := 1; offset+recordHeaderLength <= len(remainder); offset++ {
+
+		// Only lengths that fit in the rest of the file are worth reading
+		payloadLength := binary.BigEndian.Uint32(remainder[offset : offset+4])
+
+		if int64(payloadLength) > int64(len(remainder)-offset-recordHeaderLength) {
+			continue
+		}
+
+		if _, _, err := readRecord(bytes.NewReader(remainder[offset:])); err == nil {
+			return false, nil
+		}
+
+	}
+
+	return true, nil
+
+}
+
+// corruptFileError describes a file holding a corrupt record that is followed
+// by intact ones
+func corruptFileError(filename string, position int64) error {
+
+	return errors.New("'" + filename + "' has a corrupt record at byte " + strconv.FormatInt(position, 10) + " followed by intact records, so it must be repaired or moved aside")
+
+}
@@ -0,0 +1,111 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Analyzers', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Truncate the collection and clear its mapping
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/analysed/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        request('PUT', 'http://127.0.0.1:9999/analysed/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {}}});
+
+        sleep(250);
+    });
+
+
+    /*
+     * Count the documents in the collection matching a contains criterion
+     */
+    function countMatches(field, phrase)
+    {
+        let criteria = {'and': [{'contains': {[field]: phrase}}]};
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9998/analysed/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        return response.information.total_matches;
+    }
+
+
+    it('stem and remove stop words in the language of a field', () =>
+    {
+
+        let mapping = {'fields': {'titre': {'type': 'text', 'analyzer': 'french'}, 'title': {'type': 'text'}}};
+
+        request('PUT', 'http://127.0.0.1:9999/analysed/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': mapping}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/analysed/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'titre': 'Les chevaux de la ferme', 'title': 'The horses of the farm'}}).getBody();
+
+        expect(countMatches('titre', 'cheval')).to.equal(1);
+        expect(countMatches('titre', 'chevaux ferme')).to.equal(1);
+        expect(countMatches('title', 'horse')).to.equal(1);
+
+        /*
+         * The standard analyzer keeps stop words
+         */
+        expect(countMatches('title', 'horses farm')).to.equal(0);
+        expect(countMatches('title', 'of the farm')).to.equal(1);
+
+    });
+
+
+    it('apply the collection analyzer to fields without their own', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/analysed/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Running shoes'}}).getBody();
+
+        expect(countMatches('name', 'run')).to.equal(1);
+
+        request('PUT', 'http://127.0.0.1:9999/analysed/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'analyzer': 'simple', 'fields': {}}}).getBody();
+
+        expect(countMatches('name', 'run')).to.equal(0);
+        expect(countMatches('name', 'running')).to.equal(1);
+
+    });
+
+
+    it('can be defined in a mapping', () =>
+    {
+
+        let mapping = {
+            'analyzers': {'tags': {'tokeniser': 'whitespace', 'stemmer': null}},
+            'fields': {'tags': {'type': 'text', 'analyzer': 'tags'}}
+        };
+
+        let mappingResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/analysed/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': mapping}).getBody().toString('utf8'));
+
+        expect(mappingResponse.mapping.analyzers).to.deep.equal({'tags': {'tokeniser': 'whitespace', 'lowercase': true, 'stop_words': '', 'stemmer': ''}});
+
+        request('PUT', 'http://127.0.0.1:9999/analysed/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'tags': 'Node.js running-shoes'}}).getBody();
+
+        expect(countMatches('tags', 'node.js')).to.equal(1);
+        expect(countMatches('tags', 'running-shoes')).to.equal(1);
+        expect(countMatches('tags', 'running')).to.equal(0);
+        expect(countMatches('tags', 'running-shoes node.js')).to.equal(0);
+
+    });
+
+
+    it('must exist to be used', () =>
+    {
+
+        let response = request('PUT', 'http://127.0.0.1:9999/analysed/_mapping', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'name': {'type': 'text', 'analyzer': 'klingon'}}}});
+
+        expect(response.statusCode).to.equal(400);
+        expect(JSON.parse(response.body.toString('utf8')).message).to.equal("Analyzer 'klingon' does not exist");
+
+        let keywordResponse = request('PUT', 'http://127.0.0.1:9999/analysed/_mapping', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'name': {'type': 'keyword', 'analyzer': 'french'}}}});
+
+        expect(keywordResponse.statusCode).to.equal(400);
+
+    });
+
+
+});
@@ -0,0 +1,147 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as btoa from 'btoa';
+
+
+describe('Change feeds', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Make sure the collection exists
+     */
+    beforeEach(() =>
+    {
+        request('PUT', 'http://127.0.0.1:9999/feed/seed?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'colour': 'none'}}).getBody();
+    });
+
+
+    /*
+     * Read a change feed for a short while, returning its events
+     */
+    function readChanges(params, criteria = null)
+    {
+        let options = {'headers': {'Authorization': 'Basic ' + btoa('root:password')}};
+
+        if (criteria !== null)
+        {
+            options['json'] = criteria;
+        }
+
+        let body = request('POST', 'http://127.0.0.1:9999/feed/_changes?timeout=200ms&' + params, options).getBody().toString('utf8');
+
+        return body.split('\n').filter((line) => line !== '').map((line) => JSON.parse(line));
+    }
+
+
+    /*
+     * Write some documents to a node
+     */
+    function writeDocuments(port, lines)
+    {
+        request('POST', 'http://127.0.0.1:' + port + '/feed/_bulk?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': lines.map((line) => JSON.stringify(line)).join('\n') + '\n'}).getBody();
+    }
+
+
+    it('stream changes made on any node since a sequence number', () =>
+    {
+
+        let start = readChanges('');
+
+        expect(start.length).to.equal(1);
+        expect(start[0].type).to.equal('heartbeat');
+
+        writeDocuments(9999, [{'index': {'id': 'first'}}, {'colour': 'red'}, {'index': {'id': 'second'}}, {'colour': 'blue'}]);
+        writeDocuments(9998, [{'delete': {'id': 'first'}}]);
+
+        let events = readChanges('since=' + start[0].sequence);
+
+        expect(events.length).to.equal(4);
+        expect(events[0]).to.deep.equal({'type': 'heartbeat', 'sequence': start[0].sequence});
+        expect(events[1].action).to.equal('add');
+        expect(events[1].id).to.equal('first');
+        expect(events[1].version).to.equal(1);
+        expect(events[1].document).to.deep.equal({'colour': 'red'});
+        expect(events[2].id).to.equal('second');
+        expect(events[3].action).to.equal('remove');
+        expect(events[3].id).to.equal('first');
+        expect(events[3].version).to.equal(2);
+        expect(events[2].sequence > events[1].sequence).to.equal(true);
+        expect(events[3].sequence > events[2].sequence).to.equal(true);
+
+        let resumed = readChanges('since=' + events[2].sequence);
+
+        expect(resumed.length).to.equal(2);
+        expect(resumed[1].sequence).to.equal(events[3].sequence);
+
+    });
+
+
+    it('can be filtered by criteria', () =>
+    {
+
+        let start = readChanges('');
+
+        writeDocuments(9999, [{'index': {'id': 'third'}}, {'colour': 'red'}, {'index': {'id': 'fourth'}}, {'colour': 'green'}]);
+        writeDocuments(9999, [{'index': {'id': 'third'}}, {'colour': 'green'}]);
+
+        let events = readChanges('since=' + start[0].sequence + '&fields=colour', {'and': [{'equals': {'colour': 'red'}}]});
+
+        // The second change to the third document matched beforehand
+        expect(events.length).to.equal(3);
+        expect(events[1].id).to.equal('third');
+        expect(events[1].document).to.deep.equal({'colour': 'red'});
+        expect(events[2].id).to.equal('third');
+        expect(events[2].document).to.deep.equal({'colour': 'green'});
+
+    });
+
+
+    it('can be sent as server-sent events', () =>
+    {
+
+        let start = readChanges('');
+
+        writeDocuments(9999, [{'index': {'id': 'fifth'}}, {'colour': 'red'}]);
+
+        let response = request('GET', 'http://127.0.0.1:9999/feed/_changes?timeout=200ms', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'Accept': 'text/event-stream', 'Last-Event-ID': String(start[0].sequence)}});
+
+        expect(response.headers['content-type']).to.equal('text/event-stream');
+
+        let events = response.body.toString('utf8').split('\n\n').filter((event) => event !== '');
+
+        expect(events.length).to.equal(2);
+        expect(events[1]).to.include('event: change\n');
+        expect(events[1]).to.include('"id":"fifth"');
+
+    });
+
+
+    it('reject sequence numbers they cannot resume from', () =>
+    {
+
+        let response = request('GET', 'http://127.0.0.1:9999/feed/_changes?since=1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(response.statusCode).to.equal(410);
+
+        let goneResponse = JSON.parse(response.body.toString('utf8'));
+
+        expect(goneResponse.resync).to.equal(true);
+        expect(goneResponse.message).to.include('since=' + goneResponse.resync_from);
+
+        // Following the feed again from the sequence number given works
+        let resumedResponse = request('GET', 'http://127.0.0.1:9999/feed/_changes?timeout=200ms&since=' + goneResponse.resync_from, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(resumedResponse.statusCode).to.equal(200);
+
+        let invalidResponse = request('GET', 'http://127.0.0.1:9999/feed/_changes?since=latest', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(invalidResponse.statusCode).to.equal(400);
+
+    });
+
+
+});
@@ -0,0 +1,188 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Collections', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Truncate the collections
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        request('DELETE', 'http://127.0.0.1:9999/people/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        request('DELETE', 'http://127.0.0.1:9999/pets/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+    });
+
+
+    it('keep documents with the same ID apart', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/people/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Joe Bloggs'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9998/pets/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Rex'}}).getBody();
+
+        /*
+         * Each collection holds its own version of the document
+         */
+        let personResponse = JSON.parse(request('GET', 'http://127.0.0.1:9997/people/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(personResponse).to.deep.equal({'name': 'Joe Bloggs'});
+
+        let petResponse = JSON.parse(request('GET', 'http://127.0.0.1:9997/pets/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(petResponse).to.deep.equal({'name': 'Rex'});
+
+        /*
+         * Neither is in the default collection
+         */
+        let defaultResponse = request('GET', 'http://127.0.0.1:9999/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(defaultResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('are searched independently', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/people/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Rex Bloggs'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/pets/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Rex'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/pets/2?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Fido'}}).getBody();
+
+        let searchResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/pets/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'contains': {'name': 'rex'}}]}}).getBody().toString('utf8'));
+
+        expect(searchResponse.information.total_matches).to.equal(1);
+        expect(searchResponse.results[0].document).to.deep.equal({'name': 'Rex'});
+
+        let statsResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/pets/_stats', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(statsResponse.collection).to.equal('pets');
+        expect(statsResponse.totals.documents).to.equal(2);
+
+    });
+
+
+    it('are truncated independently', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/people/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Joe Bloggs'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/pets/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Rex'}}).getBody();
+
+        request('DELETE', 'http://127.0.0.1:9999/pets/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        /*
+         * Other collections can still be replicated to while it happens
+         */
+        let replicatedResponse = request('PUT', 'http://127.0.0.1:9999/people/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Jane Bloggs'}});
+
+        expect(replicatedResponse.statusCode).to.equal(200);
+
+        sleep(250);
+
+        let petResponse = request('GET', 'http://127.0.0.1:9998/pets/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(petResponse.statusCode).to.equal(404);
+
+        let personResponse = JSON.parse(request('GET', 'http://127.0.0.1:9998/people/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(personResponse).to.deep.equal({'name': 'Joe Bloggs'});
+
+    });
+
+
+    it('are listed', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/people/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Joe Bloggs'}}).getBody();
+
+        let listResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/_collections', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+        let people = listResponse.collections.filter(collection => collection.name === 'people')[0];
+
+        expect(listResponse.default).to.equal('default');
+        expect(people.totals.documents).to.equal(1);
+
+    });
+
+
+    it('can be written to in bulk', () =>
+    {
+
+        let body = '{"index": {"id": "1"}}\n{"name": "Rex"}\n{"index": {}}\n{"name": "Fido"}\n';
+
+        request('POST', 'http://127.0.0.1:9999/pets/_bulk', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': body}).getBody();
+
+        let statsResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/pets/_stats', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(statsResponse.totals.documents).to.equal(2);
+
+    });
+
+
+    it('can generate document IDs', () =>
+    {
+
+        let createResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/pets/_doc?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Rex'}}).getBody().toString('utf8'));
+        let readResponse   = JSON.parse(request('GET', 'http://127.0.0.1:9999/pets/' + createResponse.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(readResponse).to.deep.equal({'name': 'Rex'});
+
+    });
+
+
+    it('reject invalid names', () =>
+    {
+
+        let response = request('PUT', 'http://127.0.0.1:9999/Pets!/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Rex'}});
+
+        expect(response.statusCode).to.equal(400);
+
+    });
+
+
+    it('cannot be searched before they exist', () =>
+    {
+
+        let response = request('POST', 'http://127.0.0.1:9999/unknown/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {}});
+
+        expect(response.statusCode).to.equal(404);
+        expect(JSON.parse(response.body.toString('utf8'))).to.deep.equal(
+            {
+                'success': false,
+                'collection': 'unknown',
+                'message': 'Collection does not exist'
+            }
+        );
+
+    });
+
+
+    it('cannot be truncated with invalid names or before they exist', () =>
+    {
+
+        let invalidResponse = request('DELETE', 'http://127.0.0.1:9999/Pets!/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(invalidResponse.statusCode).to.equal(400);
+
+        let missingResponse = request('DELETE', 'http://127.0.0.1:9999/unknown/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+        sleep(250);
+
+        let listResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/_collections', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(listResponse.collections.filter(collection => collection.name === 'unknown')).to.deep.equal([]);
+
+    });
+
+
+});
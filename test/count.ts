@@ -0,0 +1,66 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Counting', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/counting/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        request('PUT', 'http://127.0.0.1:9999/counting/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'colour': 'red', 'size': 1}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/counting/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'colour': 'red', 'size': 2}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/counting/3?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'colour': 'blue', 'size': 3}}).getBody();
+    });
+
+
+    it('can count the documents matching criteria', () =>
+    {
+
+        let count = (body) => JSON.parse(request('POST', 'http://127.0.0.1:9998/counting/_count', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': body}).getBody().toString('utf8')).count;
+
+        expect(count({})).to.equal(3);
+        expect(count({'and': [{'equals': {'colour': 'red'}}]})).to.equal(2);
+        expect(count({'or': [{'equals': {'colour': 'blue'}}, {'gte': {'size': 2}}]})).to.equal(2);
+        expect(count({'and': [{'equals': {'colour': 'green'}}], 'sort': 'size'})).to.equal(0);
+
+        let emptyResponse = JSON.parse(request('GET', 'http://127.0.0.1:9997/counting/_count', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(emptyResponse.count).to.equal(3);
+
+        let missingResponse = request('GET', 'http://127.0.0.1:9997/nonexistent/_count', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('can check whether a document exists', () =>
+    {
+
+        let response = request('HEAD', 'http://127.0.0.1:9998/counting/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(response.statusCode).to.equal(200);
+        expect(response.headers['x-document-version']).to.equal('1');
+
+        request('DELETE', 'http://127.0.0.1:9999/counting/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody();
+
+        expect(request('HEAD', 'http://127.0.0.1:9998/counting/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).statusCode).to.equal(404);
+        expect(request('HEAD', 'http://127.0.0.1:9998/counting/missing', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).statusCode).to.equal(404);
+
+    });
+
+
+});
@@ -267,6 +267,376 @@ describe('Documents', function()
     });
 
 
+    it('can wait for writes to be replicated', () =>
+    {
+
+        let document =
+            {
+                'foo': 'bar'
+            };
+
+        /*
+         * Create and read straight back from a replica
+         */
+        let createdResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/waited?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document}).getBody().toString('utf8'));
+
+        expect(createdResponse).to.deep.equal(
+            {
+                'id': 'waited',
+                'message': 'Document has been stored',
+                'success': true,
+                'version': 1,
+                'wait_for': 'replicated'
+            }
+        );
+
+        let replicaReadResponse = JSON.parse(request('GET', 'http://127.0.0.1:9998/waited', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(replicaReadResponse).to.deep.equal(document);
+
+        /*
+         * Delete and check it has gone from a replica
+         */
+        let deletedResponse = JSON.parse(request('DELETE', 'http://127.0.0.1:9999/waited?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(deletedResponse).to.deep.equal(
+            {
+                'id': 'waited',
+                'message': 'Document has been removed',
+                'success': true,
+                'version': 2,
+                'wait_for': 'replicated'
+            }
+        );
+
+        let replicaDeletedResponse = request('GET', 'http://127.0.0.1:9997/waited', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(replicaDeletedResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('can wait for writes to be indexed', () =>
+    {
+
+        let document =
+            {
+                'foo': 'bar'
+            };
+
+        let createdResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/waited?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document}).getBody().toString('utf8'));
+
+        expect(createdResponse.success).to.be.true;
+
+        let readResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/waited', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(readResponse).to.deep.equal(document);
+
+    });
+
+
+    it('return an error if waiting for an unknown stage', () =>
+    {
+
+        try
+        {
+
+            request('PUT', 'http://127.0.0.1:9999/waited?wait_for=eventually', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'bar'}}).getBody();
+
+            expect(true).to.equal(false);
+
+        }
+
+        catch (error)
+        {
+
+            let badWaitResponse = JSON.parse(error.body.toString('utf8'));
+
+            expect(badWaitResponse).to.deep.equal(
+                {
+                    'message': 'The wait_for parameter must be one of indexed, persisted or replicated',
+                    'success': false
+                }
+            );
+
+        }
+
+    });
+
+
+    it('can be written in bulk', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/existing?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'bar', 'nested': {'a': 1, 'b': 2}}});
+
+        let body = [
+            '{"index": {"id": "bulk1"}}',
+            '{"foo": "bar"}',
+            '{"index": {}}',
+            '{"foo": "baz"}',
+            '{"update": {"id": "existing"}}',
+            '{"doc": {"foo": "qux", "nested": {"b": null, "c": 3}}}',
+            '{"update": {"id": "missing"}}',
+            '{"doc": {"foo": "bar"}}',
+            '{"index": {"id": "bulk2"}}',
+            '{"bad": "json",}',
+            '{"delete": {"id": "bulk1"}}',
+            ''
+        ].join('\n');
+
+        let bulkResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/_bulk?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': body}).getBody().toString('utf8'));
+
+        expect(bulkResponse.success).to.equal(false);
+        expect(bulkResponse.items).to.have.lengthOf(6);
+
+        expect(bulkResponse.items[0]).to.deep.equal({'action': 'index', 'id': 'bulk1', 'success': true, 'message': 'Document has been stored', 'version': 1});
+        expect(bulkResponse.items[1].success).to.be.true;
+        expect(bulkResponse.items[1].id).to.have.lengthOf(36);
+        expect(bulkResponse.items[2]).to.deep.equal({'action': 'update', 'id': 'existing', 'success': true, 'message': 'Document has been updated', 'version': 2});
+        expect(bulkResponse.items[3]).to.deep.equal({'action': 'update', 'id': 'missing', 'success': false, 'errors': ['Document does not exist']});
+        expect(bulkResponse.items[4]).to.deep.equal({'action': 'index', 'id': 'bulk2', 'success': false, 'errors': ['Document is not valid JSON']});
+        expect(bulkResponse.items[5]).to.deep.equal({'action': 'delete', 'id': 'bulk1', 'success': true, 'message': 'Document has been removed', 'version': 2});
+
+        /*
+         * Check the changes have reached a replica
+         */
+        let updatedReadResponse = JSON.parse(request('GET', 'http://127.0.0.1:9998/existing', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(updatedReadResponse).to.deep.equal({'foo': 'qux', 'nested': {'a': 1, 'c': 3}});
+
+        let generatedReadResponse = JSON.parse(request('GET', 'http://127.0.0.1:9997/' + bulkResponse.items[1].id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(generatedReadResponse).to.deep.equal({'foo': 'baz'});
+
+        let deletedReadResponse = request('GET', 'http://127.0.0.1:9998/bulk1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(deletedReadResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('return an error if a bulk action is malformed', () =>
+    {
+
+        try
+        {
+
+            request('POST', 'http://127.0.0.1:9999/_bulk', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': '{"index": {"id": "1"}}\n{"foo": "bar"}\n{"upsert": {"id": "2"}}\n'}).getBody();
+
+            expect(true).to.equal(false);
+
+        }
+
+        catch (error)
+        {
+
+            let badBulkResponse = JSON.parse(error.body.toString('utf8'));
+
+            expect(badBulkResponse).to.deep.equal(
+                {
+                    'message': "Line 3 has an unknown action 'upsert'",
+                    'success': false
+                }
+            );
+
+        }
+
+    });
+
+
+    it('can be updated with a JSON merge patch', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/patched?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'John Smith', 'age': 32, 'address': {'city': 'London', 'country': 'UK'}}});
+
+        let patchedResponse = JSON.parse(request('PATCH', 'http://127.0.0.1:9999/patched?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'Content-Type': 'application/merge-patch+json'}, 'body': '{"age": 33, "address": {"city": "Leeds", "country": null}}'}).getBody().toString('utf8'));
+
+        expect(patchedResponse).to.deep.equal(
+            {
+                'id': 'patched',
+                'message': 'Document has been updated',
+                'success': true,
+                'version': 2,
+                'wait_for': 'replicated'
+            }
+        );
+
+        let replicaReadResponse = JSON.parse(request('GET', 'http://127.0.0.1:9998/patched', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(replicaReadResponse).to.deep.equal({'name': 'John Smith', 'age': 33, 'address': {'city': 'Leeds'}});
+
+        /*
+         * Check that changed fields were reindexed and unchanged fields still match
+         */
+        let search = (criterion) => JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [criterion]}}).getBody().toString('utf8')).information.total_matches;
+
+        expect(search({'equals': {'age': 32}})).to.equal(0);
+        expect(search({'equals': {'age': 33}})).to.equal(1);
+        expect(search({'equals': {'address.city': 'leeds'}})).to.equal(1);
+        expect(search({'equals': {'address.country': 'uk'}})).to.equal(0);
+        expect(search({'contains': {'name': 'smith'}})).to.equal(1);
+
+    });
+
+
+    it('can be updated with a JSON patch', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/patched?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'John Smith', 'tags': ['a', 'b'], 'a/b': 1}});
+
+        let operations = [
+            {'op': 'test', 'path': '/name', 'value': 'John Smith'},
+            {'op': 'add', 'path': '/tags/1', 'value': 'c'},
+            {'op': 'add', 'path': '/tags/-', 'value': 'd'},
+            {'op': 'move', 'from': '/a~1b', 'path': '/count'},
+            {'op': 'copy', 'from': '/name', 'path': '/nickname'},
+            {'op': 'replace', 'path': '/name', 'value': 'Johnny Smith'},
+            {'op': 'remove', 'path': '/tags/0'}
+        ];
+
+        let patchedResponse = JSON.parse(request('PATCH', 'http://127.0.0.1:9999/patched?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'Content-Type': 'application/json-patch+json'}, 'body': JSON.stringify(operations)}).getBody().toString('utf8'));
+
+        expect(patchedResponse.success).to.be.true;
+
+        let readResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/patched', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(readResponse).to.deep.equal({'name': 'Johnny Smith', 'nickname': 'John Smith', 'tags': ['c', 'b', 'd'], 'count': 1});
+
+    });
+
+
+    it('return an error if a patch cannot be applied', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/patched?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'John Smith', 'age': 32}});
+
+        let operations = [
+            {'op': 'replace', 'path': '/age', 'value': 33},
+            {'op': 'test', 'path': '/name', 'value': 'Jane Smith'}
+        ];
+
+        try
+        {
+
+            request('PATCH', 'http://127.0.0.1:9999/patched', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': JSON.stringify(operations)}).getBody();
+
+            expect(true).to.equal(false);
+
+        }
+
+        catch (error)
+        {
+
+            expect(error.statusCode).to.equal(422);
+
+            let failedPatchResponse = JSON.parse(error.body.toString('utf8'));
+
+            expect(failedPatchResponse).to.deep.equal(
+                {
+                    'errors': ["Operation 1 failed: value at '/name' does not match"],
+                    'id': 'patched',
+                    'message': 'Patch could not be applied',
+                    'success': false
+                }
+            );
+
+        }
+
+        /*
+         * Nothing should have changed
+         */
+        let readResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/patched', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(readResponse).to.deep.equal({'name': 'John Smith', 'age': 32});
+
+        let missingResponse = request('PATCH', 'http://127.0.0.1:9999/missing', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': '{"age": 33}'});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('have versions that increase with every change', () =>
+    {
+
+        let createdResponse = request('PUT', 'http://127.0.0.1:9999/versioned?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'bar'}});
+
+        expect(JSON.parse(createdResponse.getBody().toString('utf8')).version).to.equal(1);
+        expect(createdResponse.headers['x-document-version']).to.equal('1');
+
+        let updatedResponse = request('PUT', 'http://127.0.0.1:9999/versioned?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'baz'}});
+
+        expect(JSON.parse(updatedResponse.getBody().toString('utf8')).version).to.equal(2);
+
+        /*
+         * Replicas report the same version and entity tag
+         */
+        let readResponse = request('GET', 'http://127.0.0.1:9999/versioned', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        let replicaReadResponse = request('GET', 'http://127.0.0.1:9998/versioned', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(readResponse.headers['x-document-version']).to.equal('2');
+        expect(readResponse.headers['etag']).to.equal(updatedResponse.headers['etag']);
+        expect(replicaReadResponse.headers['x-document-version']).to.equal('2');
+        expect(replicaReadResponse.headers['etag']).to.equal(updatedResponse.headers['etag']);
+
+        /*
+         * Versions keep counting up after a document is removed
+         */
+        request('DELETE', 'http://127.0.0.1:9999/versioned?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        let recreatedResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/versioned?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'bar'}}).getBody().toString('utf8'));
+
+        expect(recreatedResponse.version).to.equal(4);
+
+    });
+
+
+    it('reject conflicting writes', () =>
+    {
+
+        let createdResponse = request('PUT', 'http://127.0.0.1:9999/versioned?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'bar'}});
+        let etag = createdResponse.headers['etag'];
+
+        /*
+         * Write conditionally on the version
+         */
+        let conditionalResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/versioned?if_version=1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'baz'}}).getBody().toString('utf8'));
+
+        expect(conditionalResponse.version).to.equal(2);
+
+        let conflictingResponse = request('PUT', 'http://127.0.0.1:9999/versioned?if_version=1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'foo': 'qux'}});
+
+        expect(conflictingResponse.statusCode).to.equal(409);
+        expect(JSON.parse(conflictingResponse.body.toString('utf8'))).to.deep.equal(
+            {
+                'id': 'versioned',
+                'message': 'Document is at version 2, not version 1',
+                'success': false
+            }
+        );
+
+        /*
+         * Write conditionally on the entity tag, which is now out of date
+         */
+        let conflictingPatchResponse = request('PATCH', 'http://127.0.0.1:9999/versioned', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'If-Match': etag}, 'body': '{"foo": "qux"}'});
+
+        expect(conflictingPatchResponse.statusCode).to.equal(409);
+
+        let conflictingDeleteResponse = request('DELETE', 'http://127.0.0.1:9999/versioned', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'If-Match': etag}});
+
+        expect(conflictingDeleteResponse.statusCode).to.equal(409);
+
+        let readResponse = request('GET', 'http://127.0.0.1:9999/versioned', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(JSON.parse(readResponse.getBody().toString('utf8'))).to.deep.equal({'foo': 'baz'});
+
+        let deletedResponse = request('DELETE', 'http://127.0.0.1:9999/versioned', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'If-Match': readResponse.headers['etag']}});
+
+        expect(deletedResponse.statusCode).to.equal(200);
+
+    });
+
+
     it('can be truncated', () =>
     {
 
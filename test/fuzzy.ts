@@ -0,0 +1,107 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Fuzzy searches', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/fuzzy/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        request('PUT', 'http://127.0.0.1:9999/fuzzy/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'code': {'type': 'keyword'}}}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/fuzzy/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Joe Smith', 'code': 'AB-123'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/fuzzy/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Jane Smythe', 'code': 'AB-456'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/fuzzy/3?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Sam Jones', 'code': 'CD-123'}}).getBody();
+    });
+
+
+    /*
+     * Get the results of a search for a criterion, sorted by ID
+     */
+    function search(criterion)
+    {
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9998/fuzzy/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [criterion]}}).getBody().toString('utf8'));
+
+        return response.results.sort((first, second) => first.id < second.id ? -1 : 1);
+    }
+
+
+    /*
+     * Get the sorted IDs of the documents matching a criterion
+     */
+    function searchIds(criterion)
+    {
+        return search(criterion).map((result) => result.id);
+    }
+
+
+    it('match words within the allowed number of edits', () =>
+    {
+
+        expect(searchIds({'fuzzy': {'name': 'Smyth'}})).to.deep.equal(['1', '2']);
+        expect(searchIds({'fuzzy': {'name': 'Smiht'}})).to.deep.equal([]);
+        expect(searchIds({'fuzzy': {'name': {'value': 'Smiht', 'fuzziness': 2}}})).to.deep.equal(['1']);
+        expect(searchIds({'fuzzy': {'name': {'value': 'Smoth', 'fuzziness': 0}}})).to.deep.equal([]);
+        expect(searchIds({'fuzzy': {'name': 'Jo'}})).to.deep.equal([]);
+        expect(searchIds({'fuzzy': {'name': {'value': 'Jo', 'fuzziness': 1}}})).to.deep.equal(['1']);
+
+    });
+
+
+    it('require every word to be matched', () =>
+    {
+
+        expect(searchIds({'fuzzy': {'name': 'Jane Smoth'}})).to.deep.equal(['2']);
+        expect(searchIds({'fuzzy': {'name': 'Jone Smoth'}})).to.deep.equal(['1', '2']);
+        expect(searchIds({'fuzzy': {'name': 'Jake Jonas'}})).to.deep.equal([]);
+
+    });
+
+
+    it('can require a prefix to match exactly', () =>
+    {
+
+        expect(searchIds({'fuzzy': {'name': {'value': 'Smyth', 'prefix_length': 3}}})).to.deep.equal(['2']);
+        expect(searchIds({'fuzzy': {'name': {'value': 'Smyth', 'prefix_length': 2}}})).to.deep.equal(['1', '2']);
+
+    });
+
+
+    it('match the whole values of keyword fields', () =>
+    {
+
+        expect(searchIds({'fuzzy': {'code': 'ab-124'}})).to.deep.equal(['1']);
+        expect(searchIds({'fuzzy': {'code': {'value': 'AB-1', 'fuzziness': 2}}})).to.deep.equal(['1']);
+        expect(searchIds({'fuzzy': {'code': 'AB'}})).to.deep.equal([]);
+
+    });
+
+
+    it('report the terms they matched', () =>
+    {
+
+        let results = search({'fuzzy': {'name': 'Smyth'}});
+
+        expect(results[0].matched_terms).to.deep.equal({'name': ['smith']});
+        expect(results[1].matched_terms).to.deep.equal({'name': ['smyth']});
+
+        let plainResults = search({'prefix': {'name': 'smi'}});
+
+        expect(plainResults[0].matched_terms).to.equal(undefined);
+
+    });
+
+
+});
@@ -0,0 +1,92 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Highlighting', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/highlighting/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        request('PUT', 'http://127.0.0.1:9999/highlighting/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'title': 'The quick brown fox jumps over the lazy dog.', 'tags': ['animals', 'Foxes']}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/highlighting/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'title': 'Nothing to see here', 'tags': ['fox']}}).getBody();
+    });
+
+
+    /*
+     * Get the results of a search, sorted by ID
+     */
+    function search(body)
+    {
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9998/highlighting/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': body}).getBody().toString('utf8'));
+
+        return response.results.sort((first, second) => first.id < second.id ? -1 : 1);
+    }
+
+
+    it('wrap the matched terms of each field in tags', () =>
+    {
+
+        let results = search({'or': [{'contains': {'title': 'lazy dogs'}}, {'contains': {'tags': 'fox'}}], 'highlight': {}});
+
+        expect(results[0].highlight).to.deep.equal({'title': ['The quick brown fox jumps over the <em>lazy</em> <em>dog</em>.'], 'tags': ['<em>Foxes</em>']});
+        expect(results[1].highlight).to.deep.equal({'tags': ['<em>fox</em>']});
+
+        let customResults = search({'and': [{'match_phrase': {'title': {'query': 'quick fox', 'slop': 1}}}], 'highlight': {'pre_tag': '[', 'post_tag': ']', 'fields': ['title']}});
+
+        expect(customResults[0].highlight).to.deep.equal({'title': ['The [quick] brown [fox] jumps over the lazy dog.']});
+
+    });
+
+
+    it('break long fields into fragments', () =>
+    {
+
+        let results = search({'and': [{'contains': {'title': 'brown'}}, {'contains': {'title': 'dog'}}], 'highlight': {'fragment_size': 20}});
+
+        expect(results[0].highlight).to.deep.equal({'title': ['<em>brown</em> fox jumps over', 'lazy <em>dog</em>.']});
+
+        let limitedResults = search({'and': [{'contains': {'title': 'brown'}}, {'contains': {'title': 'dog'}}], 'highlight': {'fragment_size': 20, 'number_of_fragments': 1}});
+
+        expect(limitedResults[0].highlight).to.deep.equal({'title': ['<em>brown</em> fox jumps over']});
+
+    });
+
+
+    it('include fuzzy matches', () =>
+    {
+
+        let results = search({'and': [{'fuzzy': {'title': 'lazzy'}}], 'highlight': {'fragment_size': 0}});
+
+        expect(results[0].highlight).to.deep.equal({'title': ['The quick brown fox jumps over the <em>lazy</em> dog.']});
+
+    });
+
+
+    it('are only returned when asked for', () =>
+    {
+
+        let results = search({'and': [{'contains': {'title': 'lazy'}}]});
+
+        expect(results[0].highlight).to.equal(undefined);
+
+        let response = request('POST', 'http://127.0.0.1:9998/highlighting/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [], 'highlight': {'fragment_size': 'big'}}});
+
+        expect(response.statusCode).to.equal(400);
+
+    });
+
+
+});
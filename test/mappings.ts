@@ -0,0 +1,160 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Mappings', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Truncate the collection and clear its mapping
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/mapped/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        request('PUT', 'http://127.0.0.1:9999/mapped/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {}}});
+
+        sleep(250);
+    });
+
+
+    it('can be set and retrieved', () =>
+    {
+
+        let mapping = {'strict': true, 'fields': {'name': {'type': 'text'}, 'age': {'type': 'number'}}};
+
+        let putResponse = JSON.parse(request('PUT', 'http://127.0.0.1:9999/mapped/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': mapping}).getBody().toString('utf8'));
+
+        expect(putResponse.success).to.equal(true);
+        expect(putResponse.mapping).to.deep.equal(mapping);
+
+        /*
+         * Peers know about the mapping too
+         */
+        let getResponse = JSON.parse(request('GET', 'http://127.0.0.1:9998/mapped/_mapping', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(getResponse).to.deep.equal({'collection': 'mapped', 'mapping': mapping});
+
+    });
+
+
+    it('reject invalid field types', () =>
+    {
+
+        let response = request('PUT', 'http://127.0.0.1:9999/mapped/_mapping', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'name': {'type': 'string'}}}});
+
+        expect(response.statusCode).to.equal(400);
+        expect(JSON.parse(response.body.toString('utf8')).message).to.equal("Field 'name' must have a type of keyword, text, number, date, boolean or not_indexed");
+
+    });
+
+
+    it('only match keyword fields in full', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/mapped/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'code': {'type': 'keyword'}, 'name': {'type': 'text'}}}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/mapped/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'code': 'ABC DEF', 'name': 'ABC DEF'}}).getBody();
+
+        let keywordResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'contains': {'code': 'abc'}}]}}).getBody().toString('utf8'));
+
+        expect(keywordResponse.information.total_matches).to.equal(0);
+
+        let fullResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'contains': {'code': 'ABC DEF'}}]}}).getBody().toString('utf8'));
+
+        expect(fullResponse.information.total_matches).to.equal(1);
+
+        let textResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'contains': {'name': 'abc'}}]}}).getBody().toString('utf8'));
+
+        expect(textResponse.information.total_matches).to.equal(1);
+
+    });
+
+
+    it('convert values to their field types', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/mapped/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'age': {'type': 'number'}, 'joined': {'type': 'date'}}}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/mapped/1?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'age': '30', 'joined': '2020-01-01T01:00:00+01:00'}}).getBody();
+
+        let numberResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'gte': {'age': 30}}]}}).getBody().toString('utf8'));
+
+        expect(numberResponse.information.total_matches).to.equal(1);
+
+        let dateResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'equals': {'joined': '2020-01-01'}}]}}).getBody().toString('utf8'));
+
+        expect(dateResponse.information.total_matches).to.equal(1);
+
+        /*
+         * Values that cannot be converted never match, so every document
+         * matches their negation
+         */
+        let unconvertibleResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'equals': {'age': 'abc'}}]}}).getBody().toString('utf8'));
+
+        expect(unconvertibleResponse.information.total_matches).to.equal(0);
+
+        let negatedResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'not_equals': {'age': 'abc'}}]}}).getBody().toString('utf8'));
+
+        expect(negatedResponse.information.total_matches).to.equal(1);
+
+    });
+
+
+    it('reindex existing documents', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/mapped/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'day': '2020-01-01', 'secret': 'hidden'}}).getBody();
+
+        let beforeResponse = JSON.parse(request('POST', 'http://127.0.0.1:9998/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'gte': {'day': '2019-01-01'}}]}}).getBody().toString('utf8'));
+
+        expect(beforeResponse.information.total_matches).to.equal(1);
+
+        request('PUT', 'http://127.0.0.1:9999/mapped/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'day': {'type': 'text'}, 'secret': {'type': 'not_indexed'}}}}).getBody();
+
+        /*
+         * Text fields cannot be searched by range, and fields that aren't
+         * indexed cannot be searched at all
+         */
+        let rangeResponse = JSON.parse(request('POST', 'http://127.0.0.1:9998/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'gte': {'day': '2019-01-01'}}]}}).getBody().toString('utf8'));
+
+        expect(rangeResponse.information.total_matches).to.equal(0);
+
+        let secretResponse = JSON.parse(request('POST', 'http://127.0.0.1:9998/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'equals': {'secret': 'hidden'}}]}}).getBody().toString('utf8'));
+
+        expect(secretResponse.information.total_matches).to.equal(0);
+
+        let notSecretResponse = JSON.parse(request('POST', 'http://127.0.0.1:9998/mapped/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'not_contains': {'secret': 'hidden'}}]}}).getBody().toString('utf8'));
+
+        expect(notSecretResponse.information.total_matches).to.equal(1);
+
+    });
+
+
+    it('reject non-conforming documents when strict', () =>
+    {
+
+        request('PUT', 'http://127.0.0.1:9999/mapped/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'strict': true, 'fields': {'age': {'type': 'number'}}}}).getBody();
+
+        let putResponse = request('PUT', 'http://127.0.0.1:9999/mapped/1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'age': 'thirty'}});
+
+        expect(putResponse.statusCode).to.equal(400);
+        expect(JSON.parse(putResponse.body.toString('utf8')).message).to.equal("Field 'age' must hold a number");
+
+        let bulkBody = '{"index": {"id": "2"}}\n{"age": "thirty"}\n{"index": {"id": "3"}}\n{"age": 30}\n';
+        let bulkResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/mapped/_bulk?wait_for=indexed', {'headers': {'Authorization': 'Basic ' + btoa('root:password'), 'Content-Type': 'application/x-ndjson'}, 'body': bulkBody}).getBody().toString('utf8'));
+
+        expect(bulkResponse.items[0].success).to.equal(false);
+        expect(bulkResponse.items[1].success).to.equal(true);
+
+        let patchResponse = request('PATCH', 'http://127.0.0.1:9999/mapped/3', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'age': 'thirty'}});
+
+        expect(patchResponse.statusCode).to.equal(422);
+
+    });
+
+
+});
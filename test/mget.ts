@@ -0,0 +1,80 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as btoa from 'btoa';
+
+
+describe('Multi-get', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create some documents to fetch
+     */
+    beforeEach(() =>
+    {
+        let lines = [
+            JSON.stringify({'index': {'id': 'apple'}}), JSON.stringify({'name': 'Apple', 'colour': 'red', 'price': {'amount': 30, 'currency': 'GBP'}}),
+            JSON.stringify({'index': {'id': 'banana'}}), JSON.stringify({'name': 'Banana', 'colour': 'yellow', 'price': {'amount': 20, 'currency': 'GBP'}})
+        ];
+
+        request('POST', 'http://127.0.0.1:9999/fruit/_bulk', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': lines.join('\n') + '\n'}).getBody();
+    });
+
+
+    /*
+     * Fetch some documents by their IDs
+     */
+    function multiGet(body, params = '')
+    {
+        return request('POST', 'http://127.0.0.1:9999/fruit/_mget' + params, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': body});
+    }
+
+
+    it('returns documents in the order requested', () =>
+    {
+
+        let response = JSON.parse(multiGet({'ids': ['banana', 'cherry', 'apple']}).getBody().toString('utf8'));
+
+        expect(response.documents.length).to.equal(3);
+
+        expect(response.documents[0].id).to.equal('banana');
+        expect(response.documents[0].found).to.equal(true);
+        expect(response.documents[0].version).to.equal(1);
+        expect(response.documents[0].document).to.deep.equal({'name': 'Banana', 'colour': 'yellow', 'price': {'amount': 20, 'currency': 'GBP'}});
+
+        expect(response.documents[1]).to.deep.equal({'id': 'cherry', 'found': false});
+
+        expect(response.documents[2].id).to.equal('apple');
+        expect(response.documents[2].found).to.equal(true);
+
+    });
+
+
+    it('can select fields', () =>
+    {
+
+        let response = JSON.parse(multiGet({'ids': ['apple', 'banana']}, '?fields=name,price&exclude=price.currency').getBody().toString('utf8'));
+
+        expect(response.documents[0].document).to.deep.equal({'name': 'Apple', 'price': {'amount': 30}});
+        expect(response.documents[1].document).to.deep.equal({'name': 'Banana', 'price': {'amount': 20}});
+
+    });
+
+
+    it('requires an array of IDs', () =>
+    {
+
+        expect(multiGet({}).statusCode).to.equal(400);
+        expect(multiGet({'ids': [1, 2]}).statusCode).to.equal(400);
+
+        let missingResponse = request('POST', 'http://127.0.0.1:9999/vegetables/_mget', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'ids': ['carrot']}});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+    });
+
+
+});
@@ -0,0 +1,139 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Paging', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/paging/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        let lines = [];
+
+        for (let i = 1; i <= 7; i++)
+        {
+            lines.push(JSON.stringify({'index': {'id': 'doc' + i}}), JSON.stringify({'rank': i % 3, 'name': 'Document ' + i}));
+        }
+
+        request('POST', 'http://127.0.0.1:9999/paging/_bulk?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': lines.join('\n') + '\n'}).getBody();
+    });
+
+
+    /*
+     * Search the collection on a node with some URL parameters
+     */
+    function search(port, params, body)
+    {
+        return JSON.parse(request('POST', 'http://127.0.0.1:' + port + '/paging/_search' + params, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': body}).getBody().toString('utf8'));
+    }
+
+
+    /*
+     * Get the next page of a scroll
+     */
+    function scroll(scrollId)
+    {
+        return JSON.parse(request('GET', 'http://127.0.0.1:9998/_search/scroll?scroll=30s&scroll_id=' + scrollId, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+    }
+
+
+    it('can continue after a cursor', () =>
+    {
+
+        let body = {'sort': ['rank', {'field': 'name', 'order': 'desc'}]};
+        let first = search(9998, '?size=3', body);
+
+        expect(first.results.map((result) => result.id)).to.deep.equal(['doc6', 'doc3', 'doc7']);
+        expect(first.information.search_after).to.be.a('string');
+
+        /*
+         * Documents added before the cursor don't shift the next page
+         */
+        request('PUT', 'http://127.0.0.1:9999/paging/doc0?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'rank': 0, 'name': 'Document 0'}}).getBody();
+
+        let second = search(9997, '?size=3&search_after=' + first.information.search_after, body);
+
+        expect(second.results.map((result) => result.id)).to.deep.equal(['doc4', 'doc1', 'doc5']);
+
+        let third = search(9999, '?size=3&search_after=' + second.information.search_after, body);
+
+        expect(third.results.map((result) => result.id)).to.deep.equal(['doc2']);
+        expect(third.information.search_after).to.equal(undefined);
+
+    });
+
+
+    it('reject cursors that do not fit the search', () =>
+    {
+
+        let first = search(9998, '?size=3', {'sort': 'rank'});
+        let response = request('POST', 'http://127.0.0.1:9998/paging/_search?search_after=' + first.information.search_after, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {}});
+
+        expect(response.statusCode).to.equal(400);
+
+        let invalidResponse = request('POST', 'http://127.0.0.1:9998/paging/_search?search_after=nonsense', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {}});
+
+        expect(invalidResponse.statusCode).to.equal(400);
+
+    });
+
+
+    it('can scroll through a snapshot of the results', () =>
+    {
+
+        let first = search(9998, '?size=3&scroll=30s&fields=rank', {'sort': 'rank'});
+        let scrollId = first.information.scroll_id;
+
+        expect(first.information.total_matches).to.equal(7);
+        expect(first.results.map((result) => result.id)).to.deep.equal(['doc3', 'doc6', 'doc1']);
+        expect(first.results[0].document).to.deep.equal({'rank': 0});
+
+        /*
+         * Later changes don't add to the scroll, but removed documents are
+         * left out
+         */
+        request('PUT', 'http://127.0.0.1:9999/paging/doc0?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'rank': 0}}).getBody();
+        request('DELETE', 'http://127.0.0.1:9999/paging/doc4?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody();
+
+        expect(scroll(scrollId).results.map((result) => result.id)).to.deep.equal(['doc7', 'doc2']);
+        expect(scroll(scrollId).results.map((result) => result.id)).to.deep.equal(['doc5']);
+        expect(scroll(scrollId).results).to.deep.equal([]);
+
+        let clearResponse = request('DELETE', 'http://127.0.0.1:9998/_search/scroll?scroll_id=' + scrollId, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(clearResponse.statusCode).to.equal(200);
+
+        let missingResponse = request('GET', 'http://127.0.0.1:9998/_search/scroll?scroll_id=' + scrollId, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('reject invalid scrolls', () =>
+    {
+
+        let durationResponse = request('POST', 'http://127.0.0.1:9998/paging/_search?scroll=forever', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {}});
+
+        expect(durationResponse.statusCode).to.equal(400);
+
+        let aggregationResponse = request('POST', 'http://127.0.0.1:9998/paging/_search?scroll=1m', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'aggregations': {'ranks': {'stats': {'field': 'rank'}}}}});
+
+        expect(aggregationResponse.statusCode).to.equal(400);
+
+    });
+
+
+});
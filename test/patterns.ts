@@ -0,0 +1,85 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Pattern searches', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/patterns/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        request('PUT', 'http://127.0.0.1:9999/patterns/_mapping?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'fields': {'code': {'type': 'keyword'}}}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/patterns/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Joe Smith', 'code': 'AB-123'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/patterns/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Jane Smythe', 'code': 'AB-456'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/patterns/3?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Sam Jones', 'code': 'CD-123'}}).getBody();
+    });
+
+
+    /*
+     * Get the sorted IDs of the documents matching a criterion
+     */
+    function search(criterion)
+    {
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9998/patterns/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [criterion]}}).getBody().toString('utf8'));
+
+        return response.results.map((result) => result.id).sort();
+    }
+
+
+    it('match words by prefix', () =>
+    {
+
+        expect(search({'prefix': {'name': 'Sm'}})).to.deep.equal(['1', '2']);
+        expect(search({'prefix': {'name': 'j'}})).to.deep.equal(['1', '2', '3']);
+        expect(search({'prefix': {'name': 'x'}})).to.deep.equal([]);
+
+    });
+
+
+    it('match words by wildcard and regular expression', () =>
+    {
+
+        expect(search({'wildcard': {'name': 'sm?th*'}})).to.deep.equal(['1', '2']);
+        expect(search({'wildcard': {'name': 'j?n*'}})).to.deep.equal(['2', '3']);
+        expect(search({'regexp': {'name': 'sm(i|y)th'}})).to.deep.equal(['1', '2']);
+        expect(search({'regexp': {'name': 'smi.+'}})).to.deep.equal(['1']);
+        expect(search({'regexp': {'name': '(unclosed'}})).to.deep.equal([]);
+
+    });
+
+
+    it('match keywords in full', () =>
+    {
+
+        expect(search({'prefix': {'code': 'ab-'}})).to.deep.equal(['1', '2']);
+        expect(search({'wildcard': {'code': '*-123'}})).to.deep.equal(['1', '3']);
+        expect(search({'prefix': {'code': '123'}})).to.deep.equal([]);
+
+    });
+
+
+    it('forget terms of removed documents', () =>
+    {
+
+        request('DELETE', 'http://127.0.0.1:9999/patterns/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody();
+        request('PATCH', 'http://127.0.0.1:9999/patterns/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': 'Joe Bloggs'}}).getBody();
+
+        expect(search({'prefix': {'name': 'sm'}})).to.deep.equal([]);
+        expect(search({'prefix': {'name': 'blo'}})).to.deep.equal(['1']);
+
+    });
+
+
+});
@@ -0,0 +1,168 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+import * as child_process from 'child_process';
+import * as fs from 'fs';
+import * as os from 'os';
+import * as path from 'path';
+
+
+describe('Percolator', function()
+{
+
+
+    this.timeout(10000);
+
+
+    /*
+     * Register a percolator query against the alerts collection
+     */
+    function registerQuery(name, body)
+    {
+        return request('PUT', 'http://127.0.0.1:9999/alerts/_percolator/' + name, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': body});
+    }
+
+
+    /*
+     * Get the recent matches of a percolator query from a node
+     */
+    function getMatches(port, name)
+    {
+        return JSON.parse(request('GET', 'http://127.0.0.1:' + port + '/alerts/_percolator/' + name + '/_matches', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8')).matches;
+    }
+
+
+    it('can register, list and remove queries', () =>
+    {
+
+        let response = JSON.parse(registerQuery('urgent', {'and': [{'equals': {'priority': 'urgent'}}]}).getBody().toString('utf8'));
+
+        expect(response.success).to.equal(true);
+        expect(response.query).to.deep.equal({'name': 'urgent', 'collection': 'alerts', 'criteria': {'and': [{'equals': {'priority': 'urgent'}}]}});
+
+        let listResponse = JSON.parse(request('GET', 'http://127.0.0.1:9998/alerts/_percolator', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(listResponse.queries.map((query) => query.name)).to.include('urgent');
+
+        let deleteResponse = request('DELETE', 'http://127.0.0.1:9999/alerts/_percolator/urgent', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(deleteResponse.statusCode).to.equal(200);
+
+        let missingResponse = request('GET', 'http://127.0.0.1:9998/alerts/_percolator/urgent', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('rejects invalid queries', () =>
+    {
+
+        expect(registerQuery('broken', {'and': ['priority']}).statusCode).to.equal(400);
+        expect(registerQuery('broken', {'and': [{'or': 'priority'}]}).statusCode).to.equal(400);
+        expect(registerQuery('broken', {'webhook': 'ftp://127.0.0.1/hook'}).statusCode).to.equal(400);
+
+        // Writers cannot register queries, as webhooks make outbound requests
+        request('POST', 'http://127.0.0.1:9999/_user', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'action': 'create', 'username': 'percolator-writer', 'password': 'password'}}).getBody();
+
+        sleep(250);
+
+        let forbiddenResponse = request('PUT', 'http://127.0.0.1:9999/alerts/_percolator/broken', {'headers': {'Authorization': 'Basic ' + btoa('percolator-writer:password')}, 'json': {}});
+
+        request('POST', 'http://127.0.0.1:9999/_user', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'action': 'delete', 'username': 'percolator-writer'}}).getBody();
+
+        expect(forbiddenResponse.statusCode).to.equal(403);
+
+    });
+
+
+    it('rejects invalid collection names', () =>
+    {
+
+        let headers = {'Authorization': 'Basic ' + btoa('root:password')};
+
+        expect(request('GET', 'http://127.0.0.1:9999/Alerts!/_percolator', {'headers': headers}).statusCode).to.equal(400);
+        expect(request('GET', 'http://127.0.0.1:9999/Alerts!/_percolator/urgent', {'headers': headers}).statusCode).to.equal(400);
+        expect(request('DELETE', 'http://127.0.0.1:9999/Alerts!/_percolator/urgent', {'headers': headers}).statusCode).to.equal(400);
+        expect(request('GET', 'http://127.0.0.1:9999/Alerts!/_percolator/urgent/_matches', {'headers': headers}).statusCode).to.equal(400);
+        expect(request('POST', 'http://127.0.0.1:9999/Alerts!/_percolate', {'headers': headers, 'json': {'priority': 'urgent'}}).statusCode).to.equal(400);
+
+    });
+
+
+    it('finds the queries a document matches', () =>
+    {
+
+        registerQuery('red', {'and': [{'equals': {'colour': 'red'}}]}).getBody();
+        registerQuery('large', {'and': [{'gte': {'size': 10}}]}).getBody();
+
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9997/alerts/_percolate', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'colour': 'red', 'size': 12}}).getBody().toString('utf8'));
+
+        expect(response.matches).to.deep.equal(['large', 'red']);
+
+        let noMatchResponse = JSON.parse(request('POST', 'http://127.0.0.1:9997/alerts/_percolate', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'colour': 'blue', 'size': 2}}).getBody().toString('utf8'));
+
+        expect(noMatchResponse.matches).to.deep.equal([]);
+
+    });
+
+
+    it('records matches and calls webhooks as documents are stored', () =>
+    {
+
+        // Stand in for a webhook with a server that writes out what it is sent
+        let received = path.join(os.tmpdir(), 'memdb-webhook-' + process.pid + '.ndjson');
+        let server = child_process.spawn('node', ['-e', `
+            require('http').createServer((request, response) => {
+                let body = '';
+                request.on('data', (chunk) => body += chunk);
+                request.on('end', () => { require('fs').appendFileSync(process.argv[1], body + '\\n'); response.end(); });
+            }).listen(9996);
+        `, received]);
+
+        try
+        {
+            sleep(500);
+
+            registerQuery('outage', {'and': [{'contains': {'message': 'outage'}}], 'webhook': 'http://127.0.0.1:9996/hook'}).getBody();
+
+            request('PUT', 'http://127.0.0.1:9998/alerts/first?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'message': 'Power outage reported'}}).getBody();
+            request('PUT', 'http://127.0.0.1:9998/alerts/second?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'message': 'All systems normal'}}).getBody();
+
+            let bulkLines = [JSON.stringify({'index': {'id': 'third'}}), JSON.stringify({'message': 'Network outage'})];
+
+            request('POST', 'http://127.0.0.1:9999/alerts/_bulk?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': bulkLines.join('\n') + '\n'}).getBody();
+
+            sleep(500);
+
+            // Matches are recorded by the node that stored the document
+            expect(getMatches(9998, 'outage').map((match) => match.id)).to.deep.equal(['first']);
+            expect(getMatches(9999, 'outage').map((match) => match.id)).to.deep.equal(['third']);
+
+            let payloads = fs.readFileSync(received, 'utf8').split('\n').filter((line) => line !== '').map((line) => JSON.parse(line));
+
+            payloads.sort((first, second) => first.id < second.id ? -1 : 1);
+
+            expect(payloads.length).to.equal(2);
+            expect(payloads[0].query).to.equal('outage');
+            expect(payloads[0].collection).to.equal('alerts');
+            expect(payloads[0].id).to.equal('first');
+            expect(payloads[0].version).to.equal(1);
+            expect(payloads[0].document).to.deep.equal({'message': 'Power outage reported'});
+            expect(payloads[1].id).to.equal('third');
+        }
+        finally
+        {
+            server.kill();
+
+            if (fs.existsSync(received))
+            {
+                fs.unlinkSync(received);
+            }
+        }
+
+    });
+
+
+});
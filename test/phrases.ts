@@ -0,0 +1,73 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Phrase searches', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/phrases/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        request('PUT', 'http://127.0.0.1:9999/phrases/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'title': 'The quick brown fox jumps over the lazy dog'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/phrases/2?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'title': 'A lazy dog and a quick fox'}}).getBody();
+        request('PUT', 'http://127.0.0.1:9999/phrases/3?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'tags': ['quick', 'fox']}}).getBody();
+    });
+
+
+    /*
+     * Get the sorted IDs of the documents matching a criterion
+     */
+    function search(criterion)
+    {
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9997/phrases/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [criterion]}}).getBody().toString('utf8'));
+
+        return response.results.map((result) => result.id).sort();
+    }
+
+
+    it('match phrases of any length', () =>
+    {
+
+        expect(search({'contains': {'title': 'quick brown fox jumps over the lazy'}})).to.deep.equal(['1']);
+        expect(search({'contains': {'title': 'jumping over the lazy dogs'}})).to.deep.equal(['1']);
+        expect(search({'contains': {'title': 'fox brown'}})).to.deep.equal([]);
+        expect(search({'not_contains': {'title': 'lazy dog'}})).to.deep.equal(['3']);
+        expect(search({'not_contains': {'title': 'unicorn'}})).to.deep.equal(['1', '2', '3']);
+
+    });
+
+
+    it('allow terms to move by the slop', () =>
+    {
+
+        expect(search({'match_phrase': {'title': 'quick fox'}})).to.deep.equal(['2']);
+        expect(search({'match_phrase': {'title': {'query': 'quick fox', 'slop': 1}}})).to.deep.equal(['1', '2']);
+        expect(search({'match_phrase': {'title': {'query': 'dog lazy', 'slop': 1}}})).to.deep.equal([]);
+        expect(search({'match_phrase': {'title': {'query': 'dog lazy', 'slop': 2}}})).to.deep.equal(['1', '2']);
+
+    });
+
+
+    it('do not run across array values', () =>
+    {
+
+        expect(search({'contains': {'tags': 'quick'}})).to.deep.equal(['3']);
+        expect(search({'contains': {'tags': 'quick fox'}})).to.deep.equal([]);
+        expect(search({'match_phrase': {'tags': {'query': 'quick fox', 'slop': 200}}})).to.deep.equal(['3']);
+
+    });
+
+
+});
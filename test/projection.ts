@@ -0,0 +1,76 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Field selection', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh document
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/projection/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        let document = {
+            'title': 'Hello',
+            'author': {'name': 'Joe Bloggs', 'email': 'joe@example.com'},
+            'comments': [{'body': 'First', 'score': 1}, {'body': 'Second', 'score': 2}],
+            'blob': 'aGVsbG8='
+        };
+
+        request('PUT', 'http://127.0.0.1:9999/projection/1?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document}).getBody();
+    });
+
+
+    /*
+     * Get a document with some URL parameters
+     */
+    function getDocument(params)
+    {
+        return JSON.parse(request('GET', 'http://127.0.0.1:9998/projection/1' + params, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+    }
+
+
+    it('can be applied when retrieving a document', () =>
+    {
+
+        expect(getDocument('?fields=title,author.name')).to.deep.equal({'title': 'Hello', 'author': {'name': 'Joe Bloggs'}});
+        expect(getDocument('?exclude=blob&exclude=author')).to.deep.equal({'title': 'Hello', 'comments': [{'body': 'First', 'score': 1}, {'body': 'Second', 'score': 2}]});
+        expect(getDocument('?fields=author&exclude=author.email')).to.deep.equal({'author': {'name': 'Joe Bloggs'}});
+        expect(getDocument('?fields=unknown')).to.deep.equal({});
+
+    });
+
+
+    it('can select fields inside arrays', () =>
+    {
+
+        expect(getDocument('?fields=comments.body')).to.deep.equal({'comments': [{'body': 'First'}, {'body': 'Second'}]});
+        expect(getDocument('?fields=comments.1')).to.deep.equal({'comments': [{'body': 'Second', 'score': 2}]});
+        expect(getDocument('?fields=comments&exclude=comments.0.score')).to.deep.equal({'comments': [{'body': 'First'}, {'body': 'Second', 'score': 2}]});
+
+    });
+
+
+    it('can be applied to search results', () =>
+    {
+
+        let criteria = {'and': [{'contains': {'comments.body': 'first'}}], 'aggregations': {'scores': {'stats': {'field': 'comments.score'}}}};
+        let response = JSON.parse(request('POST', 'http://127.0.0.1:9997/projection/_search?fields=title', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(response.results[0].document).to.deep.equal({'title': 'Hello'});
+        expect(response.aggregations.scores.sum).to.equal(3);
+
+    });
+
+
+});
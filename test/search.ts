@@ -17,6 +17,7 @@ var documents =
                         'last': 'Doe'
                     },
                 'age': 30,
+                'joined': '2017-06-01T09:00:00Z',
                 'interests': ['surfing', 'football']
             }
         },
@@ -31,6 +32,7 @@ var documents =
                         'last': 'Doe'
                     },
                 'age': 32,
+                'joined': '2018-01-15T12:30:00Z',
                 'interests': ['music', 'Cryptography']
             }
         },
@@ -45,6 +47,7 @@ var documents =
                         'last': 'Smith'
                     },
                 'age': 27,
+                'joined': '2018-03-02T18:45:00Z',
                 'interests': ['football games', 'painting']
             }
         }
@@ -106,6 +109,27 @@ describe('Search', function()
     });
 
 
+    it('returns an error if malformed criteria are supplied', () =>
+    {
+
+        for (let path of ['_search', '_count', '_delete', '_update_by_query', '_changes?timeout=1s'])
+        {
+
+            let response = request('POST', 'http://127.0.0.1:9999/' + path, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'or': [1]}], 'operations': [{'op': 'unset', 'field': 'name'}]}});
+
+            expect(response.statusCode).to.equal(400);
+            expect(JSON.parse(response.body.toString('utf8'))).to.deep.equal(
+                {
+                    'message': 'Each criterion must be an object',
+                    'success': false
+                }
+            );
+
+        }
+
+    });
+
+
     it('returns all documents when no criteria set', () =>
     {
 
@@ -289,7 +313,8 @@ describe('Search', function()
 
         let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
 
-        expect(responses.results).to.deep.equal([documents[2]]);
+        expect(responses.results.map((result) => ({'id': result.id, 'document': result.document}))).to.deep.equal([documents[2]]);
+        expect(responses.results[0]._score).to.be.above(0);
         expect(responses.criteria).to.deep.equal(criteria);
         expect(responses.information.total_matches).to.equal(1);
 
@@ -428,8 +453,10 @@ describe('Search', function()
 
         let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
 
-        expect(responses.results[0]).to.deep.equal(documents[0]);
-        expect(responses.results[1]).to.deep.equal(documents[2]);
+        expect(responses.results[0].document).to.deep.equal(documents[0].document);
+        expect(responses.results[0]._score).to.be.above(0);
+        expect(responses.results[1].document).to.deep.equal(documents[2].document);
+        expect(responses.results[1]._score).to.be.above(0);
         expect(responses.criteria).to.deep.equal(criteria);
         expect(responses.information.total_matches).to.equal(2);
 
@@ -446,6 +473,300 @@ describe('Search', function()
     });
 
 
+    it('returns documents with numeric range criteria', () =>
+    {
+
+        /*
+         * Create documents
+         */
+        documents.forEach((document) =>
+        {
+            request('PUT', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document.document})
+        });
+
+        sleep(500);
+
+        /*
+         * Greater than
+         */
+        let criteria =
+            {
+                'and':
+                    [
+                        {'gt': {'age': 27}}
+                    ]
+            };
+
+        let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(responses.results).to.deep.equal([documents[0], documents[1]]);
+        expect(responses.information.total_matches).to.equal(2);
+
+        /*
+         * Inclusive upper and lower bounds
+         */
+        let boundedCriteria =
+            {
+                'and':
+                    [
+                        {'gte': {'age': 27}},
+                        {'lte': {'age': 30}}
+                    ]
+            };
+
+        let boundedResponses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': boundedCriteria}).getBody().toString('utf8'));
+
+        expect(boundedResponses.results).to.deep.equal([documents[0], documents[2]]);
+        expect(boundedResponses.information.total_matches).to.equal(2);
+
+        /*
+         * Between
+         */
+        let betweenCriteria =
+            {
+                'and':
+                    [
+                        {'between': {'age': [28, 32]}}
+                    ]
+            };
+
+        let betweenResponses = JSON.parse(request('POST', 'http://127.0.0.1:9998/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': betweenCriteria}).getBody().toString('utf8'));
+
+        expect(betweenResponses.results).to.deep.equal([documents[0], documents[1]]);
+        expect(betweenResponses.information.total_matches).to.equal(2);
+
+        /*
+         * Remove documents
+         */
+        documents.forEach((document) =>
+        {
+            request('DELETE', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}})
+        });
+
+        sleep(500);
+
+    });
+
+
+    it('returns documents with date range criteria', () =>
+    {
+
+        /*
+         * Create documents
+         */
+        documents.forEach((document) =>
+        {
+            request('PUT', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document.document})
+        });
+
+        sleep(500);
+
+        /*
+         * Dates within 2018
+         */
+        let criteria =
+            {
+                'and':
+                    [
+                        {'between': {'joined': ['2018-01-01', '2018-12-31T23:59:59Z']}}
+                    ]
+            };
+
+        let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(responses.results).to.deep.equal([documents[1], documents[2]]);
+        expect(responses.information.total_matches).to.equal(2);
+
+        /*
+         * Dates before a timestamp with an offset
+         */
+        let beforeCriteria =
+            {
+                'and':
+                    [
+                        {'lt': {'joined': '2018-01-15T13:00:00+01:00'}}
+                    ]
+            };
+
+        let beforeResponses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': beforeCriteria}).getBody().toString('utf8'));
+
+        expect(beforeResponses.results).to.deep.equal([documents[0]]);
+        expect(beforeResponses.information.total_matches).to.equal(1);
+
+        /*
+         * Remove documents
+         */
+        documents.forEach((document) =>
+        {
+            request('DELETE', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}})
+        });
+
+        sleep(500);
+
+    });
+
+
+    it('returns documents sorted by custom fields', () =>
+    {
+
+        /*
+         * Create documents
+         */
+        documents.forEach((document) =>
+        {
+            request('PUT', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document.document})
+        });
+
+        request('PUT', 'http://127.0.0.1:9999/4', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'name': {'first': 'Anonymous'}}});
+
+        sleep(500);
+
+        /*
+         * Sort by a numeric field, descending
+         */
+        let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'sort': [{'field': 'age', 'order': 'desc'}]}}).getBody().toString('utf8'));
+
+        expect(responses.results.map((result) => result.id)).to.deep.equal(['2', '1', '3', '4']);
+        expect(responses.criteria).to.deep.equal({});
+        expect(responses.information.total_matches).to.equal(4);
+
+        /*
+         * Sort by several string fields, with criteria
+         */
+        let criteria =
+            {
+                'and':
+                    [
+                        {'gt': {'age': 0}}
+                    ],
+                'sort':
+                    [
+                        {'field': 'name.last'},
+                        {'field': 'name.first', 'order': 'asc'}
+                    ]
+            };
+
+        let sortedResponses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(sortedResponses.results).to.deep.equal([documents[1], documents[0], documents[2]]);
+        expect(sortedResponses.criteria).to.deep.equal({'and': [{'gt': {'age': 0}}]});
+
+        /*
+         * Paginate after sorting
+         */
+        let pagedResponses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search?size=2&from=1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'sort': 'joined'}}).getBody().toString('utf8'));
+
+        expect(pagedResponses.results.map((result) => result.id)).to.deep.equal(['2', '3']);
+        expect(pagedResponses.information.total_matches).to.equal(4);
+
+        /*
+         * Remove documents
+         */
+        documents.forEach((document) =>
+        {
+            request('DELETE', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}})
+        });
+
+        request('DELETE', 'http://127.0.0.1:9999/4', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(500);
+
+    });
+
+
+    it('returns an error if the sort clause is malformed', () =>
+    {
+
+        try
+        {
+
+            request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'sort': [{'field': 'age', 'order': 'sideways'}]}}).getBody();
+
+            expect(true).to.equal(false);
+
+        }
+
+        catch (error)
+        {
+
+            let badSortResponse = JSON.parse(error.body.toString('utf8'));
+
+            expect(badSortResponse).to.deep.equal(
+                {
+                    'message': 'Sort order must be \'asc\' or \'desc\'',
+                    'success': false
+                }
+            );
+
+        }
+
+    });
+
+
+    it('scores documents by relevance to contains criteria', () =>
+    {
+
+        let scoredDocuments =
+            [
+                {'id': 'a', 'document': {'title': 'A history of the Smith family', 'body': 'Smith, Smith and more Smith'}},
+                {'id': 'b', 'document': {'title': 'Gardening for beginners', 'body': 'Mentions Mr Smith once, in passing, amongst a great many other words about plants'}},
+                {'id': 'c', 'document': {'title': 'Smith', 'body': 'Smith'}},
+                {'id': 'd', 'document': {'title': 'Nothing relevant', 'body': 'No matches here'}}
+            ];
+
+        /*
+         * Create documents
+         */
+        scoredDocuments.forEach((document) =>
+        {
+            request('PUT', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document.document})
+        });
+
+        sleep(500);
+
+        /*
+         * Sort by relevance
+         */
+        let criteria =
+            {
+                'or':
+                    [
+                        {'contains': {'body': 'smith'}},
+                        {'contains': {'title': 'smith'}}
+                    ],
+                'sort': '_score'
+            };
+
+        let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(responses.results.map((result) => result.id)).to.deep.equal(['c', 'a', 'b']);
+        expect(responses.results[0]._score).to.be.above(responses.results[1]._score);
+        expect(responses.results[1]._score).to.be.above(responses.results[2]._score);
+        expect(responses.results[2]._score).to.be.above(0);
+        expect(responses.information.total_matches).to.equal(3);
+
+        /*
+         * Sort by relevance, ascending
+         */
+        criteria.sort = [{'field': '_score', 'order': 'asc'}];
+
+        let ascendingResponses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(ascendingResponses.results.map((result) => result.id)).to.deep.equal(['b', 'a', 'c']);
+
+        /*
+         * Remove documents
+         */
+        scoredDocuments.forEach((document) =>
+        {
+            request('DELETE', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}})
+        });
+
+        sleep(500);
+
+    });
+
+
     it('can bulk delete documents', () =>
     {
 
@@ -479,11 +800,9 @@ describe('Search', function()
 
         let deletionRequest = JSON.parse(request('POST', 'http://127.0.0.1:9999/_delete', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
 
-        expect(deletionRequest).to.deep.equal(
-            {
-                'message': '2 document(s) will be removed',
-                'success': true
-            });
+        expect(deletionRequest.success).to.equal(true);
+        expect(deletionRequest.message).to.equal('2 of 2 document(s) have been removed');
+        expect(deletionRequest.task.deleted).to.equal(2);
 
         sleep(500);
 
@@ -705,3 +1024,139 @@ describe('Significant terms', function()
 
 
 });
+
+
+describe('Aggregations', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Truncate the database
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+    });
+
+
+    it('can be computed over all matching documents', () =>
+    {
+
+        /*
+         * Create documents
+         */
+        documents.forEach((document) =>
+        {
+            request('PUT', 'http://127.0.0.1:9999/' + document.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': document.document})
+        });
+
+        sleep(500);
+
+        /*
+         * Request aggregations alongside a single result
+         */
+        let criteria =
+            {
+                'aggregations':
+                    {
+                        'surnames': {'terms': {'field': 'name.last'}},
+                        'top_surname': {'terms': {'field': 'name.last', 'size': 1}},
+                        'ages': {'histogram': {'field': 'age', 'interval': 5}},
+                        'joined_per_year': {'date_histogram': {'field': 'joined', 'interval': 'year'}},
+                        'age_stats': {'stats': {'field': 'age'}}
+                    }
+            };
+
+        let responses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search?size=1', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': criteria}).getBody().toString('utf8'));
+
+        expect(responses.results.length).to.equal(1);
+        expect(responses.criteria).to.deep.equal({});
+
+        expect(responses.aggregations).to.deep.equal(
+            {
+                'surnames':
+                    {
+                        'buckets': [{'key': 'Doe', 'doc_count': 2}, {'key': 'Smith', 'doc_count': 1}],
+                        'sum_other_doc_count': 0
+                    },
+                'top_surname':
+                    {
+                        'buckets': [{'key': 'Doe', 'doc_count': 2}],
+                        'sum_other_doc_count': 1
+                    },
+                'ages':
+                    {
+                        'buckets': [{'key': 25, 'doc_count': 1}, {'key': 30, 'doc_count': 2}]
+                    },
+                'joined_per_year':
+                    {
+                        'buckets': [{'key': '2017-01-01T00:00:00Z', 'doc_count': 1}, {'key': '2018-01-01T00:00:00Z', 'doc_count': 2}]
+                    },
+                'age_stats':
+                    {
+                        'count': 3,
+                        'min': 27,
+                        'max': 32,
+                        'avg': 89 / 3,
+                        'sum': 89
+                    }
+            }
+        );
+
+        /*
+         * Aggregations only cover documents matching the criteria
+         */
+        let filteredCriteria =
+            {
+                'and':
+                    [
+                        {'gt': {'age': 27}}
+                    ],
+                'aggregations':
+                    {
+                        'surnames': {'terms': {'field': 'name.last'}},
+                        'interests': {'terms': {'field': 'interests'}}
+                    }
+            };
+
+        let filteredResponses = JSON.parse(request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': filteredCriteria}).getBody().toString('utf8'));
+
+        expect(filteredResponses.aggregations.surnames.buckets).to.deep.equal([{'key': 'Doe', 'doc_count': 2}]);
+        expect(filteredResponses.aggregations.interests.buckets.length).to.equal(4);
+
+    });
+
+
+    it('returns an error for an unknown aggregation type', () =>
+    {
+
+        try
+        {
+
+            request('POST', 'http://127.0.0.1:9999/_search', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'aggregations': {'ages': {'median': {'field': 'age'}}}}}).getBody();
+
+            expect(true).to.equal(false);
+
+        }
+
+        catch (error)
+        {
+
+            let badAggregationResponse = JSON.parse(error.body.toString('utf8'));
+
+            expect(badAggregationResponse).to.deep.equal(
+                {
+                    'message': 'Aggregation \'ages\' has an unknown type',
+                    'success': false
+                }
+            );
+
+        }
+
+    });
+
+
+});
@@ -0,0 +1,123 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Delete by query', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/tasks/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        let lines = [];
+
+        for (let i = 1; i <= 5; i++)
+        {
+            lines.push(JSON.stringify({'index': {'id': 'doc' + i}}), JSON.stringify({'colour': i <= 3 ? 'red' : 'blue'}));
+        }
+
+        request('POST', 'http://127.0.0.1:9999/tasks/_bulk?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': lines.join('\n') + '\n'}).getBody();
+    });
+
+
+    /*
+     * Remove the red documents with some URL parameters
+     */
+    function deleteRed(params)
+    {
+        return request('POST', 'http://127.0.0.1:9999/tasks/_delete' + params, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'equals': {'colour': 'red'}}]}});
+    }
+
+
+    /*
+     * Count the documents left in the collection on a node
+     */
+    function count(port)
+    {
+        return JSON.parse(request('GET', 'http://127.0.0.1:' + port + '/tasks/_count', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8')).count;
+    }
+
+
+    it('reports the outcome of its task', () =>
+    {
+
+        let response = JSON.parse(deleteRed('?wait_for=replicated').getBody().toString('utf8'));
+
+        expect(response.success).to.equal(true);
+        expect(response.task.action).to.equal('delete_by_query');
+        expect(response.task.status).to.equal('completed');
+        expect(response.task.total).to.equal(3);
+        expect(response.task.processed).to.equal(3);
+        expect(response.task.deleted).to.equal(3);
+        expect(response.task.failed).to.equal(0);
+
+        expect(count(9999)).to.equal(2);
+        expect(count(9997)).to.equal(2);
+
+        let taskResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/_tasks/' + response.task.id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(taskResponse.task.deleted).to.equal(3);
+
+        let missingResponse = request('GET', 'http://127.0.0.1:9999/_tasks/missing', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(missingResponse.statusCode).to.equal(404);
+
+    });
+
+
+    it('can be limited or run as a dry run', () =>
+    {
+
+        let dryResponse = JSON.parse(deleteRed('?dry_run=true').getBody().toString('utf8'));
+
+        expect(dryResponse.message).to.equal('3 document(s) would be removed');
+        expect(dryResponse.task.deleted).to.equal(0);
+        expect(count(9999)).to.equal(5);
+
+        let limitedResponse = JSON.parse(deleteRed('?max_docs=2').getBody().toString('utf8'));
+
+        expect(limitedResponse.task.deleted).to.equal(2);
+        expect(count(9999)).to.equal(3);
+
+        let invalidResponse = deleteRed('?max_docs=lots');
+
+        expect(invalidResponse.statusCode).to.equal(400);
+
+    });
+
+
+    it('can run in the background', () =>
+    {
+
+        let response = deleteRed('?wait_for_completion=false');
+
+        expect(response.statusCode).to.equal(202);
+
+        let taskId = JSON.parse(response.body.toString('utf8')).task.id;
+
+        sleep(250);
+
+        let taskResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/_tasks/' + taskId, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(taskResponse.task.status).to.equal('completed');
+        expect(taskResponse.task.deleted).to.equal(3);
+
+        let listResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/_tasks', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(listResponse.tasks.map((task) => task.id)).to.include(taskId);
+
+    });
+
+
+});
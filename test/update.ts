@@ -0,0 +1,123 @@
+import { expect } from 'chai';
+import * as request from 'sync-request';
+import * as sleep from 'sleep-sync';
+import * as btoa from 'btoa';
+
+
+describe('Update by query', function()
+{
+
+
+    this.timeout(5000);
+
+
+    /*
+     * Create a fresh set of documents
+     */
+    beforeEach(() =>
+    {
+        request('DELETE', 'http://127.0.0.1:9999/updates/_all', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+        let lines = [
+            JSON.stringify({'index': {'id': 'ticket1'}}), JSON.stringify({'status': 'open', 'views': 1, 'tags': ['bug'], 'owner': 'sam'}),
+            JSON.stringify({'index': {'id': 'ticket2'}}), JSON.stringify({'status': 'open', 'views': 'many'}),
+            JSON.stringify({'index': {'id': 'ticket3'}}), JSON.stringify({'status': 'closed', 'views': 5})
+        ];
+
+        request('POST', 'http://127.0.0.1:9999/updates/_bulk?wait_for=replicated', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'body': lines.join('\n') + '\n'}).getBody();
+    });
+
+
+    /*
+     * Update the open tickets with a set of operations
+     */
+    function updateOpen(operations, params = '')
+    {
+        return request('POST', 'http://127.0.0.1:9999/updates/_update_by_query' + params, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'equals': {'status': 'open'}}], 'operations': operations}});
+    }
+
+
+    /*
+     * Get a document from a node
+     */
+    function getTicket(port, id)
+    {
+        return JSON.parse(request('GET', 'http://127.0.0.1:' + port + '/updates/' + id, {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+    }
+
+
+    it('applies operations to the matching documents', () =>
+    {
+
+        let response = JSON.parse(updateOpen([
+            {'op': 'set', 'field': 'flags.reviewed', 'value': true},
+            {'op': 'append', 'field': 'tags', 'value': 'triaged'},
+            {'op': 'rename', 'field': 'owner', 'to': 'assignee'},
+            {'op': 'unset', 'field': 'missing'}
+        ], '?wait_for=replicated').getBody().toString('utf8'));
+
+        expect(response.success).to.equal(true);
+        expect(response.message).to.equal('2 of 2 document(s) have been updated');
+        expect(response.task.action).to.equal('update_by_query');
+        expect(response.task.updated).to.equal(2);
+
+        for (let port of [9999, 9997])
+        {
+            expect(getTicket(port, 'ticket1')).to.deep.equal({'status': 'open', 'views': 1, 'tags': ['bug', 'triaged'], 'assignee': 'sam', 'flags': {'reviewed': true}});
+            expect(getTicket(port, 'ticket2')).to.deep.equal({'status': 'open', 'views': 'many', 'tags': ['triaged'], 'flags': {'reviewed': true}});
+            expect(getTicket(port, 'ticket3')).to.deep.equal({'status': 'closed', 'views': 5});
+        }
+
+        let searchResponse = JSON.parse(request('POST', 'http://127.0.0.1:9999/updates/_count', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'and': [{'equals': {'assignee': 'sam'}}]}}).getBody().toString('utf8'));
+
+        expect(searchResponse.count).to.equal(1);
+
+    });
+
+
+    it('reports the documents that could not be updated', () =>
+    {
+
+        let response = JSON.parse(updateOpen([{'op': 'increment', 'field': 'views', 'value': 2}]).getBody().toString('utf8'));
+
+        expect(response.success).to.equal(false);
+        expect(response.message).to.equal('1 of 2 document(s) have been updated');
+        expect(response.task.failed).to.equal(1);
+        expect(response.task.failures[0].id).to.equal('ticket2');
+        expect(response.task.failures[0].errors).to.deep.equal(['\'views\' is not a number, so cannot be incremented']);
+
+        expect(getTicket(9999, 'ticket1').views).to.equal(3);
+        expect(getTicket(9999, 'ticket2').views).to.equal('many');
+
+    });
+
+
+    it('can be run as a dry run', () =>
+    {
+
+        let response = JSON.parse(updateOpen([{'op': 'set', 'field': 'status', 'value': 'closed'}], '?dry_run=true').getBody().toString('utf8'));
+
+        expect(response.message).to.equal('2 document(s) would be updated');
+        expect(getTicket(9999, 'ticket1').status).to.equal('open');
+
+    });
+
+
+    it('rejects invalid operations', () =>
+    {
+
+        expect(updateOpen([]).statusCode).to.equal(400);
+        expect(updateOpen([{'op': 'multiply', 'field': 'views'}]).statusCode).to.equal(400);
+        expect(updateOpen([{'op': 'set', 'field': 'status'}]).statusCode).to.equal(400);
+        expect(updateOpen([{'op': 'rename', 'field': 'owner'}]).statusCode).to.equal(400);
+
+        let response = JSON.parse(updateOpen([{'op': 'increment', 'field': 'views', 'value': 'one'}]).body.toString('utf8'));
+
+        expect(response.message).to.equal('The \'increment\' operation on \'views\' must have a numeric value');
+
+    });
+
+
+});
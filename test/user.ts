@@ -362,4 +362,111 @@ describe('User management', function()
     });
 
 
+    it('enforces the permissions granted by roles', function()
+    {
+
+        /*
+         * Create a reader and a writer
+         */
+        request('PUT', 'http://127.0.0.1:9999/_user/reader', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'password': 'bar', 'roles': ['reader']}});
+        request('PUT', 'http://127.0.0.1:9999/_user/writer', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'password': 'bar'}});
+
+        sleep(250);
+
+        /*
+         * Ensure that the reader can read but not write
+         */
+        let readResponse = request('GET', 'http://127.0.0.1:9998/_stats', {'headers': {'Authorization': 'Basic ' + btoa('reader:bar')}});
+
+        expect(readResponse.statusCode).to.equal(200);
+
+        let writeResponse = request('PUT', 'http://127.0.0.1:9998/rbac', {'headers': {'Authorization': 'Basic ' + btoa('reader:bar')}, 'json': {'foo': 'bar'}});
+
+        expect(writeResponse.statusCode).to.equal(403);
+        expect(JSON.parse(writeResponse.body.toString('utf8'))).to.deep.equal(
+            {
+                'message': 'Access denied',
+                'success': false
+            }
+        );
+
+        /*
+         * Ensure that the writer can write but not remove all documents
+         */
+        let writerResponse = request('PUT', 'http://127.0.0.1:9999/rbac', {'headers': {'Authorization': 'Basic ' + btoa('writer:bar')}, 'json': {'foo': 'bar'}});
+
+        expect(writerResponse.statusCode).to.equal(202);
+
+        let truncateResponse = request('DELETE', 'http://127.0.0.1:9999/_all', {'headers': {'Authorization': 'Basic ' + btoa('writer:bar')}});
+
+        expect(truncateResponse.statusCode).to.equal(403);
+
+        /*
+         * Grant the writer the truncate permission and ensure it is listed
+         */
+        request('PUT', 'http://127.0.0.1:9999/_user/writer', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'permissions': ['documents:truncate']}});
+
+        sleep(250);
+
+        let userResponse = JSON.parse(request('GET', 'http://127.0.0.1:9997/_user/writer', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+
+        expect(userResponse).to.deep.equal(
+            {
+                'username': 'writer',
+                'roles': ['writer'],
+                'permissions': ['documents:truncate'],
+                'effective_permissions': ['documents:read', 'documents:write', 'documents:truncate', 'stats:read']
+            }
+        );
+
+        /*
+         * Clean up
+         */
+        request('DELETE', 'http://127.0.0.1:9999/rbac', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        request('DELETE', 'http://127.0.0.1:9999/_user/reader', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+        request('DELETE', 'http://127.0.0.1:9999/_user/writer', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        sleep(250);
+
+    });
+
+
+    it('lists users along with their roles', function()
+    {
+
+        let listResponse = JSON.parse(request('GET', 'http://127.0.0.1:9999/_user', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}}).getBody().toString('utf8'));
+        let rootUser     = listResponse.users.filter(user => user.username === 'root')[0];
+
+        expect(rootUser.roles).to.deep.equal(['admin']);
+
+    });
+
+
+    it('fails to grant a role that does not exist', function()
+    {
+
+        let response = request('PUT', 'http://127.0.0.1:9999/_user/foo', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}, 'json': {'password': 'bar', 'roles': ['superuser']}});
+
+        expect(response.statusCode).to.equal(400);
+        expect(JSON.parse(response.body.toString('utf8'))).to.deep.equal(
+            {
+                'success': false,
+                'username': 'foo',
+                'message': 'Role \'superuser\' does not exist'
+            }
+        );
+
+    });
+
+
+    it('refuses to delete the root user', function()
+    {
+
+        let response = request('DELETE', 'http://127.0.0.1:9999/_user/root', {'headers': {'Authorization': 'Basic ' + btoa('root:password')}});
+
+        expect(response.statusCode).to.equal(400);
+
+    });
+
+
 });